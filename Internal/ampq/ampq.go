@@ -1,49 +1,97 @@
 package ampq
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	transfer "github.com/sv-z/amqproxy/Internal/ampq/data-transfer"
 	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
 	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
 )
 
+// How long the peer has to answer connection.close with connection.close-ok
+const closeTimeout = time.Second
+
 type Connection struct {
-	Connected bool
-	rw        *io.ReadWriter
-	spec      *spec091.Spec
+	Connected        bool
+	ClientProperties transfer.Table
+	ServerProperties transfer.Table // sent in connection.start, set before Open
+	Offer            Tune           // limits offered in connection.tune, set before Open
+	Tune             Tune           // limits the client agreed to
+	User             string
+	Mechanism        string // SASL mechanism the client was authenticated with
+	VirtualHost      string
+	IdentityHeader   string // header the published messages get the user in, set before Relay, none when empty
+	password         string
+	auth             Authenticator
+	rw               *io.ReadWriter
+	spec             *spec091.Spec
+	heartbeat        *heartbeat
+	frames           chan *spec091.Frame
+	closed           chan struct{} // closed once the client connection is gone
+	err              error
+	channels         *channelMap   // filled while the connection is relayed
+	topology         *topology     // filled while the connection is relayed
+	killed           chan struct{} // closed by Kill
+	killOnce         sync.Once
+	killErr          *spec091.Error
+	draining         chan struct{} // closed by Drain
+	drainOnce        sync.Once
+	drainErr         *spec091.Error
 }
 
-func NewConnection(readWriter io.ReadWriter) *Connection {
+func NewConnection(readWriter io.ReadWriter, auth Authenticator) *Connection {
+	spec := spec091.NewSpec091(&readWriter)
+	spec.SetMechanisms(auth.Mechanisms())
+
 	return &Connection{
-		rw:   &readWriter,
-		spec: spec091.NewSpec091(&readWriter),
+		Offer:    DefaultTune,
+		auth:     auth,
+		rw:       &readWriter,
+		spec:     spec,
+		frames:   make(chan *spec091.Frame, 64),
+		closed:   make(chan struct{}),
+		killed:   make(chan struct{}),
+		draining: make(chan struct{}),
+		// created with the connection, the admin API reads them while the relay fills them
+		channels: newChannelMap(),
+		topology: newTopology(),
 	}
 }
 
-//    Connection          = open-Connection *use-Connection close-Connection
-//    open-Connection     = C:protocol-header
-//                          S:START C:START-OK
-//                          *challenge
-//                          S:TUNE C:TUNE-OK
-//                          C:OPEN S:OPEN-OK
-//    challenge           = S:SECURE C:SECURE-OK
-//    use-Connection      = *channel
-//    close-Connection    = C:CLOSE S:CLOSE-OK
-//                        / S:CLOSE C:CLOSE-OK
-func (c Connection) Open() error {
+// Handshake of the client connection, the grammar of the AMQP 0-9-1 specification:
+//
+//	Connection          = open-Connection *use-Connection close-Connection
+//	open-Connection     = C:protocol-header
+//	                      S:START C:START-OK
+//	                      *challenge
+//	                      S:TUNE C:TUNE-OK
+//	                      C:OPEN S:OPEN-OK
+//	challenge           = S:SECURE C:SECURE-OK
+//	use-Connection      = *channel
+//	close-Connection    = C:CLOSE S:CLOSE-OK
+//	                    / S:CLOSE C:CLOSE-OK
+func (c *Connection) Open() (err error) {
+	defer func() {
+		if err != nil {
+			c.abort(err)
+		}
+	}()
 
 	//The client MUST start a new connection by sending a protocol header.
 	// C:protocol-header
 	protocolHeader := make([]byte, 8)
-	reader := bufio.NewReader(*c.rw)
-	if _, err := reader.Read(protocolHeader); err == io.EOF {
+	if _, err := io.ReadFull(*c.rw, protocolHeader); err != nil {
 		return err
 	}
 
+	// The server answers an unsupported protocol with the header it supports and closes the socket
 	if !c.checkProtocol(protocolHeader) {
-		return fmt.Errorf("unsupported protocol: '%v'", protocolHeader)
+		c.spec.PushProtocolHeader()
+		return &refusal{reason: "protocol", text: fmt.Sprintf("unsupported protocol: '%v'", protocolHeader)}
 	}
 
 	// S:START >> C:START-OK
@@ -63,6 +111,159 @@ func (c Connection) Open() error {
 
 	c.Connected = true
 
+	go c.readLoop()
+
+	c.heartbeat = startHeartbeat(c.spec, c.Tune.Heartbeat, func() {
+		// the client is gone, there is nobody to wait a close-ok from
+		c.sendClose(spec091.NewError(spec091.ConnectionForced, "missed heartbeats from client, timeout: %ds", c.Tune.Heartbeat))
+		c.Close()
+	})
+
+	return nil
+}
+
+// Read frames from the client until the connection is gone, the heartbeats are consumed here.
+// The frames channel is closed afterwards and err tells why.
+func (c *Connection) readLoop() {
+	defer close(c.frames)
+
+	for {
+		frame, err := c.spec.ReadFrame()
+		if err != nil {
+			c.err = err
+			close(c.closed)
+			return
+		}
+
+		if frame.Type == spec091.FrameHeartbeat {
+			continue
+		}
+
+		c.frames <- frame
+	}
+}
+
+// Tell the client why the connection is closed and close it.
+// AMQP exceptions keep their reply code, any other error is reported as an internal error.
+// Nobody else may read the client frames meanwhile.
+func (c *Connection) CloseWithError(err error) {
+	e, ok := err.(*spec091.Error)
+	if !ok {
+		e = spec091.NewError(spec091.InternalError, "proxy failure")
+	}
+
+	if c.sendClose(e) && c.Connected {
+		c.awaitCloseOk()
+	}
+
+	c.Close()
+}
+
+func (c *Connection) sendClose(e *spec091.Error) bool {
+	return c.spec.WriteMethod(0, &spec091.ConnectionClose{
+		ReplyCode: e.Code,
+		ReplyText: e.Text,
+		ClassId:   e.ClassId,
+		MethodId:  e.MethodId,
+	}) == nil
+}
+
+// After connection.close the client may only answer with connection.close-ok, everything else is dropped
+func (c *Connection) awaitCloseOk() {
+	timeout := time.After(closeTimeout)
+
+	for {
+		select {
+		case frame, ok := <-c.frames:
+			if !ok {
+				return
+			}
+			if method, err := frame.Method(); err == nil {
+				if _, ok := method.(*spec091.ConnectionCloseOk); ok {
+					return
+				}
+			}
+
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// The handshake failed: the client is told why unless it closed the connection itself
+func (c *Connection) abort(err error) {
+	if e, ok := err.(*spec091.Error); ok && !e.Received {
+		c.sendClose(e)
+	}
+
+	c.Close()
+}
+
+// Have the connection closed with connection.close and the reply text, the relay or the spool sends it.
+// A connection not relayed yet is closed once it is.
+func (c *Connection) Kill(text string) {
+	c.killOnce.Do(func() {
+		c.killErr = spec091.NewError(spec091.ConnectionForced, "%s", text)
+		close(c.killed)
+	})
+}
+
+// Have the connection closed like Kill once the client has nothing in flight:
+// no published message half sent and no publish waiting for its confirm
+func (c *Connection) Drain(text string) {
+	c.drainOnce.Do(func() {
+		c.drainErr = spec091.NewError(spec091.ConnectionForced, "%s", text)
+		close(c.draining)
+	})
+}
+
+// Watch the frames of the client, set before Open
+func (c *Connection) Observe(observer spec091.Observer) {
+	c.spec.SetObserver(observer)
+}
+
+// Handshake failure the client learns about only by the closed socket
+type refusal struct {
+	reason string
+	text   string
+}
+
+func (r *refusal) Error() string {
+	return r.text
+}
+
+// Why Open failed in short like "access_refused", "closed" or "timeout"
+func HandshakeFailure(err error) string {
+	switch e := err.(type) {
+	case *refusal:
+		return e.reason
+	case *spec091.Error:
+		if name := spec091.ReplyName(e.Code); name != "" {
+			return strings.ToLower(name)
+		}
+	case net.Error:
+		if e.Timeout() {
+			return "timeout"
+		}
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "closed"
+	}
+
+	return "error"
+}
+
+// Stop the heartbeats and close the client connection
+func (c *Connection) Close() error {
+	if c.heartbeat != nil {
+		c.heartbeat.Stop()
+	}
+
+	if closer, ok := (*c.rw).(io.Closer); ok {
+		return closer.Close()
+	}
+
 	return nil
 }
 
@@ -73,7 +274,17 @@ func (c *Connection) startOk() error {
 		return fmt.Errorf("cannot send response \"connection.start\"")
 	}
 
-	if _, err := c.spec.PullConnectionStartOk(); err != nil {
+	startOk, err := c.spec.PullConnectionStartOk()
+	if err != nil {
+		return err
+	}
+	c.ClientProperties = startOk.ClientProperties
+
+	if err := c.authenticate(startOk); err != nil {
+		// without authentication_failure_close the client only expects the socket to be closed
+		if e, ok := err.(*spec091.Error); ok && e.Code == spec091.AccessRefused && !clientCapability(c.ClientProperties, "authentication_failure_close") {
+			return &refusal{reason: "access_refused", text: e.Text}
+		}
 		return err
 	}
 
@@ -84,14 +295,27 @@ func (c *Connection) startOk() error {
 // The client return connection.tune-ok
 func (c *Connection) tuneOK() error {
 
-	if !c.spec.PushConnectionTune() {
-		return fmt.Errorf("cannot send response \"connection.tune-ok\"")
+	if !c.spec.PushConnectionTune(c.Offer.ChannelMax, c.Offer.FrameMax, c.Offer.Heartbeat) {
+		return fmt.Errorf("cannot send response \"connection.tune\"")
+	}
+
+	tuneOk, err := c.spec.PullConnectionTuneOK()
+	if err != nil {
+		return err
 	}
 
-	if _, err := c.spec.PullConnectionTuneOK(); err != nil {
+	tune := Tune{
+		ChannelMax: tuneOk.ChannelMax,
+		FrameMax:   tuneOk.FrameMax,
+		Heartbeat:  tuneOk.Heartbeat,
+	}
+	if err := c.Offer.check(tune); err != nil {
 		return err
 	}
 
+	c.Tune = tune
+	c.spec.SetFrameMax(c.Tune.FrameMax)
+
 	return nil
 }
 
@@ -99,9 +323,11 @@ func (c *Connection) tuneOK() error {
 // The server return connection open-ok
 func (c *Connection) openOK() error {
 
-	if _, err := c.spec.PullConnectionOpen(); err != nil {
-		panic(err)
+	open, err := c.spec.PullConnectionOpen()
+	if err != nil {
+		return err
 	}
+	c.VirtualHost = open.VirtualHost
 
 	if !c.spec.PushConnectionOpenOK() {
 		return fmt.Errorf("cannot send response \"connection.open-ok\"")
@@ -110,31 +336,30 @@ func (c *Connection) openOK() error {
 	return nil
 }
 
-func (s Connection) checkProtocol(protocolHeader []byte) bool {
+// Upstream channel ids by client channel id, empty until the connection is relayed
+func (c *Connection) Channels() map[uint16]uint16 {
+	return c.channels.snapshot()
+}
+
+// Consumer tags by client channel id, empty until the connection is relayed
+func (c *Connection) Consumers() map[uint16][]string {
+	return c.topology.consumers()
+}
+
+// The password the client presented, it is only known for the password mechanisms
+func (c *Connection) Password() string {
+	return c.password
+}
+
+func (s *Connection) checkProtocol(protocolHeader []byte) bool {
 	return bytes.Compare(protocolHeader, []byte{'A', 'M', 'Q', 'P', 0, 0, 9, 1}) == 0
 }
 
 func (c *Connection) sendStart() bool {
+	properties := c.ServerProperties
+	if properties == nil {
+		properties = ServerProperties(nil, nil)
+	}
 
-	args := transfer.Table{
-		"capabilities": transfer.Table{
-			"consumer_priorities":          true,
-			"authentication_failure_close": true,
-			"direct_reply_to":              true,
-			"publisher_confirms":           true,
-			"exchange_exchange_bindings":   true,
-			"basic.nack":                   true,
-			"consumer_cancel_notify":       true,
-			"connection.blocked":           true,
-			"per_consumer_qos":             true,
-		},
-		"cluster_name": "rabbit@rabbit",
-		"copyright":    "Copyright (c) 2007-2019 Pivotal Software, Inc.",
-		"information":  "Licensed under the MPL 1.1. Website: https://rabbitmq.com",
-		"platform":     "Erlang/OTP 22.2.4",
-		"product":      "RabbitMQ",
-		"version":      "3.8.2",
-	}
-
-	return c.spec.PushConnectionStart(&args)
+	return c.spec.PushConnectionStart(&properties)
 }
@@ -0,0 +1,184 @@
+package ampq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	logger "github.com/sirupsen/logrus"
+	transfer "github.com/sv-z/amqproxy/Internal/ampq/data-transfer"
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+	"strings"
+)
+
+// Authenticator decides who the client is during the connection handshake
+type Authenticator interface {
+	// SASL mechanisms offered in connection.start, the preferred one first
+	Mechanisms() []string
+	// Check the connection.start-ok response of the chosen mechanism.
+	// The mechanism may ask for more with challenge, it sends connection.secure and returns the secure-ok response.
+	Authenticate(mechanism string, response string, challenge Challenge) (*Identity, error)
+}
+
+// Challenge sends connection.secure to the client and returns its response
+type Challenge func(challenge string) (string, error)
+
+// Identity is the authenticated client
+type Identity struct {
+	User     string
+	Password string // empty when the mechanism does not carry a password
+}
+
+// UserStore checks the passwords of the clients
+type UserStore interface {
+	Verify(user string, password string) bool
+}
+
+// ErrAccessRefused is returned when the credentials are wrong
+var ErrAccessRefused = fmt.Errorf("access refused")
+
+// PasswordAuthenticator accepts PLAIN and AMQPLAIN.
+// Without a user store any credentials pass. The broker checks them only when the upstream connection
+// is opened with the client's own credentials, not with configured ones or a service account.
+type PasswordAuthenticator struct {
+	Users UserStore
+}
+
+func NewPasswordAuthenticator(users UserStore) *PasswordAuthenticator {
+	return &PasswordAuthenticator{Users: users}
+}
+
+func (a *PasswordAuthenticator) Mechanisms() []string {
+	return []string{"PLAIN", "AMQPLAIN"}
+}
+
+func (a *PasswordAuthenticator) Authenticate(mechanism string, response string, challenge Challenge) (*Identity, error) {
+	var (
+		user, password string
+		err            error
+	)
+
+	switch mechanism {
+	case "PLAIN":
+		user, password, err = parsePlain(response)
+	case "AMQPLAIN":
+		user, password, err = parseAmqplain(response)
+	default:
+		return nil, fmt.Errorf("unsupported mechanism %q", mechanism)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if a.Users != nil && !a.Users.Verify(user, password) {
+		return nil, ErrAccessRefused
+	}
+
+	return &Identity{User: user, Password: password}, nil
+}
+
+// ExternalAuthenticator offers EXTERNAL on top of the other mechanisms.
+// The identity was established outside of AMQP, by the client certificate verified during the TLS handshake.
+type ExternalAuthenticator struct {
+	Authenticator
+	User string
+}
+
+func NewExternalAuthenticator(next Authenticator, user string) *ExternalAuthenticator {
+	return &ExternalAuthenticator{Authenticator: next, User: user}
+}
+
+func (a *ExternalAuthenticator) Mechanisms() []string {
+	return append([]string{"EXTERNAL"}, a.Authenticator.Mechanisms()...)
+}
+
+// The EXTERNAL response is the authorization identity, empty to take the one of the certificate
+func (a *ExternalAuthenticator) Authenticate(mechanism string, response string, challenge Challenge) (*Identity, error) {
+	if mechanism != "EXTERNAL" {
+		return a.Authenticator.Authenticate(mechanism, response, challenge)
+	}
+
+	if response != "" && response != a.User {
+		return nil, fmt.Errorf("certificate of %q cannot act as %q", a.User, response)
+	}
+
+	return &Identity{User: a.User}, nil
+}
+
+// PLAIN response is "authzid \0 authcid \0 passwd"
+func parsePlain(response string) (user string, password string, err error) {
+	parts := strings.SplitN(response, "\x00", 3)
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("malformed PLAIN response")
+	}
+
+	return parts[1], parts[2], nil
+}
+
+// AMQPLAIN response is a field table with LOGIN and PASSWORD, sent without the table size
+func parseAmqplain(response string) (user string, password string, err error) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(response)))
+	buf.WriteString(response)
+
+	table, err := transfer.NewDataReader(&buf).ReadTable()
+	if err != nil {
+		return "", "", fmt.Errorf("malformed AMQPLAIN response: %s", err)
+	}
+
+	user, userOk := table["LOGIN"].(string)
+	password, passwordOk := table["PASSWORD"].(string)
+	if !userOk || !passwordOk {
+		return "", "", fmt.Errorf("malformed AMQPLAIN response: LOGIN and PASSWORD are required")
+	}
+
+	return user, password, nil
+}
+
+// Run the authentication of connection.start-ok, the failures are reported with access-refused
+func (c *Connection) authenticate(startOk *spec091.ConnectionStartOk) error {
+	offered := false
+	for _, mechanism := range c.auth.Mechanisms() {
+		offered = offered || mechanism == startOk.Mechanism
+	}
+	if !offered {
+		return spec091.NewError(spec091.CommandInvalid, "unknown authentication mechanism '%s'", startOk.Mechanism)
+	}
+
+	challenge := func(challenge string) (string, error) {
+		if !c.spec.PushConnectionSecure(challenge) {
+			return "", fmt.Errorf("cannot send response \"connection.secure\"")
+		}
+
+		secureOk, err := c.spec.PullConnectionSecureOk()
+		if err != nil {
+			return "", err
+		}
+
+		return secureOk.Response, nil
+	}
+
+	identity, err := c.auth.Authenticate(startOk.Mechanism, startOk.Response, challenge)
+	if err != nil {
+		// the client closed the connection or broke the protocol during a challenge
+		if _, ok := err.(*spec091.Error); ok {
+			return err
+		}
+
+		logger.Debug(fmt.Sprintf("Authentication with %s failed: %s", startOk.Mechanism, err.Error()))
+
+		return spec091.NewError(spec091.AccessRefused, "Login was refused using authentication mechanism %s", startOk.Mechanism)
+	}
+
+	c.User, c.password = identity.User, identity.Password
+	c.Mechanism = startOk.Mechanism
+
+	return nil
+}
+
+// A capability the client announced in its connection.start-ok properties
+func clientCapability(properties transfer.Table, name string) bool {
+	capabilities, _ := properties["capabilities"].(transfer.Table)
+	enabled, _ := capabilities[name].(bool)
+
+	return enabled
+}
@@ -0,0 +1,130 @@
+package ampq
+
+import (
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+)
+
+// What a client did with an upstream channel.
+// It decides whether the channel can be kept open for the next client.
+type channelState struct {
+	open      bool   // channel open-ok was received
+	closing   bool   // channel close was sent by either side, waiting for close-ok
+	confirm   bool   // confirm.select, cannot be undone
+	tx        bool   // tx.select, cannot be undone
+	qos       bool   // basic.qos, reset to the defaults before reuse
+	consumers bool   // basic.consume or basic.get, there may be unacknowledged deliveries
+	content   bool   // a basic.publish is waiting for its header and body frames
+	bodyLeft  uint64 // body bytes still expected for the content, zero until the header arrives
+}
+
+// Only plain publisher channels are handed over as is
+func (ch *channelState) reusable() bool {
+	return ch.open && !ch.closing && !ch.confirm && !ch.tx && !ch.consumers && !ch.content
+}
+
+// Track a frame the client sends on the upstream channel id, the frame still has the client channel.
+// Content frames out of order are refused before they reach the broker.
+func (u *Upstream) observeClient(id uint16, frame *spec091.Frame) error {
+	if frame.Channel == 0 {
+		return nil
+	}
+
+	ch := u.channels[id]
+
+	switch frame.Type {
+	case spec091.FrameHeader:
+		if ch == nil || !ch.content || ch.bodyLeft > 0 {
+			return spec091.NewError(spec091.UnexpectedFrame, "content header frame is not expected on channel %d", frame.Channel)
+		}
+
+		bodySize, err := frame.BodySize()
+		if err != nil {
+			return err
+		}
+		ch.bodyLeft = bodySize
+		ch.content = ch.bodyLeft > 0
+		return nil
+
+	case spec091.FrameBody:
+		if ch == nil || !ch.content || ch.bodyLeft == 0 {
+			return spec091.NewError(spec091.UnexpectedFrame, "content body frame is not expected on channel %d", frame.Channel)
+		}
+
+		if uint64(len(frame.Payload)) > ch.bodyLeft {
+			return spec091.NewError(spec091.FrameError, "content body on channel %d is bigger than announced", frame.Channel)
+		}
+		ch.bodyLeft -= uint64(len(frame.Payload))
+		ch.content = ch.bodyLeft > 0
+		return nil
+	}
+
+	method, err := frame.Method()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := method.(*spec091.ChannelOpen); ok {
+		u.channels[id] = &channelState{}
+		return nil
+	}
+
+	if ch == nil {
+		return spec091.NewError(spec091.ChannelError, "channel %d is not open", frame.Channel)
+	}
+
+	if ch.content {
+		return spec091.NewError(spec091.UnexpectedFrame, "%s received in the middle of a content on channel %d", method.Name(), frame.Channel)
+	}
+
+	switch method.(type) {
+	case *spec091.ChannelClose:
+		ch.closing = true
+	case *spec091.ChannelCloseOk:
+		delete(u.channels, id)
+	case *spec091.BasicQos:
+		ch.qos = true
+	case *spec091.BasicConsume, *spec091.BasicGet:
+		ch.consumers = true
+	case *spec091.BasicPublish:
+		ch.content = true
+	case *spec091.ConfirmSelect:
+		ch.confirm = true
+	case *spec091.TxSelect:
+		ch.tx = true
+	}
+
+	return nil
+}
+
+// Track a frame the broker sends on an upstream channel
+func (u *Upstream) observeUpstream(frame *spec091.Frame) {
+	if frame.Type != spec091.FrameMethod {
+		return
+	}
+
+	method, err := frame.Method()
+	if err != nil {
+		return
+	}
+
+	if frame.Channel == 0 {
+		if _, ok := method.(*spec091.ConnectionClose); ok {
+			u.closing = true
+		}
+		return
+	}
+
+	ch := u.channels[frame.Channel]
+	if ch == nil {
+		return
+	}
+
+	switch method.(type) {
+	case *spec091.ChannelOpenOk:
+		ch.open = true
+	case *spec091.ChannelClose:
+		ch.closing = true
+	case *spec091.ChannelCloseOk:
+		delete(u.channels, frame.Channel)
+	}
+}
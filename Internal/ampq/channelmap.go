@@ -0,0 +1,104 @@
+package ampq
+
+import (
+	"fmt"
+	logger "github.com/sirupsen/logrus"
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+	"sort"
+	"sync"
+)
+
+// channelMap translates the channel ids of a client to the ids of its upstream connection.
+// The relay changes it, anybody may read it to inspect the connection.
+type channelMap struct {
+	mu         sync.RWMutex
+	toUpstream map[uint16]uint16
+	toClient   map[uint16]uint16
+}
+
+func newChannelMap() *channelMap {
+	return &channelMap{
+		toUpstream: make(map[uint16]uint16),
+		toClient:   make(map[uint16]uint16),
+	}
+}
+
+func (m *channelMap) upstreamId(client uint16) (uint16, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	id, exists := m.toUpstream[client]
+	return id, exists
+}
+
+func (m *channelMap) clientId(upstream uint16) (uint16, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	id, exists := m.toClient[upstream]
+	return id, exists
+}
+
+func (m *channelMap) bind(client uint16, upstream uint16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.toUpstream[client] = upstream
+	m.toClient[upstream] = client
+
+	logger.Debug(fmt.Sprintf("Client channel %d mapped to upstream channel %d", client, upstream))
+}
+
+// Forget the client channel, the upstream one is free once the broker confirmed it is closed
+func (m *channelMap) release(client uint16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if upstream, exists := m.toUpstream[client]; exists {
+		delete(m.toUpstream, client)
+		delete(m.toClient, upstream)
+
+		logger.Debug(fmt.Sprintf("Client channel %d released upstream channel %d", client, upstream))
+	}
+}
+
+// Upstream channel ids by client channel id
+func (m *channelMap) snapshot() map[uint16]uint16 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	snapshot := make(map[uint16]uint16, len(m.toUpstream))
+	for client, upstream := range m.toUpstream {
+		snapshot[client] = upstream
+	}
+
+	return snapshot
+}
+
+// Pick the upstream channel for a new client channel.
+// A channel left open by a previous client is reused first, otherwise the lowest free id within channel-max is taken.
+func (u *Upstream) allocateChannel(mapped func(uint16) bool) (id uint16, reused bool, err error) {
+	var kept []int
+	for id, ch := range u.channels {
+		if ch.reusable() && !mapped(id) {
+			kept = append(kept, int(id))
+		}
+	}
+	if len(kept) > 0 {
+		sort.Ints(kept)
+		return uint16(kept[0]), true, nil
+	}
+
+	max := int(u.Tune.ChannelMax)
+	if max == 0 {
+		max = 65535
+	}
+
+	for id := 1; id <= max; id++ {
+		if _, exists := u.channels[uint16(id)]; !exists {
+			return uint16(id), false, nil
+		}
+	}
+
+	return 0, false, spec091.NewError(spec091.ResourceError, "no free channel on the upstream connection, channel_max is %d", max)
+}
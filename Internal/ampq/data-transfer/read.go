@@ -28,6 +28,10 @@ func (r *dataReader) ReadLongstr() (v string, err error) {
 	return readLongstr(*r.r)
 }
 
+func (r *dataReader) ReadTimestamp() (v time.Time, err error) {
+	return readTimestamp(*r.r)
+}
+
 /*
 'A': []interface{}
 'D': Decimal
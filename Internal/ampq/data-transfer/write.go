@@ -9,6 +9,30 @@ import (
 	"time"
 )
 
+type dataWriter struct {
+	w *io.Writer
+}
+
+func NewDataWriter(w io.Writer) *dataWriter {
+	return &dataWriter{w: &w}
+}
+
+func (w *dataWriter) WriteTable(table Table) (err error) {
+	return writeTable(*w.w, table)
+}
+
+func (w *dataWriter) WriteShortstr(v string) (err error) {
+	return writeShortstr(*w.w, v)
+}
+
+func (w *dataWriter) WriteLongstr(v string) (err error) {
+	return writeLongstr(*w.w, v)
+}
+
+func (w *dataWriter) WriteTimestamp(v time.Time) (err error) {
+	return binary.Write(*w.w, binary.BigEndian, uint64(v.Unix()))
+}
+
 func LongStrToByte(str string) []byte {
 	b := []byte(str)
 	var length = uint32(len(b))
@@ -0,0 +1,93 @@
+package ampq
+
+import (
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+)
+
+// fragmenter fits the frames going to one side of the relay into the frame-max of that side.
+// Content body frames are split, or coalesced per channel until they fill a frame or the content is complete,
+// so the body size announced by the content header stays the same.
+// Method and header frames cannot be split, a too big one is a frame error.
+type fragmenter struct {
+	frameMax uint32 // of the destination, zero means no limit
+	pending  map[uint16]*pendingBody
+}
+
+// Body of a content being forwarded on a channel
+type pendingBody struct {
+	left uint64 // body bytes not received yet
+	buf  []byte // received body bytes not forwarded yet
+}
+
+func newFragmenter(frameMax uint32) *fragmenter {
+	return &fragmenter{
+		frameMax: frameMax,
+		pending:  make(map[uint16]*pendingBody),
+	}
+}
+
+// Frames to send for a frame received from the other side
+func (f *fragmenter) push(frame *spec091.Frame) ([]*spec091.Frame, error) {
+	if f.frameMax == 0 {
+		return []*spec091.Frame{frame}, nil
+	}
+
+	switch frame.Type {
+	case spec091.FrameHeader:
+		bodySize, err := frame.BodySize()
+		if err != nil {
+			return nil, err
+		}
+
+		delete(f.pending, frame.Channel)
+		if bodySize > 0 {
+			f.pending[frame.Channel] = &pendingBody{left: bodySize}
+		}
+
+	case spec091.FrameBody:
+		return f.pushBody(frame)
+	}
+
+	if uint64(len(frame.Payload))+8 > uint64(f.frameMax) {
+		return nil, spec091.NewError(spec091.FrameError, "frame of %d bytes on channel %d exceeds frame-max %d of the other side", len(frame.Payload)+8, frame.Channel, f.frameMax)
+	}
+
+	return []*spec091.Frame{frame}, nil
+}
+
+func (f *fragmenter) pushBody(frame *spec091.Frame) ([]*spec091.Frame, error) {
+	body, exists := f.pending[frame.Channel]
+	if !exists {
+		return nil, spec091.NewError(spec091.UnexpectedFrame, "content body frame is not expected on channel %d", frame.Channel)
+	}
+
+	if uint64(len(frame.Payload)) > body.left {
+		return nil, spec091.NewError(spec091.FrameError, "content body on channel %d is bigger than announced", frame.Channel)
+	}
+	body.left -= uint64(len(frame.Payload))
+	body.buf = append(body.buf, frame.Payload...)
+
+	// frame header and frame end take 8 bytes
+	chunk := int(f.frameMax - 8)
+
+	var frames []*spec091.Frame
+	for len(body.buf) >= chunk || (body.left == 0 && len(body.buf) > 0) {
+		size := chunk
+		if len(body.buf) < size {
+			size = len(body.buf)
+		}
+
+		frames = append(frames, &spec091.Frame{
+			Type:    spec091.FrameBody,
+			Channel: frame.Channel,
+			Payload: body.buf[:size:size],
+		})
+		body.buf = body.buf[size:]
+	}
+
+	if body.left == 0 {
+		delete(f.pending, frame.Channel)
+	}
+
+	return frames, nil
+}
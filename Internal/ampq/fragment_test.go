@@ -0,0 +1,192 @@
+package ampq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+	"reflect"
+	"testing"
+)
+
+// Content header frame of basic with no properties
+func headerFrame(channel uint16, bodySize uint64) *spec091.Frame {
+	payload := make([]byte, 14)
+	binary.BigEndian.PutUint16(payload[0:2], 60)
+	binary.BigEndian.PutUint64(payload[4:12], bodySize)
+
+	return &spec091.Frame{Type: spec091.FrameHeader, Channel: channel, Payload: payload}
+}
+
+func body(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+
+	return b
+}
+
+func TestFragmenterBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		frameMax uint32
+		bodySize int
+		received []int // sizes of the body frames received, in order
+		sent     []int // sizes of the body frames sent
+	}{
+		{"same size", 4104, 4096, []int{4096}, []int{4096}},
+		{"split", 4104, 10000, []int{10000}, []int{4096, 4096, 1808}},
+		{"split exactly", 4104, 8192, []int{8192}, []int{4096, 4096}},
+		{"coalesce", 4104, 6000, []int{1000, 1000, 1000, 1000, 1000, 1000}, []int{4096, 1904}},
+		{"coalesce the last frames", 4104, 2500, []int{1000, 1000, 500}, []int{2500}},
+		{"uneven frame-max", 4100, 10000, []int{3000, 3000, 3000, 1000}, []int{4092, 4092, 1816}},
+		{"uneven frame-max split", 5000, 12345, []int{12345}, []int{4992, 4992, 2361}},
+		{"one byte", 4104, 1, []int{1}, []int{1}},
+		{"no limit", 0, 10000, []int{6000, 4000}, []int{6000, 4000}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFragmenter(test.frameMax)
+			content := body(test.bodySize)
+
+			frames, err := f.push(headerFrame(1, uint64(test.bodySize)))
+			if err != nil {
+				t.Fatalf("header: %s", err)
+			}
+			if len(frames) != 1 || frames[0].Type != spec091.FrameHeader {
+				t.Fatalf("header: got %d frames, want the header alone", len(frames))
+			}
+
+			var sent []int
+			var forwarded []byte
+			offset := 0
+			for _, size := range test.received {
+				frame := &spec091.Frame{Type: spec091.FrameBody, Channel: 1, Payload: content[offset : offset+size]}
+				offset += size
+
+				frames, err := f.push(frame)
+				if err != nil {
+					t.Fatalf("body: %s", err)
+				}
+				for _, frame := range frames {
+					if frame.Type != spec091.FrameBody || frame.Channel != 1 {
+						t.Fatalf("got a frame of type %d on channel %d", frame.Type, frame.Channel)
+					}
+					if test.frameMax > 0 && len(frame.Payload)+8 > int(test.frameMax) {
+						t.Errorf("frame of %d bytes exceeds frame-max %d", len(frame.Payload)+8, test.frameMax)
+					}
+					sent = append(sent, len(frame.Payload))
+					forwarded = append(forwarded, frame.Payload...)
+				}
+			}
+
+			if !reflect.DeepEqual(sent, test.sent) {
+				t.Errorf("sent body frames of %v bytes, want %v", sent, test.sent)
+			}
+			if !bytes.Equal(forwarded, content) {
+				t.Errorf("the forwarded body differs from the received one")
+			}
+			if len(f.pending) != 0 {
+				t.Errorf("content still pending after the whole body")
+			}
+		})
+	}
+}
+
+func TestFragmenterEmptyBody(t *testing.T) {
+	f := newFragmenter(4104)
+
+	frames, err := f.push(headerFrame(1, 0))
+	if err != nil {
+		t.Fatalf("header: %s", err)
+	}
+	if len(frames) != 1 {
+		t.Fatalf("header: got %d frames, want 1", len(frames))
+	}
+	if len(f.pending) != 0 {
+		t.Fatalf("content pending without a body")
+	}
+
+	// the content is complete with the header, a body frame is not expected anymore
+	_, err = f.push(&spec091.Frame{Type: spec091.FrameBody, Channel: 1, Payload: []byte{0}})
+	if e, ok := err.(*spec091.Error); !ok || e.Code != spec091.UnexpectedFrame {
+		t.Errorf("body after an empty content: got %v, want an unexpected frame error", err)
+	}
+}
+
+func TestFragmenterErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []*spec091.Frame
+		code   uint16
+	}{
+		{
+			"body without header",
+			[]*spec091.Frame{{Type: spec091.FrameBody, Channel: 1, Payload: body(10)}},
+			spec091.UnexpectedFrame,
+		},
+		{
+			"body bigger than announced",
+			[]*spec091.Frame{headerFrame(1, 10), {Type: spec091.FrameBody, Channel: 1, Payload: body(11)}},
+			spec091.FrameError,
+		},
+		{
+			"method bigger than frame-max",
+			[]*spec091.Frame{{Type: spec091.FrameMethod, Channel: 1, Payload: body(5000)}},
+			spec091.FrameError,
+		},
+		{
+			"truncated header",
+			[]*spec091.Frame{{Type: spec091.FrameHeader, Channel: 1, Payload: body(6)}},
+			spec091.SyntaxError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFragmenter(4104)
+
+			var err error
+			for _, frame := range test.frames {
+				if _, err = f.push(frame); err != nil {
+					break
+				}
+			}
+
+			e, ok := err.(*spec091.Error)
+			if !ok || e.Code != test.code {
+				t.Errorf("got %v, want reply code %d", err, test.code)
+			}
+		})
+	}
+}
+
+// Contents on different channels are coalesced separately
+func TestFragmenterChannels(t *testing.T) {
+	f := newFragmenter(4104)
+
+	for _, channel := range []uint16{1, 2} {
+		if _, err := f.push(headerFrame(channel, 3000)); err != nil {
+			t.Fatalf("header on channel %d: %s", channel, err)
+		}
+	}
+
+	sent := 0
+	for _, channel := range []uint16{1, 2, 1, 2} {
+		frames, err := f.push(&spec091.Frame{Type: spec091.FrameBody, Channel: channel, Payload: body(1500)})
+		if err != nil {
+			t.Fatalf("body on channel %d: %s", channel, err)
+		}
+		for _, frame := range frames {
+			if frame.Channel != channel || len(frame.Payload) != 3000 {
+				t.Errorf("got %d bytes on channel %d, want 3000 on channel %d", len(frame.Payload), frame.Channel, channel)
+			}
+		}
+		sent += len(frames)
+	}
+
+	if sent != 2 {
+		t.Errorf("sent %d body frames, want one per channel", sent)
+	}
+}
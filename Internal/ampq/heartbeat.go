@@ -0,0 +1,62 @@
+package ampq
+
+import (
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+	"sync"
+	"time"
+)
+
+// Heartbeat keeps one side of the proxy alive on its own negotiated interval:
+// it sends a heartbeat when nothing was sent for half of the interval
+// and gives up on the peer when nothing was received for two intervals.
+type heartbeat struct {
+	spec     *spec091.Spec
+	interval time.Duration
+	timeout  func()
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Start the heartbeat, zero seconds disables it
+func startHeartbeat(spec *spec091.Spec, seconds uint16, timeout func()) *heartbeat {
+	h := &heartbeat{
+		spec:     spec,
+		interval: time.Duration(seconds) * time.Second,
+		timeout:  timeout,
+		stop:     make(chan struct{}),
+	}
+
+	if seconds > 0 {
+		go h.loop()
+	}
+
+	return h
+}
+
+func (h *heartbeat) Stop() {
+	h.stopOnce.Do(func() {
+		close(h.stop)
+	})
+}
+
+func (h *heartbeat) loop() {
+	ticker := time.NewTicker(h.interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+
+		case now := <-ticker.C:
+			if now.Sub(h.spec.LastRead()) > 2*h.interval {
+				h.timeout()
+				return
+			}
+
+			if now.Sub(h.spec.LastWrite()) >= h.interval/2 {
+				h.spec.PushHeartbeat()
+			}
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package ampq
+
+import (
+	"crypto/sha256"
+	"fmt"
+	logger "github.com/sirupsen/logrus"
+	transfer "github.com/sv-z/amqproxy/Internal/ampq/data-transfer"
+	"io"
+	"sync"
+	"time"
+)
+
+// How long a client waits for a free upstream connection when the pool is full
+const poolAcquireTimeout = 10 * time.Second
+
+// How long the broker has to answer connection.start when its properties are probed
+const probeTimeout = 5 * time.Second
+
+// Dialer opens the transport to the broker
+type Dialer func() (io.ReadWriteCloser, error)
+
+// Credentials the upstream connection is opened with
+type Credentials struct {
+	User     string
+	Password string
+	Vhost    string
+}
+
+type PoolOptions struct {
+	MaxSize     int           // open connections per (user, vhost)
+	IdleTimeout time.Duration // idle connections are closed after that
+}
+
+// Connections are shared by (user, vhost), the password digest guards against handing
+// a connection to a client that does not know the password it was opened with
+type poolKey struct {
+	user     string
+	vhost    string
+	password [sha256.Size]byte
+}
+
+// Pool keeps upstream connections open between short-lived clients
+type Pool struct {
+	dial    Dialer
+	options PoolOptions
+	mu      sync.Mutex
+	idle    map[poolKey][]*Upstream
+	open    map[poolKey]int
+	waiters map[poolKey]chan struct{}
+	stop    chan struct{}
+	retune  chan struct{} // the options changed, the eviction period follows
+	// discarded under the lock, closed once it is released
+	discarded []*Upstream
+	// connection.start properties of the broker, from the last connection opened
+	serverProperties transfer.Table
+	// closed when the probe of the properties in flight ends, nil without one
+	probing  chan struct{}
+	probeErr error
+	// limits negotiated by the last connection opened
+	tune      Tune
+	tuneKnown bool
+}
+
+func NewPool(dial Dialer, options PoolOptions) *Pool {
+	p := &Pool{
+		dial:    dial,
+		options: options,
+		idle:    make(map[poolKey][]*Upstream),
+		open:    make(map[poolKey]int),
+		waiters: make(map[poolKey]chan struct{}),
+		stop:    make(chan struct{}),
+		retune:  make(chan struct{}, 1),
+	}
+
+	go p.evictLoop()
+
+	return p
+}
+
+// Take an idle connection opened with the same credentials or open a new one
+func (p *Pool) Acquire(credentials Credentials, properties transfer.Table, limits Tune) (*Upstream, error) {
+	key := poolKey{
+		user:     credentials.User,
+		vhost:    credentials.Vhost,
+		password: sha256.Sum256([]byte(credentials.Password)),
+	}
+	deadline := time.After(poolAcquireTimeout)
+
+	for {
+		p.mu.Lock()
+		if u := p.popIdle(key); u != nil {
+			p.unlock()
+			return u, nil
+		}
+
+		if p.open[key] < p.options.MaxSize {
+			p.open[key]++
+			p.unlock()
+			return p.connect(key, credentials, properties, limits)
+		}
+
+		wait, exists := p.waiters[key]
+		if !exists {
+			wait = make(chan struct{})
+			p.waiters[key] = wait
+		}
+		p.unlock()
+
+		select {
+		case <-wait:
+		case <-deadline:
+			return nil, fmt.Errorf("no upstream connection available for user %q vhost %q", credentials.User, credentials.Vhost)
+		}
+	}
+}
+
+// Hand the connection back once the client is gone.
+// Its channels are reset first, a connection that cannot be reset is closed.
+func (p *Pool) Release(u *Upstream) {
+	if !u.broken() {
+		if err := u.reset(); err != nil {
+			logger.Debug(fmt.Sprintf("Upstream connection is not reusable: %s", err.Error()))
+			u.closing = true
+		}
+	}
+
+	p.mu.Lock()
+	defer p.unlock()
+
+	if u.broken() {
+		p.discard(u)
+		return
+	}
+
+	u.idleSince = time.Now()
+	u.stopIdle = make(chan struct{})
+	u.idleDone = make(chan struct{})
+	go u.idle(u.stopIdle, u.idleDone)
+
+	p.idle[u.key] = append(p.idle[u.key], u)
+	p.notify(u.key)
+}
+
+// Close the idle connections and stop the eviction
+func (p *Pool) Close() {
+	close(p.stop)
+
+	p.mu.Lock()
+	defer p.unlock()
+
+	for key, list := range p.idle {
+		for _, u := range list {
+			p.wake(u)
+			p.discard(u)
+		}
+		delete(p.idle, key)
+	}
+}
+
+// Properties the broker announces in connection.start.
+// Until a connection is opened they are read from a connection dropped right after connection.start,
+// the clients asking meanwhile share that probe and it gives up after probeTimeout.
+func (p *Pool) ServerProperties() (transfer.Table, error) {
+	p.mu.Lock()
+	if p.serverProperties != nil {
+		defer p.mu.Unlock()
+		return p.serverProperties, nil
+	}
+
+	done := p.probing
+	if done == nil {
+		done = make(chan struct{})
+		p.probing = done
+		go p.probe(done)
+	}
+	p.mu.Unlock()
+
+	<-done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.serverProperties != nil {
+		return p.serverProperties, nil
+	}
+
+	return nil, p.probeErr
+}
+
+func (p *Pool) probe(done chan struct{}) {
+	properties, err := p.readServerProperties()
+
+	p.mu.Lock()
+	if err == nil && p.serverProperties == nil {
+		p.serverProperties = properties
+	}
+	p.probeErr = err
+	p.probing = nil
+	close(done)
+	p.mu.Unlock()
+}
+
+// Dial and read connection.start, the connection is closed when the broker does not send it in time
+func (p *Pool) readServerProperties() (transfer.Table, error) {
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	timer := time.AfterFunc(probeTimeout, func() {
+		conn.Close()
+	})
+
+	properties, err := NewUpstream(conn).probe()
+	if !timer.Stop() {
+		return nil, fmt.Errorf("no connection.start from the upstream within %s", probeTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return properties, nil
+}
+
+// Limits negotiated with the broker, false until a connection was opened
+func (p *Pool) Tune() (Tune, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.tune, p.tuneKnown
+}
+
+// Change the limits, a lowered size keeps the connections open above it until they are closed
+func (p *Pool) SetOptions(options PoolOptions) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.options = options
+
+	select {
+	case p.retune <- struct{}{}:
+	default:
+	}
+}
+
+// Connections open and the idle ones among them
+func (p *Pool) Stats() (open int, idle int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, n := range p.open {
+		open += n
+	}
+	for _, list := range p.idle {
+		idle += len(list)
+	}
+
+	return open, idle
+}
+
+// Dial and open a new connection, the slot is already counted in open
+func (p *Pool) connect(key poolKey, credentials Credentials, properties transfer.Table, limits Tune) (*Upstream, error) {
+	conn, err := p.dial()
+	if err != nil {
+		p.release(key)
+		return nil, err
+	}
+
+	u := NewUpstream(conn)
+	u.key = key
+
+	if err := u.Open(credentials, properties, limits); err != nil {
+		conn.Close()
+		p.release(key)
+		return nil, err
+	}
+
+	logger.Debug(fmt.Sprintf("Upstream connection opened for user %q vhost %q", credentials.User, credentials.Vhost))
+
+	p.mu.Lock()
+	p.serverProperties = u.ServerProperties
+	p.tune, p.tuneKnown = u.Tune, true
+	p.mu.Unlock()
+
+	return u, nil
+}
+
+// Most recently used idle connection first, the old ones are left to the eviction.
+// The caller holds the lock.
+func (p *Pool) popIdle(key poolKey) *Upstream {
+	for {
+		list := p.idle[key]
+		if len(list) == 0 {
+			return nil
+		}
+
+		u := list[len(list)-1]
+		p.idle[key] = list[:len(list)-1]
+
+		p.wake(u)
+		if u.broken() {
+			p.discard(u)
+			continue
+		}
+
+		return u
+	}
+}
+
+// Stop the idle keeper of the connection and wait for it, the caller holds the lock
+func (p *Pool) wake(u *Upstream) {
+	close(u.stopIdle)
+	<-u.idleDone
+}
+
+// Free the slot of the connection, the caller holds the lock and closes the connection with unlock
+func (p *Pool) discard(u *Upstream) {
+	p.discarded = append(p.discarded, u)
+	p.open[u.key]--
+	p.notify(u.key)
+}
+
+// Release the lock and close the connections discarded meanwhile,
+// closing waits for the close-ok of the broker
+func (p *Pool) unlock() {
+	discarded := p.discarded
+	p.discarded = nil
+	p.mu.Unlock()
+
+	for _, u := range discarded {
+		u.Close()
+	}
+}
+
+func (p *Pool) release(key poolKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.open[key]--
+	p.notify(key)
+}
+
+// Wake up the clients waiting for a connection, the caller holds the lock
+func (p *Pool) notify(key poolKey) {
+	if wait, exists := p.waiters[key]; exists {
+		close(wait)
+		delete(p.waiters, key)
+	}
+}
+
+// Close the connections that stayed idle longer than IdleTimeout,
+// the period follows the IdleTimeout set last
+func (p *Pool) evictLoop() {
+	timer := time.NewTimer(p.evictPeriod())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-timer.C:
+			p.evict()
+			timer.Reset(p.evictPeriod())
+		case <-p.retune:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(p.evictPeriod())
+		}
+	}
+}
+
+func (p *Pool) evictPeriod() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	period := p.options.IdleTimeout / 2
+	if period < time.Second {
+		period = time.Second
+	}
+
+	return period
+}
+
+func (p *Pool) evict() {
+	p.mu.Lock()
+	defer p.unlock()
+
+	now := time.Now()
+
+	for key, list := range p.idle {
+		kept := list[:0]
+		for _, u := range list {
+			if u.disconnected() || now.Sub(u.idleSince) > p.options.IdleTimeout {
+				p.wake(u)
+				p.discard(u)
+				logger.Debug(fmt.Sprintf("Idle upstream connection closed for user %q vhost %q", key.user, key.vhost))
+				continue
+			}
+			kept = append(kept, u)
+		}
+
+		if len(kept) == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = kept
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package ampq
+
+import (
+	transfer "github.com/sv-z/amqproxy/Internal/ampq/data-transfer"
+	"strings"
+)
+
+// Version of the proxy announced to the clients, set at build time with -ldflags "-X .../Internal/ampq.Version=..."
+var Version = "dev"
+
+// Capabilities of the broker the proxy relays correctly, the others are not announced to the clients
+var relayedCapabilities = map[string]bool{
+	"publisher_confirms":         true,
+	"exchange_exchange_bindings": true,
+	"basic.nack":                 true,
+	"consumer_cancel_notify":     true,
+	"connection.blocked":         true,
+	"consumer_priorities":        true,
+	"per_consumer_qos":           true,
+	"direct_reply_to":            true,
+}
+
+// Capabilities the proxy implements itself whatever the broker does
+var proxyCapabilities = transfer.Table{
+	"authentication_failure_close": true,
+}
+
+// Properties of connection.start sent to the clients.
+// The broker properties are kept, its capabilities only when the proxy relays them.
+// Overrides are "key" or "capabilities.key" with "true", "false" or a string, an empty value removes the key.
+func ServerProperties(upstream transfer.Table, overrides map[string]string) transfer.Table {
+	properties := transfer.Table{}
+	for key, value := range upstream {
+		if key != "capabilities" {
+			properties[key] = value
+		}
+	}
+
+	capabilities := transfer.Table{}
+	upstreamCapabilities, _ := upstream["capabilities"].(transfer.Table)
+	for key, value := range upstreamCapabilities {
+		if relayedCapabilities[key] {
+			capabilities[key] = value
+		}
+	}
+	for key, value := range proxyCapabilities {
+		capabilities[key] = value
+	}
+
+	for key, value := range overrides {
+		table := properties
+		if strings.HasPrefix(key, "capabilities.") {
+			table, key = capabilities, strings.TrimPrefix(key, "capabilities.")
+		}
+
+		switch value {
+		case "":
+			delete(table, key)
+		case "true", "false":
+			table[key] = value == "true"
+		default:
+			table[key] = value
+		}
+	}
+
+	properties["capabilities"] = capabilities
+	properties["proxy"] = transfer.Table{
+		"product": "amqproxy",
+		"version": Version,
+	}
+
+	return properties
+}
@@ -0,0 +1,428 @@
+package ampq
+
+import (
+	"fmt"
+	logger "github.com/sirupsen/logrus"
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+	"sort"
+	"time"
+)
+
+// How long the broker has to answer a replayed method
+const replayTimeout = 10 * time.Second
+
+// Recovery lets the relay replace an upstream connection the broker dropped,
+// the client keeps its connection and channel ids and only sees the messages delivered again
+type Recovery struct {
+	Reconnect  func() (*Upstream, error) // opens a new upstream connection for the client
+	Discard    func(*Upstream)           // hands a lost upstream connection back
+	Attempts   int                       // zero keeps trying while the client is connected
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// The broker closed the upstream connection with connection-forced, it is shutting down
+var errUpstreamForced = fmt.Errorf("upstream connection closed by the broker")
+
+// Replace the lost upstream connection and replay the topology of the client on a new one
+func (r *relay) recover(cause error) error {
+	lost := r.upstream
+	r.recovery.Discard(lost)
+	r.upstream = nil
+
+	if cause == nil {
+		cause = fmt.Errorf("connection closed")
+	}
+	logger.Warn(fmt.Sprintf("Upstream connection of user %q vhost %q lost: %s", r.client.User, r.client.VirtualHost, cause.Error()))
+
+	// what the client channels were doing on the lost connection
+	states := make(map[uint16]channelState)
+	for client, id := range r.channels.snapshot() {
+		if state := lost.channels[id]; state != nil {
+			states[client] = *state
+		}
+	}
+
+	backoff := r.recovery.MinBackoff
+	for attempt := 1; r.recovery.Attempts == 0 || attempt <= r.recovery.Attempts; attempt++ {
+		upstream, err := r.recovery.Reconnect()
+		if err == nil {
+			r.upstream = upstream
+			if err = r.replay(states); err == nil {
+				logger.Info(fmt.Sprintf("Upstream connection of user %q vhost %q recovered after %d attempt(s)", r.client.User, r.client.VirtualHost, attempt))
+				return nil
+			}
+
+			r.recovery.Discard(upstream)
+			r.upstream = nil
+		}
+		logger.Warn(fmt.Sprintf("Upstream recovery attempt %d failed: %s", attempt, err.Error()))
+
+		// a draining proxy does not wait for the broker to come back
+		if r.drained {
+			return r.client.drainErr
+		}
+
+		select {
+		case <-r.client.closed:
+			return fmt.Errorf("client left during the upstream recovery")
+		case <-r.client.killed:
+			return r.client.killErr
+		case <-r.draining:
+			return r.client.drainErr
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > r.recovery.MaxBackoff {
+			backoff = r.recovery.MaxBackoff
+		}
+	}
+
+	return spec091.NewError(spec091.ConnectionForced, "upstream connection lost")
+}
+
+// Open the client channels again on the new upstream connection and set them up as they were.
+// The states of the channels on the lost connection tell what each one was doing.
+func (r *relay) replay(states map[uint16]channelState) error {
+	u := r.upstream
+
+	r.toClient, r.toUpstream = nil, nil
+	if r.client.Tune.FrameMax != u.Tune.FrameMax {
+		r.toClient = newFragmenter(r.client.Tune.FrameMax)
+		r.toUpstream = newFragmenter(u.Tune.FrameMax)
+	}
+	r.closingUpstream = make(map[uint16]bool)
+
+	snapshot := r.channels.snapshot()
+	clients := make([]int, 0, len(snapshot))
+	for client := range snapshot {
+		clients = append(clients, int(client))
+	}
+	sort.Ints(clients)
+
+	// the channels are bound again one by one, the previous attempt may have bound some already
+	for client := range snapshot {
+		r.channels.release(client)
+	}
+
+	var reopened []uint16
+	for _, c := range clients {
+		client := uint16(c)
+		state, known := states[client]
+		ch := r.topology.channels[client]
+
+		switch {
+		case r.closingClient[client]:
+			// the close-ok of the client is all that is left
+
+		case !known:
+			r.release(client)
+
+		case ch != nil && isChannelClose(ch.pending):
+			// the client closed the channel, the broker will not answer anymore
+			if err := r.client.spec.WriteMethod(client, &spec091.ChannelCloseOk{}); err != nil {
+				return err
+			}
+			r.release(client)
+
+		case state.closing:
+			// the broker closed the channel, the client still has to confirm it
+			r.closingClient[client] = true
+
+		case state.content || r.delivering[client] > 0:
+			delete(r.delivering, client)
+			e := spec091.NewError(spec091.InternalError, "upstream connection lost in the middle of a content")
+			e.Channel = client
+			if err := r.closeChannel(e); err != nil {
+				return err
+			}
+
+		case ch != nil && ch.txWork:
+			// the broker dropped the uncommitted work, a new transaction would commit without it
+			e := spec091.NewError(spec091.InternalError, "upstream connection lost with an uncommitted transaction")
+			e.Channel = client
+			if err := r.closeChannel(e); err != nil {
+				return err
+			}
+
+		default:
+			id, err := r.openChannel()
+			if err != nil {
+				return err
+			}
+			r.channels.bind(client, id)
+
+			// the client is still waiting for its channel
+			if !state.open {
+				if err := r.client.spec.WriteMethod(client, &spec091.ChannelOpenOk{}); err != nil {
+					return err
+				}
+				state.open = true
+				states[client] = state
+			}
+			reopened = append(reopened, client)
+		}
+	}
+
+	if err := r.replayDeclarations(); err != nil {
+		return err
+	}
+
+	for _, client := range reopened {
+		if err := r.replayChannel(client); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Exchanges, queues and bindings are declared again on a channel of their own
+func (r *relay) replayDeclarations() error {
+	t := r.topology
+
+	var methods []spec091.Method
+
+	exchanges := make([]string, 0, len(t.exchanges))
+	for name := range t.exchanges {
+		exchanges = append(exchanges, name)
+	}
+	sort.Strings(exchanges)
+	for _, name := range exchanges {
+		declare := *t.exchanges[name]
+		declare.NoWait = false
+		methods = append(methods, &declare)
+	}
+
+	queues := make([]string, 0, len(t.queues))
+	for name := range t.queues {
+		queues = append(queues, name)
+	}
+	sort.Strings(queues)
+	for _, name := range queues {
+		declare := *t.queues[name]
+		declare.NoWait = false
+		methods = append(methods, &declare)
+	}
+
+	for _, binding := range t.exchangeBindings {
+		bind := *binding
+		bind.NoWait = false
+		methods = append(methods, &bind)
+	}
+
+	for _, binding := range t.queueBindings {
+		bind := *binding
+		bind.NoWait = false
+		methods = append(methods, &bind)
+	}
+
+	if len(methods) == 0 {
+		return nil
+	}
+
+	id, err := r.openChannel()
+	if err != nil {
+		return err
+	}
+
+	for _, method := range methods {
+		// the broker names the server-named queues again
+		name := ""
+		switch m := method.(type) {
+		case *spec091.QueueDeclare:
+			if t.serverNamed[m.Queue] {
+				name, m.Queue = m.Queue, ""
+			}
+		case *spec091.QueueBind:
+			m.Queue = t.queueName(m.Queue)
+		}
+
+		reply, err := r.call(id, method)
+		if e, ok := err.(*spec091.Error); ok && e.Channel != 0 {
+			logger.Warn(fmt.Sprintf("Replay of %s refused by the upstream: %s", method.Name(), e.Text))
+			if id, err = r.openChannel(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if ok, _ := reply.(*spec091.QueueDeclareOk); ok != nil && name != "" {
+			t.renamed[name] = ok.Queue
+		}
+	}
+
+	if _, err := r.call(id, &spec091.ChannelClose{ReplyCode: spec091.ReplySuccess, ReplyText: "recovered"}); err != nil {
+		return err
+	}
+	delete(r.upstream.channels, id)
+
+	return nil
+}
+
+// Set up a client channel as it was: prefetch, confirms, transactions and consumers.
+// A refused method closes the client channel with the broker's reason.
+func (r *relay) replayChannel(client uint16) error {
+	id, _ := r.channels.upstreamId(client)
+	state := r.upstream.channels[id]
+	ch := r.topology.channels[client]
+	tags := r.tags[client]
+
+	// the unacknowledged deliveries come again with new tags, the unconfirmed publishes may be lost
+	if tags != nil {
+		tags.deliveries.expire()
+
+		if tags.confirms != nil {
+			originals, contiguous, _ := tags.confirms.resolve(0, true)
+			frames, err := ackFrames(client, originals, true, contiguous, func(tag uint64, multiple bool) spec091.Method {
+				return &spec091.BasicNack{DeliveryTag: tag, Multiple: multiple}
+			})
+			if err != nil {
+				return err
+			}
+			if err := forwardAll(r.client.spec, r.toClient, frames); err != nil {
+				return err
+			}
+			tags.confirms = newTagTable()
+		}
+	}
+
+	if ch == nil {
+		return nil
+	}
+
+	var methods []spec091.Method
+	if ch.qos != nil {
+		methods = append(methods, ch.qos)
+		state.qos = true
+	}
+	if ch.globalQos != nil {
+		methods = append(methods, ch.globalQos)
+		state.qos = true
+	}
+	if ch.confirm {
+		methods = append(methods, &spec091.ConfirmSelect{})
+		state.confirm = true
+	}
+	if ch.tx {
+		methods = append(methods, &spec091.TxSelect{})
+		state.tx = true
+	}
+
+	consumers := make([]string, 0, len(ch.consumers))
+	for tag := range ch.consumers {
+		consumers = append(consumers, tag)
+	}
+	sort.Strings(consumers)
+	for _, tag := range consumers {
+		consume := *ch.consumers[tag]
+		consume.Queue = r.topology.queueName(consume.Queue)
+		consume.NoWait = false
+		methods = append(methods, &consume)
+		state.consumers = true
+	}
+
+	for _, method := range methods {
+		_, err := r.call(id, method)
+		if e, ok := err.(*spec091.Error); ok && e.Channel != 0 {
+			e.Channel = client
+			return r.closeChannel(e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// the broker of the lost connection never answered it
+	if ch.pending != nil {
+		pending := ch.pending
+		if renamed := r.topology.rename(pending); renamed != nil {
+			pending = renamed
+		}
+		if err := r.upstream.spec.WriteMethod(id, pending); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Open a channel on the upstream connection, a channel kept open by a previous client is taken first
+func (r *relay) openChannel() (uint16, error) {
+	id, reused, err := r.upstream.allocateChannel(func(id uint16) bool {
+		_, mapped := r.channels.clientId(id)
+		return mapped
+	})
+	if err != nil || reused {
+		return id, err
+	}
+
+	r.upstream.channels[id] = &channelState{}
+	if _, err := r.call(id, &spec091.ChannelOpen{}); err != nil {
+		return 0, err
+	}
+	r.upstream.channels[id].open = true
+
+	return id, nil
+}
+
+// Send a method to the broker and wait for its answer.
+// The frames of the channels replayed before go their normal way meanwhile.
+func (r *relay) call(id uint16, method spec091.Method) (spec091.Method, error) {
+	u := r.upstream
+	if err := u.spec.WriteMethod(id, method); err != nil {
+		return nil, err
+	}
+
+	timeout := time.After(replayTimeout)
+
+	for {
+		select {
+		case frame, ok := <-u.frames:
+			if !ok {
+				if u.err != nil {
+					return nil, u.err
+				}
+				return nil, fmt.Errorf("upstream connection lost")
+			}
+
+			if frame.Channel == id && frame.Type == spec091.FrameMethod {
+				reply, err := frame.Method()
+				if err != nil {
+					return nil, err
+				}
+
+				if closeMethod, ok := reply.(*spec091.ChannelClose); ok {
+					u.spec.PushChannelCloseOk(id)
+					delete(u.channels, id)
+					return nil, &spec091.Error{
+						Code:     closeMethod.ReplyCode,
+						Text:     closeMethod.ReplyText,
+						Channel:  id,
+						ClassId:  closeMethod.ClassId,
+						MethodId: closeMethod.MethodId,
+					}
+				}
+
+				if reply.Name() == method.Name()+"-ok" {
+					return reply, nil
+				}
+			}
+
+			if err := r.fromUpstream(frame); err != nil {
+				return nil, err
+			}
+
+		case <-timeout:
+			return nil, fmt.Errorf("upstream did not answer %s within %s", method.Name(), replayTimeout)
+		}
+	}
+}
+
+func isChannelClose(method spec091.Method) bool {
+	_, ok := method.(*spec091.ChannelClose)
+	return ok
+}
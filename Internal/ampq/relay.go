@@ -0,0 +1,441 @@
+package ampq
+
+import (
+	transfer "github.com/sv-z/amqproxy/Internal/ampq/data-transfer"
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+	"io"
+)
+
+// Relay copies frames between the client and the upstream until either side closes the connection.
+// A returned error ends the client connection, AMQP exceptions are meant for Connection.CloseWithError.
+// Nil means the connection was closed in an orderly way.
+// With a recovery a lost upstream is replaced, the upstream in use at the end is returned,
+// nil when there is none left. It is handed back to the pool afterwards.
+func Relay(client *Connection, upstream *Upstream, recovery *Recovery) (*Upstream, error) {
+	r := &relay{
+		client:          client,
+		upstream:        upstream,
+		recovery:        recovery,
+		channels:        client.channels,
+		closingClient:   make(map[uint16]bool),
+		closingUpstream: make(map[uint16]bool),
+		tags:            make(map[uint16]*channelTags),
+		topology:        client.topology,
+		delivering:      make(map[uint16]uint64),
+		publishing:      make(map[uint16]uint64),
+		draining:        client.draining,
+	}
+
+	// the frames are forwarded as they are when both sides agreed to the same frame-max
+	if client.Tune.FrameMax != upstream.Tune.FrameMax {
+		r.toClient = newFragmenter(client.Tune.FrameMax)
+		r.toUpstream = newFragmenter(upstream.Tune.FrameMax)
+	}
+
+	err := r.run()
+
+	return r.upstream, err
+}
+
+type relay struct {
+	client   *Connection
+	upstream *Upstream
+	recovery *Recovery // nil when a lost upstream ends the relay
+	// channels opened by this client, the other upstream channels are left from the previous clients
+	channels *channelMap
+	// client channels the proxy closed, waiting for close-ok
+	closingClient map[uint16]bool
+	// upstream channels the proxy closed, their close-ok is not forwarded
+	closingUpstream map[uint16]bool
+	// fit the frames to the frame-max of each side, nil when it is the same
+	toClient   *fragmenter
+	toUpstream *fragmenter
+	// delivery tags and publish sequence numbers by client channel
+	tags map[uint16]*channelTags
+	// what the client declared, replayed when the upstream is replaced
+	topology *topology
+	// content body bytes the client still expects, by client channel
+	delivering map[uint16]uint64
+	// client channels from basic.publish to the last body frame, with the body bytes still to come once the header is seen
+	publishing map[uint16]uint64
+	// signaled once when the client is drained, nil afterwards
+	draining <-chan struct{}
+	drained  bool
+}
+
+func (r *relay) run() error {
+	for {
+		select {
+		case frame, ok := <-r.client.frames:
+			if !ok {
+				if r.client.err == io.EOF {
+					return nil
+				}
+				return r.client.err
+			}
+
+			stop, err := r.fromClient(frame)
+			if err = r.handle(err); err != nil || stop {
+				return err
+			}
+
+		case <-r.client.killed:
+			return r.client.killErr
+
+		case <-r.draining:
+			r.draining = nil
+			r.drained = true
+
+		case frame, ok := <-r.upstream.frames:
+			var err error
+			switch {
+			case ok:
+				err = r.fromUpstream(frame)
+			// the broker closed the connection and the client was told so
+			case r.upstream.closing:
+				return nil
+			default:
+				err = r.upstream.err
+			}
+
+			if !ok || err == errUpstreamForced {
+				if r.recovery == nil {
+					return spec091.NewError(spec091.ConnectionForced, "upstream connection lost")
+				}
+				err = r.recover(err)
+			}
+
+			if err = r.handle(err); err != nil {
+				return err
+			}
+		}
+
+		if r.drained && r.idle() {
+			return r.client.drainErr
+		}
+	}
+}
+
+// Whether the client has nothing in flight, the connection can be closed without losing a message
+func (r *relay) idle() bool {
+	if len(r.publishing) > 0 {
+		return false
+	}
+
+	for _, tags := range r.tags {
+		if tags.confirms != nil && len(tags.confirms.outstanding) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Follow the content the client publishes on its channel
+func (r *relay) trackPublish(frame *spec091.Frame, method spec091.Method) {
+	switch frame.Type {
+	case spec091.FrameMethod:
+		if _, ok := method.(*spec091.BasicPublish); ok {
+			r.publishing[frame.Channel] = 0
+		}
+
+	case spec091.FrameHeader:
+		if bodySize, err := frame.BodySize(); err == nil && bodySize > 0 {
+			r.publishing[frame.Channel] = bodySize
+		} else {
+			delete(r.publishing, frame.Channel)
+		}
+
+	case spec091.FrameBody:
+		if left := r.publishing[frame.Channel]; uint64(len(frame.Payload)) < left {
+			r.publishing[frame.Channel] = left - uint64(len(frame.Payload))
+		} else {
+			delete(r.publishing, frame.Channel)
+		}
+	}
+}
+
+// Soft exceptions close the channel, anything else ends the relay
+func (r *relay) handle(err error) error {
+	if e, ok := err.(*spec091.Error); ok && !e.Hard() {
+		return r.closeChannel(e)
+	}
+
+	return err
+}
+
+// Forward a client frame to the broker on the upstream channel mapped to the client channel.
+// The connection close is answered by the proxy itself, the upstream connection stays open for the pool.
+func (r *relay) fromClient(frame *spec091.Frame) (bool, error) {
+	var method spec091.Method
+	if frame.Type == spec091.FrameMethod {
+		var err error
+		if method, err = frame.Method(); err != nil {
+			return true, err
+		}
+	}
+
+	// after the proxy closed a channel only its close-ok is expected
+	if r.closingClient[frame.Channel] {
+		if _, ok := method.(*spec091.ChannelCloseOk); ok {
+			delete(r.closingClient, frame.Channel)
+			r.release(frame.Channel)
+		}
+		return false, nil
+	}
+
+	switch method.(type) {
+	case *spec091.ConnectionClose:
+		r.client.spec.PushConnectionCloseOk()
+		return true, nil
+
+	case *spec091.ChannelOpen:
+		if max := r.client.Tune.ChannelMax; frame.Channel == 0 || (max != 0 && frame.Channel > max) {
+			return true, spec091.NewError(spec091.NotAllowed, "channel %d is out of the negotiated channel_max (%d)", frame.Channel, max)
+		}
+		if _, exists := r.channels.upstreamId(frame.Channel); exists {
+			return true, spec091.NewError(spec091.ChannelError, "channel %d is already open", frame.Channel)
+		}
+
+		id, reused, err := r.upstream.allocateChannel(func(id uint16) bool {
+			_, mapped := r.channels.clientId(id)
+			return mapped
+		})
+		if err != nil {
+			return true, err
+		}
+		r.channels.bind(frame.Channel, id)
+		r.tags[frame.Channel] = newChannelTags()
+		r.topology.open(frame.Channel)
+
+		// the channel is still open from the previous client
+		if reused {
+			r.client.spec.PushChannelOpenOk(frame.Channel)
+			return false, nil
+		}
+	}
+
+	if frame.Channel == 0 {
+		return false, forward(r.upstream.spec, r.toUpstream, frame)
+	}
+
+	id, mapped := r.channels.upstreamId(frame.Channel)
+	if !mapped {
+		return true, spec091.NewError(spec091.ChannelError, "channel %d is not open", frame.Channel)
+	}
+
+	if err := r.upstream.observeClient(id, frame); err != nil {
+		return false, err
+	}
+	r.trackPublish(frame, method)
+	r.topology.transact(frame.Channel, method)
+
+	// the client confirmed the broker closed the channel
+	if _, ok := method.(*spec091.ChannelCloseOk); ok {
+		r.release(frame.Channel)
+	}
+
+	if method != nil {
+		frames, handled, err := r.translateFromClient(frame.Channel, id, method)
+		if handled {
+			if err != nil {
+				return false, err
+			}
+			return false, forwardAll(r.upstream.spec, r.toUpstream, frames)
+		}
+
+		r.topology.request(frame.Channel, method)
+
+		// the server-named queues have another name since the upstream was replaced
+		if renamed := r.topology.rename(method); renamed != nil {
+			out, err := spec091.NewMethodFrame(id, renamed)
+			if err != nil {
+				return false, err
+			}
+			return false, forward(r.upstream.spec, r.toUpstream, out)
+		}
+	}
+
+	// the clients only send content with basic.publish
+	if frame.Type == spec091.FrameHeader && r.client.IdentityHeader != "" {
+		out, err := r.identify(id, frame)
+		if err != nil {
+			return false, err
+		}
+		return false, forward(r.upstream.spec, r.toUpstream, out)
+	}
+
+	return false, forward(r.upstream.spec, r.toUpstream, &spec091.Frame{Type: frame.Type, Channel: id, Payload: frame.Payload})
+}
+
+// Content header with the client user in the identity header, the value the client set is replaced
+func (r *relay) identify(id uint16, frame *spec091.Frame) (*spec091.Frame, error) {
+	header, err := frame.Header()
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Properties.Headers == nil {
+		header.Properties.Headers = transfer.Table{}
+	}
+	header.Properties.Headers[r.client.IdentityHeader] = r.client.User
+
+	return spec091.NewHeaderFrame(id, header)
+}
+
+// Forward a broker frame to the client on the client channel mapped to the upstream channel
+func (r *relay) fromUpstream(frame *spec091.Frame) error {
+	// the client does not know about the proxy closing the upstream channel
+	if r.closingUpstream[frame.Channel] {
+		if method, err := frame.Method(); err == nil {
+			if _, ok := method.(*spec091.ChannelCloseOk); ok {
+				delete(r.closingUpstream, frame.Channel)
+			}
+		}
+		r.upstream.handleStray(frame)
+		return nil
+	}
+
+	if frame.Channel == 0 {
+		// the broker is shutting down, the client waits for the recovery instead
+		if r.recovery != nil && frame.Type == spec091.FrameMethod {
+			if method, err := frame.Method(); err == nil {
+				if closeMethod, ok := method.(*spec091.ConnectionClose); ok && closeMethod.ReplyCode == spec091.ConnectionForced {
+					r.upstream.closing = true
+					r.upstream.spec.PushConnectionCloseOk()
+					return errUpstreamForced
+				}
+			}
+		}
+
+		r.upstream.observeUpstream(frame)
+		return forward(r.client.spec, r.toClient, frame)
+	}
+
+	id, mapped := r.channels.clientId(frame.Channel)
+	if !mapped {
+		r.upstream.handleStray(frame)
+		return nil
+	}
+
+	r.upstream.observeUpstream(frame)
+
+	if r.closingClient[id] {
+		return nil
+	}
+
+	switch frame.Type {
+	case spec091.FrameHeader:
+		if bodySize, err := frame.BodySize(); err == nil && bodySize > 0 {
+			r.delivering[id] = bodySize
+		}
+
+	case spec091.FrameBody:
+		if left := r.delivering[id]; uint64(len(frame.Payload)) < left {
+			r.delivering[id] = left - uint64(len(frame.Payload))
+		} else {
+			delete(r.delivering, id)
+		}
+
+	case spec091.FrameMethod:
+		if method, err := frame.Method(); err == nil {
+			r.topology.reply(id, method)
+
+			// the broker confirmed the client closed the channel
+			if _, ok := method.(*spec091.ChannelCloseOk); ok {
+				r.release(id)
+			}
+
+			// passive declarations of the replayed server-named queues
+			if ok, _ := method.(*spec091.QueueDeclareOk); ok != nil {
+				if name, renamed := r.topology.clientQueueName(ok.Queue); renamed {
+					copied := *ok
+					copied.Queue = name
+					out, err := spec091.NewMethodFrame(id, &copied)
+					if err != nil {
+						return err
+					}
+					return forward(r.client.spec, r.toClient, out)
+				}
+			}
+
+			frames, handled, err := r.translateFromUpstream(id, method)
+			if handled {
+				if err != nil {
+					return err
+				}
+				return forwardAll(r.client.spec, r.toClient, frames)
+			}
+		}
+	}
+
+	return forward(r.client.spec, r.toClient, &spec091.Frame{Type: frame.Type, Channel: id, Payload: frame.Payload})
+}
+
+// Write the frame to one side, re-fragmented when the frame-max of the sides differ
+func forward(spec *spec091.Spec, f *fragmenter, frame *spec091.Frame) error {
+	if f == nil {
+		return spec.WriteFrame(frame)
+	}
+
+	frames, err := f.push(frame)
+	if err != nil {
+		return err
+	}
+
+	for _, out := range frames {
+		if err := spec.WriteFrame(out); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func forwardAll(spec *spec091.Spec, f *fragmenter, frames []*spec091.Frame) error {
+	for _, frame := range frames {
+		if err := forward(spec, f, frame); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Forget a client channel with its tags and topology
+func (r *relay) release(client uint16) {
+	r.channels.release(client)
+	delete(r.tags, client)
+	delete(r.delivering, client)
+	delete(r.publishing, client)
+	r.topology.close(client)
+}
+
+// Close a channel on both sides because of an exception raised by the proxy
+func (r *relay) closeChannel(e *spec091.Error) error {
+	err := r.client.spec.WriteMethod(e.Channel, &spec091.ChannelClose{
+		ReplyCode: e.Code,
+		ReplyText: e.Text,
+		ClassId:   e.ClassId,
+		MethodId:  e.MethodId,
+	})
+	if err != nil {
+		return err
+	}
+	r.closingClient[e.Channel] = true
+
+	id, mapped := r.channels.upstreamId(e.Channel)
+	if !mapped {
+		return nil
+	}
+
+	if ch, exists := r.upstream.channels[id]; exists && !ch.closing {
+		if !r.upstream.spec.PushChannelClose(id, spec091.ReplySuccess, "closed by proxy") {
+			return spec091.NewError(spec091.ConnectionForced, "upstream connection lost")
+		}
+		ch.closing = true
+		r.closingUpstream[id] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package spec091
+
+import (
+	"encoding/binary"
+	transfer "github.com/sv-z/amqproxy/Internal/ampq/data-transfer"
+	"io"
+	"time"
+)
+
+//go:generate go run ./gen -spec amqp0-9-1.stripped.extended.xml -out methods.go
+
+// Method is an AMQP method with its arguments, the implementations are generated in methods.go
+type Method interface {
+	Id() (classId uint16, methodId uint16)
+	Name() string
+	HasContent() bool
+	read(r io.Reader) error
+	write(w io.Writer) error
+}
+
+// ------------------------------------------- READ --------------------------------------------------------------------
+
+func readOctet(r io.Reader) (v byte, err error) {
+	err = binary.Read(r, binary.BigEndian, &v)
+	return
+}
+
+func readShort(r io.Reader) (v uint16, err error) {
+	err = binary.Read(r, binary.BigEndian, &v)
+	return
+}
+
+func readLong(r io.Reader) (v uint32, err error) {
+	err = binary.Read(r, binary.BigEndian, &v)
+	return
+}
+
+func readLonglong(r io.Reader) (v uint64, err error) {
+	err = binary.Read(r, binary.BigEndian, &v)
+	return
+}
+
+func readShortstr(r io.Reader) (string, error) {
+	return transfer.NewDataReader(r).ReadShortstr()
+}
+
+func readLongstr(r io.Reader) (string, error) {
+	return transfer.NewDataReader(r).ReadLongstr()
+}
+
+func readTimestamp(r io.Reader) (time.Time, error) {
+	return transfer.NewDataReader(r).ReadTimestamp()
+}
+
+func readTable(r io.Reader) (transfer.Table, error) {
+	return transfer.NewDataReader(r).ReadTable()
+}
+
+// ------------------------------------------- WRITE -------------------------------------------------------------------
+
+func writeOctet(w io.Writer, v byte) error {
+	return binary.Write(w, binary.BigEndian, v)
+}
+
+func writeShort(w io.Writer, v uint16) error {
+	return binary.Write(w, binary.BigEndian, v)
+}
+
+func writeLong(w io.Writer, v uint32) error {
+	return binary.Write(w, binary.BigEndian, v)
+}
+
+func writeLonglong(w io.Writer, v uint64) error {
+	return binary.Write(w, binary.BigEndian, v)
+}
+
+func writeShortstr(w io.Writer, v string) error {
+	return transfer.NewDataWriter(w).WriteShortstr(v)
+}
+
+func writeLongstr(w io.Writer, v string) error {
+	return transfer.NewDataWriter(w).WriteLongstr(v)
+}
+
+func writeTimestamp(w io.Writer, v time.Time) error {
+	return transfer.NewDataWriter(w).WriteTimestamp(v)
+}
+
+func writeTable(w io.Writer, v transfer.Table) error {
+	return transfer.NewDataWriter(w).WriteTable(v)
+}
@@ -1,13 +1,13 @@
 package spec091
 
 const (
-	frameMethod        = 1
-	frameHeader        = 2
-	frameBody          = 3
-	frameHeartbeat     = 8
-	frameMinSize       = 4096
+	FrameMethod        = 1
+	FrameHeader        = 2
+	FrameBody          = 3
+	FrameHeartbeat     = 8
+	FrameMinSize       = 4096
 	frameEnd           = 206 // "\xCE"
-	replySuccess       = 200
+	ReplySuccess       = 200
 	ContentTooLarge    = 311
 	NoRoute            = 312
 	NoConsumers        = 313
@@ -18,7 +18,7 @@ const (
 	ResourceLocked     = 405
 	PreconditionFailed = 406
 	FrameError         = 501
-	SyntaxError        = `502`
+	SyntaxError        = 502
 	CommandInvalid     = 503
 	ChannelError       = 504
 	UnexpectedFrame    = 505
@@ -0,0 +1,213 @@
+package spec091
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Content header frame payload, it follows a method that carries content
+type ContentHeader struct {
+	ClassId    uint16
+	Weight     uint16
+	BodySize   uint64
+	Properties BasicProperties
+}
+
+// Message is a content method with its header and the whole body
+type Message struct {
+	Channel uint16
+	Method  Method
+	Header  *ContentHeader
+	Body    []byte
+}
+
+// Decode the content header carried by a header frame
+func (frame *Frame) Header() (*ContentHeader, error) {
+	if frame.Type != FrameHeader {
+		return nil, NewError(UnexpectedFrame, "frame type %d on channel %d is not a content header frame", frame.Type, frame.Channel)
+	}
+
+	reader := bytes.NewReader(frame.Payload)
+	header := &ContentHeader{}
+	malformed := NewError(SyntaxError, "content header on channel %d could not be parsed", frame.Channel)
+
+	var err error
+	if header.ClassId, err = readShort(reader); err != nil {
+		return nil, malformed
+	}
+	if header.Weight, err = readShort(reader); err != nil {
+		return nil, malformed
+	}
+	if header.BodySize, err = readLonglong(reader); err != nil {
+		return nil, malformed
+	}
+
+	if header.ClassId != 60 {
+		return nil, NewError(NotImplemented, "content header of class %d is not supported", header.ClassId)
+	}
+
+	if err = header.Properties.read(reader); err != nil {
+		return nil, malformed
+	}
+
+	return header, nil
+}
+
+// Body size of a content header frame. Only the fixed part is read, the properties are relayed
+// as they are whatever field types their tables hold.
+func (frame *Frame) BodySize() (uint64, error) {
+	if frame.Type != FrameHeader {
+		return 0, NewError(UnexpectedFrame, "frame type %d on channel %d is not a content header frame", frame.Type, frame.Channel)
+	}
+
+	// class id, weight and body size
+	if len(frame.Payload) < 12 {
+		return 0, NewError(SyntaxError, "content header on channel %d could not be parsed", frame.Channel)
+	}
+
+	return binary.BigEndian.Uint64(frame.Payload[4:12]), nil
+}
+
+// Encode the content header into a header frame
+func NewHeaderFrame(channel uint16, header *ContentHeader) (*Frame, error) {
+	var payload bytes.Buffer
+
+	if err := writeShort(&payload, header.ClassId); err != nil {
+		return nil, err
+	}
+	if err := writeShort(&payload, header.Weight); err != nil {
+		return nil, err
+	}
+	if err := writeLonglong(&payload, header.BodySize); err != nil {
+		return nil, err
+	}
+	if err := header.Properties.write(&payload); err != nil {
+		return nil, err
+	}
+
+	return &Frame{Type: FrameHeader, Channel: channel, Payload: payload.Bytes()}, nil
+}
+
+// Body frames carry a part of the content as is
+func NewBodyFrame(channel uint16, body []byte) *Frame {
+	return &Frame{Type: FrameBody, Channel: channel, Payload: body}
+}
+
+// Encode the message into its method, header and body frames.
+// The body is split so that no frame is bigger than frameMax, zero means no limit.
+func (m *Message) Frames(frameMax uint32) ([]*Frame, error) {
+	methodFrame, err := NewMethodFrame(m.Channel, m.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	header := *m.Header
+	header.BodySize = uint64(len(m.Body))
+
+	headerFrame, err := NewHeaderFrame(m.Channel, &header)
+	if err != nil {
+		return nil, err
+	}
+
+	frames := []*Frame{methodFrame, headerFrame}
+
+	// frame header and frame end take 8 bytes
+	chunk := len(m.Body)
+	if frameMax > 0 {
+		if frameMax <= 8 {
+			return nil, fmt.Errorf("frame-max %d is too small", frameMax)
+		}
+		chunk = int(frameMax) - 8
+	}
+
+	for offset := 0; offset < len(m.Body); offset += chunk {
+		end := offset + chunk
+		if end > len(m.Body) {
+			end = len(m.Body)
+		}
+		frames = append(frames, NewBodyFrame(m.Channel, m.Body[offset:end]))
+	}
+
+	return frames, nil
+}
+
+// Biggest body buffer allocated up front, larger bodies grow as the frames arrive
+const assemblerPrealloc = 1 << 20
+
+// Assembler collects the method, header and body frames of a content into one message per channel
+type Assembler struct {
+	pending map[uint16]*Message
+}
+
+func NewAssembler() *Assembler {
+	return &Assembler{pending: make(map[uint16]*Message)}
+}
+
+// Push the next frame of a channel, the message is returned once its body is complete.
+// Frames that are not part of a content return nil.
+func (a *Assembler) Push(frame *Frame) (*Message, error) {
+	message := a.pending[frame.Channel]
+
+	switch frame.Type {
+	case FrameMethod:
+		if message != nil {
+			return nil, NewError(UnexpectedFrame, "method frame received in the middle of a content on channel %d", frame.Channel)
+		}
+
+		method, err := frame.Method()
+		if err != nil {
+			return nil, err
+		}
+		if !method.HasContent() {
+			return nil, nil
+		}
+
+		a.pending[frame.Channel] = &Message{Channel: frame.Channel, Method: method}
+		return nil, nil
+
+	case FrameHeader:
+		if message == nil || message.Header != nil {
+			return nil, NewError(UnexpectedFrame, "content header frame is not expected on channel %d", frame.Channel)
+		}
+
+		header, err := frame.Header()
+		if err != nil {
+			return nil, err
+		}
+		message.Header = header
+
+		// the body size comes from the peer, do not trust it for the allocation
+		capacity := header.BodySize
+		if capacity > assemblerPrealloc {
+			capacity = assemblerPrealloc
+		}
+		message.Body = make([]byte, 0, capacity)
+
+	case FrameBody:
+		if message == nil || message.Header == nil {
+			return nil, NewError(UnexpectedFrame, "content body frame is not expected on channel %d", frame.Channel)
+		}
+
+		if uint64(len(message.Body)+len(frame.Payload)) > message.Header.BodySize {
+			return nil, NewError(FrameError, "content body on channel %d is bigger than %d bytes", frame.Channel, message.Header.BodySize)
+		}
+		message.Body = append(message.Body, frame.Payload...)
+
+	default:
+		return nil, nil
+	}
+
+	if uint64(len(message.Body)) < message.Header.BodySize {
+		return nil, nil
+	}
+
+	delete(a.pending, frame.Channel)
+
+	return message, nil
+}
+
+// Forget the incomplete content of a closed channel
+func (a *Assembler) Reset(channel uint16) {
+	delete(a.pending, channel)
+}
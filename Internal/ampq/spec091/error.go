@@ -0,0 +1,62 @@
+package spec091
+
+import "fmt"
+
+// Error is an AMQP exception, the peer is told about it with connection.close or channel.close
+type Error struct {
+	Code     uint16
+	Text     string
+	Channel  uint16
+	ClassId  uint16
+	MethodId uint16
+	Received bool // the peer closed the connection with it, connection.close-ok is already sent
+}
+
+var replyNames = map[uint16]string{
+	ReplySuccess:       "NORMAL",
+	ContentTooLarge:    "CONTENT_TOO_LARGE",
+	NoRoute:            "NO_ROUTE",
+	NoConsumers:        "NO_CONSUMERS",
+	ConnectionForced:   "CONNECTION_FORCED",
+	InvalidPath:        "INVALID_PATH",
+	AccessRefused:      "ACCESS_REFUSED",
+	NotFound:           "NOT_FOUND",
+	ResourceLocked:     "RESOURCE_LOCKED",
+	PreconditionFailed: "PRECONDITION_FAILED",
+	FrameError:         "FRAME_ERROR",
+	SyntaxError:        "SYNTAX_ERROR",
+	CommandInvalid:     "COMMAND_INVALID",
+	ChannelError:       "CHANNEL_ERROR",
+	UnexpectedFrame:    "UNEXPECTED_FRAME",
+	ResourceError:      "RESOURCE_ERROR",
+	NotAllowed:         "NOT_ALLOWED",
+	NotImplemented:     "NOT_IMPLEMENTED",
+	InternalError:      "INTERNAL_ERROR",
+}
+
+// The reply text follows the broker convention: "NOT_FOUND - no queue 'orders'"
+func NewError(code uint16, format string, args ...interface{}) *Error {
+	return &Error{
+		Code: code,
+		Text: fmt.Sprintf("%s - %s", replyNames[code], fmt.Sprintf(format, args...)),
+	}
+}
+
+// Name of a reply code like "NOT_FOUND", empty for an unknown one
+func ReplyName(code uint16) string {
+	return replyNames[code]
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Text)
+}
+
+// Soft errors close the channel only, hard errors close the whole connection
+func (e *Error) Hard() bool {
+	switch e.Code {
+	case ContentTooLarge, NoRoute, NoConsumers, AccessRefused, NotFound, ResourceLocked, PreconditionFailed:
+		return e.Channel == 0
+	}
+
+	return true
+}
@@ -0,0 +1,413 @@
+// Generates the AMQP 0-9-1 method codec of the spec091 package from the XML specification
+//
+//	go run ./gen -spec amqp0-9-1.stripped.extended.xml -out methods.go
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+)
+
+type amqp struct {
+	Domains []domain `xml:"domain"`
+	Classes []class  `xml:"class"`
+}
+
+type domain struct {
+	Name string `xml:"name,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type class struct {
+	Name    string   `xml:"name,attr"`
+	Index   uint16   `xml:"index,attr"`
+	Fields  []field  `xml:"field"`
+	Methods []method `xml:"method"`
+}
+
+type method struct {
+	Name    string  `xml:"name,attr"`
+	Index   uint16  `xml:"index,attr"`
+	Content bool    `xml:"content,attr"`
+	Fields  []field `xml:"field"`
+}
+
+type field struct {
+	Name     string `xml:"name,attr"`
+	Domain   string `xml:"domain,attr"`
+	Type     string `xml:"type,attr"`
+	Reserved bool   `xml:"reserved,attr"`
+}
+
+// Go side of an AMQP type: the struct field type and the codec function suffix
+var types = map[string][2]string{
+	"octet":     {"byte", "Octet"},
+	"short":     {"uint16", "Short"},
+	"long":      {"uint32", "Long"},
+	"longlong":  {"uint64", "Longlong"},
+	"shortstr":  {"string", "Shortstr"},
+	"longstr":   {"string", "Longstr"},
+	"timestamp": {"time.Time", "Timestamp"},
+	"table":     {"transfer.Table", "Table"},
+	"bit":       {"bool", ""},
+}
+
+// View of a method for the template
+type methodView struct {
+	Class      string
+	Name       string
+	Struct     string
+	ClassId    uint16
+	MethodId   uint16
+	HasContent bool
+	Fields     []fieldView
+	HasBits    bool
+}
+
+type fieldView struct {
+	Name  string
+	Type  string
+	Codec string
+	// position of a bit field in its octet, the octet is flushed after LastBit
+	Bit     int
+	LastBit bool
+}
+
+type classView struct {
+	Name       string
+	Index      uint16
+	Methods    []methodView
+	Properties []propertyView
+}
+
+// Content property of a class, Flag is its bit in the property flags
+type propertyView struct {
+	Name  string
+	Type  string
+	Codec string
+	Flag  uint16
+	IsSet string
+}
+
+// How to tell a property was set
+var isSet = map[string]string{
+	"octet":     "%s != 0",
+	"shortstr":  `%s != ""`,
+	"timestamp": "!%s.IsZero()",
+	"table":     "%s != nil",
+}
+
+func main() {
+	specPath := flag.String("spec", "amqp0-9-1.stripped.extended.xml", "AMQP 0-9-1 XML specification")
+	outPath := flag.String("out", "methods.go", "generated file")
+	flag.Parse()
+
+	if err := generate(*specPath, *outPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func generate(specPath string, outPath string) error {
+	source, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		return err
+	}
+
+	var spec amqp
+	if err := xml.Unmarshal(source, &spec); err != nil {
+		return err
+	}
+
+	domains := make(map[string]string)
+	for _, d := range spec.Domains {
+		domains[d.Name] = d.Type
+	}
+
+	var classes []classView
+	usesTime := false
+
+	for _, c := range spec.Classes {
+		cv := classView{Name: c.Name, Index: c.Index}
+
+		// content properties take the property flag bits from the most significant one down,
+		// the last bit is reserved for the flags continuation
+		if len(c.Fields) > 15 {
+			return fmt.Errorf("%s: more than 15 properties are not supported", c.Name)
+		}
+		for i, f := range c.Fields {
+			typ := domains[f.Domain]
+			set, ok := isSet[typ]
+			if !ok {
+				return fmt.Errorf("%s: unsupported type of property %q", c.Name, f.Name)
+			}
+			if typ == "timestamp" {
+				usesTime = true
+			}
+
+			cv.Properties = append(cv.Properties, propertyView{
+				Name:  camel(f.Name),
+				Type:  types[typ][0],
+				Codec: types[typ][1],
+				Flag:  1 << uint(15-i),
+				IsSet: fmt.Sprintf(set, "p."+camel(f.Name)),
+			})
+		}
+
+		for _, m := range c.Methods {
+			mv := methodView{
+				Class:      c.Name,
+				Name:       m.Name,
+				Struct:     camel(c.Name) + camel(m.Name),
+				ClassId:    c.Index,
+				MethodId:   m.Index,
+				HasContent: m.Content,
+			}
+
+			bit := 0
+			for i, f := range m.Fields {
+				typ := f.Type
+				if typ == "" {
+					typ = domains[f.Domain]
+				}
+
+				goType, ok := types[typ]
+				if !ok {
+					return fmt.Errorf("%s.%s: unknown type of field %q", c.Name, m.Name, f.Name)
+				}
+				if typ == "timestamp" {
+					usesTime = true
+				}
+
+				fv := fieldView{
+					Name:  camel(f.Name),
+					Type:  goType[0],
+					Codec: goType[1],
+					Bit:   -1,
+				}
+				if f.Reserved {
+					fv.Name = strings.ToLower(fv.Name[:1]) + fv.Name[1:]
+				}
+
+				// consecutive bits are packed into one octet, the least significant bit first
+				if typ == "bit" {
+					fv.Bit = bit
+					bit++
+					mv.HasBits = true
+
+					next := ""
+					if i+1 < len(m.Fields) {
+						next = m.Fields[i+1].Type
+						if next == "" {
+							next = domains[m.Fields[i+1].Domain]
+						}
+					}
+					if next != "bit" || bit == 8 {
+						fv.LastBit = true
+						bit = 0
+					}
+				}
+
+				mv.Fields = append(mv.Fields, fv)
+			}
+
+			cv.Methods = append(cv.Methods, mv)
+		}
+
+		classes = append(classes, cv)
+	}
+
+	var buf bytes.Buffer
+	err = codeTemplate.Execute(&buf, map[string]interface{}{
+		"Source":   specPath,
+		"Classes":  classes,
+		"UsesTime": usesTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	code, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("generated code is not valid: %s", err)
+	}
+
+	return ioutil.WriteFile(outPath, code, 0644)
+}
+
+// "start-ok" -> "StartOk"
+func camel(name string) string {
+	var out strings.Builder
+	for _, part := range strings.Split(name, "-") {
+		if part == "" {
+			continue
+		}
+		out.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+
+	return out.String()
+}
+
+var codeTemplate = template.Must(template.New("methods").Funcs(template.FuncMap{"title": camel}).Parse(`// Code generated by gen/main.go from {{.Source}}. DO NOT EDIT.
+
+package spec091
+
+import (
+	"fmt"
+	transfer "github.com/sv-z/amqproxy/Internal/ampq/data-transfer"
+	"io"
+{{- if .UsesTime}}
+	"time"
+{{- end}}
+)
+
+{{range .Classes}}{{range .Methods}}
+// {{.Class}}.{{.Name}}
+type {{.Struct}} struct {
+{{- range .Fields}}
+	{{.Name}} {{.Type}}
+{{- end}}
+}
+
+func (m *{{.Struct}}) Id() (uint16, uint16) {
+	return {{.ClassId}}, {{.MethodId}}
+}
+
+func (m *{{.Struct}}) Name() string {
+	return "{{.Class}}.{{.Name}}"
+}
+
+func (m *{{.Struct}}) HasContent() bool {
+	return {{.HasContent}}
+}
+
+func (m *{{.Struct}}) read(r io.Reader) (err error) {
+{{- if .HasBits}}
+	var bits byte
+{{- end}}
+{{- range .Fields}}
+{{- if ge .Bit 0}}
+{{- if eq .Bit 0}}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+{{- end}}
+	m.{{.Name}} = bits&(1<<{{.Bit}}) > 0
+{{- else}}
+	if m.{{.Name}}, err = read{{.Codec}}(r); err != nil {
+		return
+	}
+{{- end}}
+{{- end}}
+
+	return
+}
+
+func (m *{{.Struct}}) write(w io.Writer) (err error) {
+{{- if .HasBits}}
+	var bits byte
+{{- end}}
+{{- range .Fields}}
+{{- if ge .Bit 0}}
+{{- if eq .Bit 0}}
+	bits = 0
+{{- end}}
+	if m.{{.Name}} {
+		bits |= 1 << {{.Bit}}
+	}
+{{- if .LastBit}}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+{{- end}}
+{{- else}}
+	if err = write{{.Codec}}(w, m.{{.Name}}); err != nil {
+		return
+	}
+{{- end}}
+{{- end}}
+
+	return
+}
+{{end}}{{end}}
+{{- range .Classes}}{{if .Properties}}
+// {{.Name}} content properties
+type {{.Name | title}}Properties struct {
+{{- range .Properties}}
+	{{.Name}} {{.Type}}
+{{- end}}
+	// properties present on the wire, the ones with a non zero value are always written
+	flags uint16
+}
+
+func (p *{{.Name | title}}Properties) read(r io.Reader) (err error) {
+	if p.flags, err = readShort(r); err != nil {
+		return
+	}
+
+	// the flags continue in the next word, no property is defined there
+	for more := p.flags&1 != 0; more; {
+		var next uint16
+		if next, err = readShort(r); err != nil {
+			return
+		}
+		more = next&1 != 0
+	}
+{{range .Properties}}
+	if p.flags&{{printf "0x%04x" .Flag}} != 0 {
+		if p.{{.Name}}, err = read{{.Codec}}(r); err != nil {
+			return
+		}
+	}
+{{- end}}
+
+	return
+}
+
+func (p *{{.Name | title}}Properties) write(w io.Writer) (err error) {
+	flags := p.flags &^ 1
+{{- range .Properties}}
+	if {{.IsSet}} {
+		flags |= {{printf "0x%04x" .Flag}}
+	}
+{{- end}}
+
+	if err = writeShort(w, flags); err != nil {
+		return
+	}
+{{range .Properties}}
+	if flags&{{printf "0x%04x" .Flag}} != 0 {
+		if err = write{{.Codec}}(w, p.{{.Name}}); err != nil {
+			return
+		}
+	}
+{{- end}}
+
+	return
+}
+{{end}}{{end}}
+// Empty method for the class and method id
+func newMethod(classId uint16, methodId uint16) (Method, error) {
+	switch classId {
+{{- range .Classes}}
+	case {{.Index}}: // {{.Name}}
+		switch methodId {
+{{- range .Methods}}
+		case {{.MethodId}}: // {{.Class}} {{.Name}}
+			return &{{.Struct}}{}, nil
+{{- end}}
+		}
+		return nil, fmt.Errorf("bad method frame, unknown method %d for class %d", methodId, classId)
+{{- end}}
+	}
+
+	return nil, fmt.Errorf("bad method frame, unknown class %d", classId)
+}
+`))
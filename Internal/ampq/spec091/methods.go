@@ -0,0 +1,3122 @@
+// Code generated by gen/main.go from amqp0-9-1.stripped.extended.xml. DO NOT EDIT.
+
+package spec091
+
+import (
+	"fmt"
+	transfer "github.com/sv-z/amqproxy/Internal/ampq/data-transfer"
+	"io"
+	"time"
+)
+
+// connection.start
+type ConnectionStart struct {
+	VersionMajor     byte
+	VersionMinor     byte
+	ServerProperties transfer.Table
+	Mechanisms       string
+	Locales          string
+}
+
+func (m *ConnectionStart) Id() (uint16, uint16) {
+	return 10, 10
+}
+
+func (m *ConnectionStart) Name() string {
+	return "connection.start"
+}
+
+func (m *ConnectionStart) HasContent() bool {
+	return false
+}
+
+func (m *ConnectionStart) read(r io.Reader) (err error) {
+	if m.VersionMajor, err = readOctet(r); err != nil {
+		return
+	}
+	if m.VersionMinor, err = readOctet(r); err != nil {
+		return
+	}
+	if m.ServerProperties, err = readTable(r); err != nil {
+		return
+	}
+	if m.Mechanisms, err = readLongstr(r); err != nil {
+		return
+	}
+	if m.Locales, err = readLongstr(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *ConnectionStart) write(w io.Writer) (err error) {
+	if err = writeOctet(w, m.VersionMajor); err != nil {
+		return
+	}
+	if err = writeOctet(w, m.VersionMinor); err != nil {
+		return
+	}
+	if err = writeTable(w, m.ServerProperties); err != nil {
+		return
+	}
+	if err = writeLongstr(w, m.Mechanisms); err != nil {
+		return
+	}
+	if err = writeLongstr(w, m.Locales); err != nil {
+		return
+	}
+
+	return
+}
+
+// connection.start-ok
+type ConnectionStartOk struct {
+	ClientProperties transfer.Table
+	Mechanism        string
+	Response         string
+	Locale           string
+}
+
+func (m *ConnectionStartOk) Id() (uint16, uint16) {
+	return 10, 11
+}
+
+func (m *ConnectionStartOk) Name() string {
+	return "connection.start-ok"
+}
+
+func (m *ConnectionStartOk) HasContent() bool {
+	return false
+}
+
+func (m *ConnectionStartOk) read(r io.Reader) (err error) {
+	if m.ClientProperties, err = readTable(r); err != nil {
+		return
+	}
+	if m.Mechanism, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.Response, err = readLongstr(r); err != nil {
+		return
+	}
+	if m.Locale, err = readShortstr(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *ConnectionStartOk) write(w io.Writer) (err error) {
+	if err = writeTable(w, m.ClientProperties); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Mechanism); err != nil {
+		return
+	}
+	if err = writeLongstr(w, m.Response); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Locale); err != nil {
+		return
+	}
+
+	return
+}
+
+// connection.secure
+type ConnectionSecure struct {
+	Challenge string
+}
+
+func (m *ConnectionSecure) Id() (uint16, uint16) {
+	return 10, 20
+}
+
+func (m *ConnectionSecure) Name() string {
+	return "connection.secure"
+}
+
+func (m *ConnectionSecure) HasContent() bool {
+	return false
+}
+
+func (m *ConnectionSecure) read(r io.Reader) (err error) {
+	if m.Challenge, err = readLongstr(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *ConnectionSecure) write(w io.Writer) (err error) {
+	if err = writeLongstr(w, m.Challenge); err != nil {
+		return
+	}
+
+	return
+}
+
+// connection.secure-ok
+type ConnectionSecureOk struct {
+	Response string
+}
+
+func (m *ConnectionSecureOk) Id() (uint16, uint16) {
+	return 10, 21
+}
+
+func (m *ConnectionSecureOk) Name() string {
+	return "connection.secure-ok"
+}
+
+func (m *ConnectionSecureOk) HasContent() bool {
+	return false
+}
+
+func (m *ConnectionSecureOk) read(r io.Reader) (err error) {
+	if m.Response, err = readLongstr(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *ConnectionSecureOk) write(w io.Writer) (err error) {
+	if err = writeLongstr(w, m.Response); err != nil {
+		return
+	}
+
+	return
+}
+
+// connection.tune
+type ConnectionTune struct {
+	ChannelMax uint16
+	FrameMax   uint32
+	Heartbeat  uint16
+}
+
+func (m *ConnectionTune) Id() (uint16, uint16) {
+	return 10, 30
+}
+
+func (m *ConnectionTune) Name() string {
+	return "connection.tune"
+}
+
+func (m *ConnectionTune) HasContent() bool {
+	return false
+}
+
+func (m *ConnectionTune) read(r io.Reader) (err error) {
+	if m.ChannelMax, err = readShort(r); err != nil {
+		return
+	}
+	if m.FrameMax, err = readLong(r); err != nil {
+		return
+	}
+	if m.Heartbeat, err = readShort(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *ConnectionTune) write(w io.Writer) (err error) {
+	if err = writeShort(w, m.ChannelMax); err != nil {
+		return
+	}
+	if err = writeLong(w, m.FrameMax); err != nil {
+		return
+	}
+	if err = writeShort(w, m.Heartbeat); err != nil {
+		return
+	}
+
+	return
+}
+
+// connection.tune-ok
+type ConnectionTuneOk struct {
+	ChannelMax uint16
+	FrameMax   uint32
+	Heartbeat  uint16
+}
+
+func (m *ConnectionTuneOk) Id() (uint16, uint16) {
+	return 10, 31
+}
+
+func (m *ConnectionTuneOk) Name() string {
+	return "connection.tune-ok"
+}
+
+func (m *ConnectionTuneOk) HasContent() bool {
+	return false
+}
+
+func (m *ConnectionTuneOk) read(r io.Reader) (err error) {
+	if m.ChannelMax, err = readShort(r); err != nil {
+		return
+	}
+	if m.FrameMax, err = readLong(r); err != nil {
+		return
+	}
+	if m.Heartbeat, err = readShort(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *ConnectionTuneOk) write(w io.Writer) (err error) {
+	if err = writeShort(w, m.ChannelMax); err != nil {
+		return
+	}
+	if err = writeLong(w, m.FrameMax); err != nil {
+		return
+	}
+	if err = writeShort(w, m.Heartbeat); err != nil {
+		return
+	}
+
+	return
+}
+
+// connection.open
+type ConnectionOpen struct {
+	VirtualHost string
+	reserved1   string
+	reserved2   bool
+}
+
+func (m *ConnectionOpen) Id() (uint16, uint16) {
+	return 10, 40
+}
+
+func (m *ConnectionOpen) Name() string {
+	return "connection.open"
+}
+
+func (m *ConnectionOpen) HasContent() bool {
+	return false
+}
+
+func (m *ConnectionOpen) read(r io.Reader) (err error) {
+	var bits byte
+	if m.VirtualHost, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.reserved1, err = readShortstr(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.reserved2 = bits&(1<<0) > 0
+
+	return
+}
+
+func (m *ConnectionOpen) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeShortstr(w, m.VirtualHost); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.reserved1); err != nil {
+		return
+	}
+	bits = 0
+	if m.reserved2 {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+
+	return
+}
+
+// connection.open-ok
+type ConnectionOpenOk struct {
+	reserved1 string
+}
+
+func (m *ConnectionOpenOk) Id() (uint16, uint16) {
+	return 10, 41
+}
+
+func (m *ConnectionOpenOk) Name() string {
+	return "connection.open-ok"
+}
+
+func (m *ConnectionOpenOk) HasContent() bool {
+	return false
+}
+
+func (m *ConnectionOpenOk) read(r io.Reader) (err error) {
+	if m.reserved1, err = readShortstr(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *ConnectionOpenOk) write(w io.Writer) (err error) {
+	if err = writeShortstr(w, m.reserved1); err != nil {
+		return
+	}
+
+	return
+}
+
+// connection.close
+type ConnectionClose struct {
+	ReplyCode uint16
+	ReplyText string
+	ClassId   uint16
+	MethodId  uint16
+}
+
+func (m *ConnectionClose) Id() (uint16, uint16) {
+	return 10, 50
+}
+
+func (m *ConnectionClose) Name() string {
+	return "connection.close"
+}
+
+func (m *ConnectionClose) HasContent() bool {
+	return false
+}
+
+func (m *ConnectionClose) read(r io.Reader) (err error) {
+	if m.ReplyCode, err = readShort(r); err != nil {
+		return
+	}
+	if m.ReplyText, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.ClassId, err = readShort(r); err != nil {
+		return
+	}
+	if m.MethodId, err = readShort(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *ConnectionClose) write(w io.Writer) (err error) {
+	if err = writeShort(w, m.ReplyCode); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.ReplyText); err != nil {
+		return
+	}
+	if err = writeShort(w, m.ClassId); err != nil {
+		return
+	}
+	if err = writeShort(w, m.MethodId); err != nil {
+		return
+	}
+
+	return
+}
+
+// connection.close-ok
+type ConnectionCloseOk struct {
+}
+
+func (m *ConnectionCloseOk) Id() (uint16, uint16) {
+	return 10, 51
+}
+
+func (m *ConnectionCloseOk) Name() string {
+	return "connection.close-ok"
+}
+
+func (m *ConnectionCloseOk) HasContent() bool {
+	return false
+}
+
+func (m *ConnectionCloseOk) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *ConnectionCloseOk) write(w io.Writer) (err error) {
+
+	return
+}
+
+// connection.blocked
+type ConnectionBlocked struct {
+	Reason string
+}
+
+func (m *ConnectionBlocked) Id() (uint16, uint16) {
+	return 10, 60
+}
+
+func (m *ConnectionBlocked) Name() string {
+	return "connection.blocked"
+}
+
+func (m *ConnectionBlocked) HasContent() bool {
+	return false
+}
+
+func (m *ConnectionBlocked) read(r io.Reader) (err error) {
+	if m.Reason, err = readShortstr(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *ConnectionBlocked) write(w io.Writer) (err error) {
+	if err = writeShortstr(w, m.Reason); err != nil {
+		return
+	}
+
+	return
+}
+
+// connection.unblocked
+type ConnectionUnblocked struct {
+}
+
+func (m *ConnectionUnblocked) Id() (uint16, uint16) {
+	return 10, 61
+}
+
+func (m *ConnectionUnblocked) Name() string {
+	return "connection.unblocked"
+}
+
+func (m *ConnectionUnblocked) HasContent() bool {
+	return false
+}
+
+func (m *ConnectionUnblocked) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *ConnectionUnblocked) write(w io.Writer) (err error) {
+
+	return
+}
+
+// channel.open
+type ChannelOpen struct {
+	reserved1 string
+}
+
+func (m *ChannelOpen) Id() (uint16, uint16) {
+	return 20, 10
+}
+
+func (m *ChannelOpen) Name() string {
+	return "channel.open"
+}
+
+func (m *ChannelOpen) HasContent() bool {
+	return false
+}
+
+func (m *ChannelOpen) read(r io.Reader) (err error) {
+	if m.reserved1, err = readShortstr(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *ChannelOpen) write(w io.Writer) (err error) {
+	if err = writeShortstr(w, m.reserved1); err != nil {
+		return
+	}
+
+	return
+}
+
+// channel.open-ok
+type ChannelOpenOk struct {
+	reserved1 string
+}
+
+func (m *ChannelOpenOk) Id() (uint16, uint16) {
+	return 20, 11
+}
+
+func (m *ChannelOpenOk) Name() string {
+	return "channel.open-ok"
+}
+
+func (m *ChannelOpenOk) HasContent() bool {
+	return false
+}
+
+func (m *ChannelOpenOk) read(r io.Reader) (err error) {
+	if m.reserved1, err = readLongstr(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *ChannelOpenOk) write(w io.Writer) (err error) {
+	if err = writeLongstr(w, m.reserved1); err != nil {
+		return
+	}
+
+	return
+}
+
+// channel.flow
+type ChannelFlow struct {
+	Active bool
+}
+
+func (m *ChannelFlow) Id() (uint16, uint16) {
+	return 20, 20
+}
+
+func (m *ChannelFlow) Name() string {
+	return "channel.flow"
+}
+
+func (m *ChannelFlow) HasContent() bool {
+	return false
+}
+
+func (m *ChannelFlow) read(r io.Reader) (err error) {
+	var bits byte
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.Active = bits&(1<<0) > 0
+
+	return
+}
+
+func (m *ChannelFlow) write(w io.Writer) (err error) {
+	var bits byte
+	bits = 0
+	if m.Active {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+
+	return
+}
+
+// channel.flow-ok
+type ChannelFlowOk struct {
+	Active bool
+}
+
+func (m *ChannelFlowOk) Id() (uint16, uint16) {
+	return 20, 21
+}
+
+func (m *ChannelFlowOk) Name() string {
+	return "channel.flow-ok"
+}
+
+func (m *ChannelFlowOk) HasContent() bool {
+	return false
+}
+
+func (m *ChannelFlowOk) read(r io.Reader) (err error) {
+	var bits byte
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.Active = bits&(1<<0) > 0
+
+	return
+}
+
+func (m *ChannelFlowOk) write(w io.Writer) (err error) {
+	var bits byte
+	bits = 0
+	if m.Active {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+
+	return
+}
+
+// channel.close
+type ChannelClose struct {
+	ReplyCode uint16
+	ReplyText string
+	ClassId   uint16
+	MethodId  uint16
+}
+
+func (m *ChannelClose) Id() (uint16, uint16) {
+	return 20, 40
+}
+
+func (m *ChannelClose) Name() string {
+	return "channel.close"
+}
+
+func (m *ChannelClose) HasContent() bool {
+	return false
+}
+
+func (m *ChannelClose) read(r io.Reader) (err error) {
+	if m.ReplyCode, err = readShort(r); err != nil {
+		return
+	}
+	if m.ReplyText, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.ClassId, err = readShort(r); err != nil {
+		return
+	}
+	if m.MethodId, err = readShort(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *ChannelClose) write(w io.Writer) (err error) {
+	if err = writeShort(w, m.ReplyCode); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.ReplyText); err != nil {
+		return
+	}
+	if err = writeShort(w, m.ClassId); err != nil {
+		return
+	}
+	if err = writeShort(w, m.MethodId); err != nil {
+		return
+	}
+
+	return
+}
+
+// channel.close-ok
+type ChannelCloseOk struct {
+}
+
+func (m *ChannelCloseOk) Id() (uint16, uint16) {
+	return 20, 41
+}
+
+func (m *ChannelCloseOk) Name() string {
+	return "channel.close-ok"
+}
+
+func (m *ChannelCloseOk) HasContent() bool {
+	return false
+}
+
+func (m *ChannelCloseOk) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *ChannelCloseOk) write(w io.Writer) (err error) {
+
+	return
+}
+
+// exchange.declare
+type ExchangeDeclare struct {
+	reserved1  uint16
+	Exchange   string
+	Type       string
+	Passive    bool
+	Durable    bool
+	AutoDelete bool
+	Internal   bool
+	NoWait     bool
+	Arguments  transfer.Table
+}
+
+func (m *ExchangeDeclare) Id() (uint16, uint16) {
+	return 40, 10
+}
+
+func (m *ExchangeDeclare) Name() string {
+	return "exchange.declare"
+}
+
+func (m *ExchangeDeclare) HasContent() bool {
+	return false
+}
+
+func (m *ExchangeDeclare) read(r io.Reader) (err error) {
+	var bits byte
+	if m.reserved1, err = readShort(r); err != nil {
+		return
+	}
+	if m.Exchange, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.Type, err = readShortstr(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.Passive = bits&(1<<0) > 0
+	m.Durable = bits&(1<<1) > 0
+	m.AutoDelete = bits&(1<<2) > 0
+	m.Internal = bits&(1<<3) > 0
+	m.NoWait = bits&(1<<4) > 0
+	if m.Arguments, err = readTable(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *ExchangeDeclare) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeShort(w, m.reserved1); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Exchange); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Type); err != nil {
+		return
+	}
+	bits = 0
+	if m.Passive {
+		bits |= 1 << 0
+	}
+	if m.Durable {
+		bits |= 1 << 1
+	}
+	if m.AutoDelete {
+		bits |= 1 << 2
+	}
+	if m.Internal {
+		bits |= 1 << 3
+	}
+	if m.NoWait {
+		bits |= 1 << 4
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+	if err = writeTable(w, m.Arguments); err != nil {
+		return
+	}
+
+	return
+}
+
+// exchange.declare-ok
+type ExchangeDeclareOk struct {
+}
+
+func (m *ExchangeDeclareOk) Id() (uint16, uint16) {
+	return 40, 11
+}
+
+func (m *ExchangeDeclareOk) Name() string {
+	return "exchange.declare-ok"
+}
+
+func (m *ExchangeDeclareOk) HasContent() bool {
+	return false
+}
+
+func (m *ExchangeDeclareOk) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *ExchangeDeclareOk) write(w io.Writer) (err error) {
+
+	return
+}
+
+// exchange.delete
+type ExchangeDelete struct {
+	reserved1 uint16
+	Exchange  string
+	IfUnused  bool
+	NoWait    bool
+}
+
+func (m *ExchangeDelete) Id() (uint16, uint16) {
+	return 40, 20
+}
+
+func (m *ExchangeDelete) Name() string {
+	return "exchange.delete"
+}
+
+func (m *ExchangeDelete) HasContent() bool {
+	return false
+}
+
+func (m *ExchangeDelete) read(r io.Reader) (err error) {
+	var bits byte
+	if m.reserved1, err = readShort(r); err != nil {
+		return
+	}
+	if m.Exchange, err = readShortstr(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.IfUnused = bits&(1<<0) > 0
+	m.NoWait = bits&(1<<1) > 0
+
+	return
+}
+
+func (m *ExchangeDelete) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeShort(w, m.reserved1); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Exchange); err != nil {
+		return
+	}
+	bits = 0
+	if m.IfUnused {
+		bits |= 1 << 0
+	}
+	if m.NoWait {
+		bits |= 1 << 1
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+
+	return
+}
+
+// exchange.delete-ok
+type ExchangeDeleteOk struct {
+}
+
+func (m *ExchangeDeleteOk) Id() (uint16, uint16) {
+	return 40, 21
+}
+
+func (m *ExchangeDeleteOk) Name() string {
+	return "exchange.delete-ok"
+}
+
+func (m *ExchangeDeleteOk) HasContent() bool {
+	return false
+}
+
+func (m *ExchangeDeleteOk) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *ExchangeDeleteOk) write(w io.Writer) (err error) {
+
+	return
+}
+
+// exchange.bind
+type ExchangeBind struct {
+	reserved1   uint16
+	Destination string
+	Source      string
+	RoutingKey  string
+	NoWait      bool
+	Arguments   transfer.Table
+}
+
+func (m *ExchangeBind) Id() (uint16, uint16) {
+	return 40, 30
+}
+
+func (m *ExchangeBind) Name() string {
+	return "exchange.bind"
+}
+
+func (m *ExchangeBind) HasContent() bool {
+	return false
+}
+
+func (m *ExchangeBind) read(r io.Reader) (err error) {
+	var bits byte
+	if m.reserved1, err = readShort(r); err != nil {
+		return
+	}
+	if m.Destination, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.Source, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.RoutingKey, err = readShortstr(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.NoWait = bits&(1<<0) > 0
+	if m.Arguments, err = readTable(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *ExchangeBind) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeShort(w, m.reserved1); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Destination); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Source); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.RoutingKey); err != nil {
+		return
+	}
+	bits = 0
+	if m.NoWait {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+	if err = writeTable(w, m.Arguments); err != nil {
+		return
+	}
+
+	return
+}
+
+// exchange.bind-ok
+type ExchangeBindOk struct {
+}
+
+func (m *ExchangeBindOk) Id() (uint16, uint16) {
+	return 40, 31
+}
+
+func (m *ExchangeBindOk) Name() string {
+	return "exchange.bind-ok"
+}
+
+func (m *ExchangeBindOk) HasContent() bool {
+	return false
+}
+
+func (m *ExchangeBindOk) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *ExchangeBindOk) write(w io.Writer) (err error) {
+
+	return
+}
+
+// exchange.unbind
+type ExchangeUnbind struct {
+	reserved1   uint16
+	Destination string
+	Source      string
+	RoutingKey  string
+	NoWait      bool
+	Arguments   transfer.Table
+}
+
+func (m *ExchangeUnbind) Id() (uint16, uint16) {
+	return 40, 40
+}
+
+func (m *ExchangeUnbind) Name() string {
+	return "exchange.unbind"
+}
+
+func (m *ExchangeUnbind) HasContent() bool {
+	return false
+}
+
+func (m *ExchangeUnbind) read(r io.Reader) (err error) {
+	var bits byte
+	if m.reserved1, err = readShort(r); err != nil {
+		return
+	}
+	if m.Destination, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.Source, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.RoutingKey, err = readShortstr(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.NoWait = bits&(1<<0) > 0
+	if m.Arguments, err = readTable(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *ExchangeUnbind) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeShort(w, m.reserved1); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Destination); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Source); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.RoutingKey); err != nil {
+		return
+	}
+	bits = 0
+	if m.NoWait {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+	if err = writeTable(w, m.Arguments); err != nil {
+		return
+	}
+
+	return
+}
+
+// exchange.unbind-ok
+type ExchangeUnbindOk struct {
+}
+
+func (m *ExchangeUnbindOk) Id() (uint16, uint16) {
+	return 40, 51
+}
+
+func (m *ExchangeUnbindOk) Name() string {
+	return "exchange.unbind-ok"
+}
+
+func (m *ExchangeUnbindOk) HasContent() bool {
+	return false
+}
+
+func (m *ExchangeUnbindOk) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *ExchangeUnbindOk) write(w io.Writer) (err error) {
+
+	return
+}
+
+// queue.declare
+type QueueDeclare struct {
+	reserved1  uint16
+	Queue      string
+	Passive    bool
+	Durable    bool
+	Exclusive  bool
+	AutoDelete bool
+	NoWait     bool
+	Arguments  transfer.Table
+}
+
+func (m *QueueDeclare) Id() (uint16, uint16) {
+	return 50, 10
+}
+
+func (m *QueueDeclare) Name() string {
+	return "queue.declare"
+}
+
+func (m *QueueDeclare) HasContent() bool {
+	return false
+}
+
+func (m *QueueDeclare) read(r io.Reader) (err error) {
+	var bits byte
+	if m.reserved1, err = readShort(r); err != nil {
+		return
+	}
+	if m.Queue, err = readShortstr(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.Passive = bits&(1<<0) > 0
+	m.Durable = bits&(1<<1) > 0
+	m.Exclusive = bits&(1<<2) > 0
+	m.AutoDelete = bits&(1<<3) > 0
+	m.NoWait = bits&(1<<4) > 0
+	if m.Arguments, err = readTable(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *QueueDeclare) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeShort(w, m.reserved1); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Queue); err != nil {
+		return
+	}
+	bits = 0
+	if m.Passive {
+		bits |= 1 << 0
+	}
+	if m.Durable {
+		bits |= 1 << 1
+	}
+	if m.Exclusive {
+		bits |= 1 << 2
+	}
+	if m.AutoDelete {
+		bits |= 1 << 3
+	}
+	if m.NoWait {
+		bits |= 1 << 4
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+	if err = writeTable(w, m.Arguments); err != nil {
+		return
+	}
+
+	return
+}
+
+// queue.declare-ok
+type QueueDeclareOk struct {
+	Queue         string
+	MessageCount  uint32
+	ConsumerCount uint32
+}
+
+func (m *QueueDeclareOk) Id() (uint16, uint16) {
+	return 50, 11
+}
+
+func (m *QueueDeclareOk) Name() string {
+	return "queue.declare-ok"
+}
+
+func (m *QueueDeclareOk) HasContent() bool {
+	return false
+}
+
+func (m *QueueDeclareOk) read(r io.Reader) (err error) {
+	if m.Queue, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.MessageCount, err = readLong(r); err != nil {
+		return
+	}
+	if m.ConsumerCount, err = readLong(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *QueueDeclareOk) write(w io.Writer) (err error) {
+	if err = writeShortstr(w, m.Queue); err != nil {
+		return
+	}
+	if err = writeLong(w, m.MessageCount); err != nil {
+		return
+	}
+	if err = writeLong(w, m.ConsumerCount); err != nil {
+		return
+	}
+
+	return
+}
+
+// queue.bind
+type QueueBind struct {
+	reserved1  uint16
+	Queue      string
+	Exchange   string
+	RoutingKey string
+	NoWait     bool
+	Arguments  transfer.Table
+}
+
+func (m *QueueBind) Id() (uint16, uint16) {
+	return 50, 20
+}
+
+func (m *QueueBind) Name() string {
+	return "queue.bind"
+}
+
+func (m *QueueBind) HasContent() bool {
+	return false
+}
+
+func (m *QueueBind) read(r io.Reader) (err error) {
+	var bits byte
+	if m.reserved1, err = readShort(r); err != nil {
+		return
+	}
+	if m.Queue, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.Exchange, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.RoutingKey, err = readShortstr(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.NoWait = bits&(1<<0) > 0
+	if m.Arguments, err = readTable(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *QueueBind) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeShort(w, m.reserved1); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Queue); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Exchange); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.RoutingKey); err != nil {
+		return
+	}
+	bits = 0
+	if m.NoWait {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+	if err = writeTable(w, m.Arguments); err != nil {
+		return
+	}
+
+	return
+}
+
+// queue.bind-ok
+type QueueBindOk struct {
+}
+
+func (m *QueueBindOk) Id() (uint16, uint16) {
+	return 50, 21
+}
+
+func (m *QueueBindOk) Name() string {
+	return "queue.bind-ok"
+}
+
+func (m *QueueBindOk) HasContent() bool {
+	return false
+}
+
+func (m *QueueBindOk) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *QueueBindOk) write(w io.Writer) (err error) {
+
+	return
+}
+
+// queue.unbind
+type QueueUnbind struct {
+	reserved1  uint16
+	Queue      string
+	Exchange   string
+	RoutingKey string
+	Arguments  transfer.Table
+}
+
+func (m *QueueUnbind) Id() (uint16, uint16) {
+	return 50, 50
+}
+
+func (m *QueueUnbind) Name() string {
+	return "queue.unbind"
+}
+
+func (m *QueueUnbind) HasContent() bool {
+	return false
+}
+
+func (m *QueueUnbind) read(r io.Reader) (err error) {
+	if m.reserved1, err = readShort(r); err != nil {
+		return
+	}
+	if m.Queue, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.Exchange, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.RoutingKey, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.Arguments, err = readTable(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *QueueUnbind) write(w io.Writer) (err error) {
+	if err = writeShort(w, m.reserved1); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Queue); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Exchange); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.RoutingKey); err != nil {
+		return
+	}
+	if err = writeTable(w, m.Arguments); err != nil {
+		return
+	}
+
+	return
+}
+
+// queue.unbind-ok
+type QueueUnbindOk struct {
+}
+
+func (m *QueueUnbindOk) Id() (uint16, uint16) {
+	return 50, 51
+}
+
+func (m *QueueUnbindOk) Name() string {
+	return "queue.unbind-ok"
+}
+
+func (m *QueueUnbindOk) HasContent() bool {
+	return false
+}
+
+func (m *QueueUnbindOk) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *QueueUnbindOk) write(w io.Writer) (err error) {
+
+	return
+}
+
+// queue.purge
+type QueuePurge struct {
+	reserved1 uint16
+	Queue     string
+	NoWait    bool
+}
+
+func (m *QueuePurge) Id() (uint16, uint16) {
+	return 50, 30
+}
+
+func (m *QueuePurge) Name() string {
+	return "queue.purge"
+}
+
+func (m *QueuePurge) HasContent() bool {
+	return false
+}
+
+func (m *QueuePurge) read(r io.Reader) (err error) {
+	var bits byte
+	if m.reserved1, err = readShort(r); err != nil {
+		return
+	}
+	if m.Queue, err = readShortstr(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.NoWait = bits&(1<<0) > 0
+
+	return
+}
+
+func (m *QueuePurge) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeShort(w, m.reserved1); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Queue); err != nil {
+		return
+	}
+	bits = 0
+	if m.NoWait {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+
+	return
+}
+
+// queue.purge-ok
+type QueuePurgeOk struct {
+	MessageCount uint32
+}
+
+func (m *QueuePurgeOk) Id() (uint16, uint16) {
+	return 50, 31
+}
+
+func (m *QueuePurgeOk) Name() string {
+	return "queue.purge-ok"
+}
+
+func (m *QueuePurgeOk) HasContent() bool {
+	return false
+}
+
+func (m *QueuePurgeOk) read(r io.Reader) (err error) {
+	if m.MessageCount, err = readLong(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *QueuePurgeOk) write(w io.Writer) (err error) {
+	if err = writeLong(w, m.MessageCount); err != nil {
+		return
+	}
+
+	return
+}
+
+// queue.delete
+type QueueDelete struct {
+	reserved1 uint16
+	Queue     string
+	IfUnused  bool
+	IfEmpty   bool
+	NoWait    bool
+}
+
+func (m *QueueDelete) Id() (uint16, uint16) {
+	return 50, 40
+}
+
+func (m *QueueDelete) Name() string {
+	return "queue.delete"
+}
+
+func (m *QueueDelete) HasContent() bool {
+	return false
+}
+
+func (m *QueueDelete) read(r io.Reader) (err error) {
+	var bits byte
+	if m.reserved1, err = readShort(r); err != nil {
+		return
+	}
+	if m.Queue, err = readShortstr(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.IfUnused = bits&(1<<0) > 0
+	m.IfEmpty = bits&(1<<1) > 0
+	m.NoWait = bits&(1<<2) > 0
+
+	return
+}
+
+func (m *QueueDelete) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeShort(w, m.reserved1); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Queue); err != nil {
+		return
+	}
+	bits = 0
+	if m.IfUnused {
+		bits |= 1 << 0
+	}
+	if m.IfEmpty {
+		bits |= 1 << 1
+	}
+	if m.NoWait {
+		bits |= 1 << 2
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+
+	return
+}
+
+// queue.delete-ok
+type QueueDeleteOk struct {
+	MessageCount uint32
+}
+
+func (m *QueueDeleteOk) Id() (uint16, uint16) {
+	return 50, 41
+}
+
+func (m *QueueDeleteOk) Name() string {
+	return "queue.delete-ok"
+}
+
+func (m *QueueDeleteOk) HasContent() bool {
+	return false
+}
+
+func (m *QueueDeleteOk) read(r io.Reader) (err error) {
+	if m.MessageCount, err = readLong(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *QueueDeleteOk) write(w io.Writer) (err error) {
+	if err = writeLong(w, m.MessageCount); err != nil {
+		return
+	}
+
+	return
+}
+
+// basic.qos
+type BasicQos struct {
+	PrefetchSize  uint32
+	PrefetchCount uint16
+	Global        bool
+}
+
+func (m *BasicQos) Id() (uint16, uint16) {
+	return 60, 10
+}
+
+func (m *BasicQos) Name() string {
+	return "basic.qos"
+}
+
+func (m *BasicQos) HasContent() bool {
+	return false
+}
+
+func (m *BasicQos) read(r io.Reader) (err error) {
+	var bits byte
+	if m.PrefetchSize, err = readLong(r); err != nil {
+		return
+	}
+	if m.PrefetchCount, err = readShort(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.Global = bits&(1<<0) > 0
+
+	return
+}
+
+func (m *BasicQos) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeLong(w, m.PrefetchSize); err != nil {
+		return
+	}
+	if err = writeShort(w, m.PrefetchCount); err != nil {
+		return
+	}
+	bits = 0
+	if m.Global {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+
+	return
+}
+
+// basic.qos-ok
+type BasicQosOk struct {
+}
+
+func (m *BasicQosOk) Id() (uint16, uint16) {
+	return 60, 11
+}
+
+func (m *BasicQosOk) Name() string {
+	return "basic.qos-ok"
+}
+
+func (m *BasicQosOk) HasContent() bool {
+	return false
+}
+
+func (m *BasicQosOk) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *BasicQosOk) write(w io.Writer) (err error) {
+
+	return
+}
+
+// basic.consume
+type BasicConsume struct {
+	reserved1   uint16
+	Queue       string
+	ConsumerTag string
+	NoLocal     bool
+	NoAck       bool
+	Exclusive   bool
+	NoWait      bool
+	Arguments   transfer.Table
+}
+
+func (m *BasicConsume) Id() (uint16, uint16) {
+	return 60, 20
+}
+
+func (m *BasicConsume) Name() string {
+	return "basic.consume"
+}
+
+func (m *BasicConsume) HasContent() bool {
+	return false
+}
+
+func (m *BasicConsume) read(r io.Reader) (err error) {
+	var bits byte
+	if m.reserved1, err = readShort(r); err != nil {
+		return
+	}
+	if m.Queue, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.ConsumerTag, err = readShortstr(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.NoLocal = bits&(1<<0) > 0
+	m.NoAck = bits&(1<<1) > 0
+	m.Exclusive = bits&(1<<2) > 0
+	m.NoWait = bits&(1<<3) > 0
+	if m.Arguments, err = readTable(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *BasicConsume) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeShort(w, m.reserved1); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Queue); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.ConsumerTag); err != nil {
+		return
+	}
+	bits = 0
+	if m.NoLocal {
+		bits |= 1 << 0
+	}
+	if m.NoAck {
+		bits |= 1 << 1
+	}
+	if m.Exclusive {
+		bits |= 1 << 2
+	}
+	if m.NoWait {
+		bits |= 1 << 3
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+	if err = writeTable(w, m.Arguments); err != nil {
+		return
+	}
+
+	return
+}
+
+// basic.consume-ok
+type BasicConsumeOk struct {
+	ConsumerTag string
+}
+
+func (m *BasicConsumeOk) Id() (uint16, uint16) {
+	return 60, 21
+}
+
+func (m *BasicConsumeOk) Name() string {
+	return "basic.consume-ok"
+}
+
+func (m *BasicConsumeOk) HasContent() bool {
+	return false
+}
+
+func (m *BasicConsumeOk) read(r io.Reader) (err error) {
+	if m.ConsumerTag, err = readShortstr(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *BasicConsumeOk) write(w io.Writer) (err error) {
+	if err = writeShortstr(w, m.ConsumerTag); err != nil {
+		return
+	}
+
+	return
+}
+
+// basic.cancel
+type BasicCancel struct {
+	ConsumerTag string
+	NoWait      bool
+}
+
+func (m *BasicCancel) Id() (uint16, uint16) {
+	return 60, 30
+}
+
+func (m *BasicCancel) Name() string {
+	return "basic.cancel"
+}
+
+func (m *BasicCancel) HasContent() bool {
+	return false
+}
+
+func (m *BasicCancel) read(r io.Reader) (err error) {
+	var bits byte
+	if m.ConsumerTag, err = readShortstr(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.NoWait = bits&(1<<0) > 0
+
+	return
+}
+
+func (m *BasicCancel) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeShortstr(w, m.ConsumerTag); err != nil {
+		return
+	}
+	bits = 0
+	if m.NoWait {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+
+	return
+}
+
+// basic.cancel-ok
+type BasicCancelOk struct {
+	ConsumerTag string
+}
+
+func (m *BasicCancelOk) Id() (uint16, uint16) {
+	return 60, 31
+}
+
+func (m *BasicCancelOk) Name() string {
+	return "basic.cancel-ok"
+}
+
+func (m *BasicCancelOk) HasContent() bool {
+	return false
+}
+
+func (m *BasicCancelOk) read(r io.Reader) (err error) {
+	if m.ConsumerTag, err = readShortstr(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *BasicCancelOk) write(w io.Writer) (err error) {
+	if err = writeShortstr(w, m.ConsumerTag); err != nil {
+		return
+	}
+
+	return
+}
+
+// basic.publish
+type BasicPublish struct {
+	reserved1  uint16
+	Exchange   string
+	RoutingKey string
+	Mandatory  bool
+	Immediate  bool
+}
+
+func (m *BasicPublish) Id() (uint16, uint16) {
+	return 60, 40
+}
+
+func (m *BasicPublish) Name() string {
+	return "basic.publish"
+}
+
+func (m *BasicPublish) HasContent() bool {
+	return true
+}
+
+func (m *BasicPublish) read(r io.Reader) (err error) {
+	var bits byte
+	if m.reserved1, err = readShort(r); err != nil {
+		return
+	}
+	if m.Exchange, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.RoutingKey, err = readShortstr(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.Mandatory = bits&(1<<0) > 0
+	m.Immediate = bits&(1<<1) > 0
+
+	return
+}
+
+func (m *BasicPublish) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeShort(w, m.reserved1); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Exchange); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.RoutingKey); err != nil {
+		return
+	}
+	bits = 0
+	if m.Mandatory {
+		bits |= 1 << 0
+	}
+	if m.Immediate {
+		bits |= 1 << 1
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+
+	return
+}
+
+// basic.return
+type BasicReturn struct {
+	ReplyCode  uint16
+	ReplyText  string
+	Exchange   string
+	RoutingKey string
+}
+
+func (m *BasicReturn) Id() (uint16, uint16) {
+	return 60, 50
+}
+
+func (m *BasicReturn) Name() string {
+	return "basic.return"
+}
+
+func (m *BasicReturn) HasContent() bool {
+	return true
+}
+
+func (m *BasicReturn) read(r io.Reader) (err error) {
+	if m.ReplyCode, err = readShort(r); err != nil {
+		return
+	}
+	if m.ReplyText, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.Exchange, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.RoutingKey, err = readShortstr(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *BasicReturn) write(w io.Writer) (err error) {
+	if err = writeShort(w, m.ReplyCode); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.ReplyText); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Exchange); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.RoutingKey); err != nil {
+		return
+	}
+
+	return
+}
+
+// basic.deliver
+type BasicDeliver struct {
+	ConsumerTag string
+	DeliveryTag uint64
+	Redelivered bool
+	Exchange    string
+	RoutingKey  string
+}
+
+func (m *BasicDeliver) Id() (uint16, uint16) {
+	return 60, 60
+}
+
+func (m *BasicDeliver) Name() string {
+	return "basic.deliver"
+}
+
+func (m *BasicDeliver) HasContent() bool {
+	return true
+}
+
+func (m *BasicDeliver) read(r io.Reader) (err error) {
+	var bits byte
+	if m.ConsumerTag, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.DeliveryTag, err = readLonglong(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.Redelivered = bits&(1<<0) > 0
+	if m.Exchange, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.RoutingKey, err = readShortstr(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *BasicDeliver) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeShortstr(w, m.ConsumerTag); err != nil {
+		return
+	}
+	if err = writeLonglong(w, m.DeliveryTag); err != nil {
+		return
+	}
+	bits = 0
+	if m.Redelivered {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Exchange); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.RoutingKey); err != nil {
+		return
+	}
+
+	return
+}
+
+// basic.get
+type BasicGet struct {
+	reserved1 uint16
+	Queue     string
+	NoAck     bool
+}
+
+func (m *BasicGet) Id() (uint16, uint16) {
+	return 60, 70
+}
+
+func (m *BasicGet) Name() string {
+	return "basic.get"
+}
+
+func (m *BasicGet) HasContent() bool {
+	return false
+}
+
+func (m *BasicGet) read(r io.Reader) (err error) {
+	var bits byte
+	if m.reserved1, err = readShort(r); err != nil {
+		return
+	}
+	if m.Queue, err = readShortstr(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.NoAck = bits&(1<<0) > 0
+
+	return
+}
+
+func (m *BasicGet) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeShort(w, m.reserved1); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Queue); err != nil {
+		return
+	}
+	bits = 0
+	if m.NoAck {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+
+	return
+}
+
+// basic.get-ok
+type BasicGetOk struct {
+	DeliveryTag  uint64
+	Redelivered  bool
+	Exchange     string
+	RoutingKey   string
+	MessageCount uint32
+}
+
+func (m *BasicGetOk) Id() (uint16, uint16) {
+	return 60, 71
+}
+
+func (m *BasicGetOk) Name() string {
+	return "basic.get-ok"
+}
+
+func (m *BasicGetOk) HasContent() bool {
+	return true
+}
+
+func (m *BasicGetOk) read(r io.Reader) (err error) {
+	var bits byte
+	if m.DeliveryTag, err = readLonglong(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.Redelivered = bits&(1<<0) > 0
+	if m.Exchange, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.RoutingKey, err = readShortstr(r); err != nil {
+		return
+	}
+	if m.MessageCount, err = readLong(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *BasicGetOk) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeLonglong(w, m.DeliveryTag); err != nil {
+		return
+	}
+	bits = 0
+	if m.Redelivered {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.Exchange); err != nil {
+		return
+	}
+	if err = writeShortstr(w, m.RoutingKey); err != nil {
+		return
+	}
+	if err = writeLong(w, m.MessageCount); err != nil {
+		return
+	}
+
+	return
+}
+
+// basic.get-empty
+type BasicGetEmpty struct {
+	reserved1 string
+}
+
+func (m *BasicGetEmpty) Id() (uint16, uint16) {
+	return 60, 72
+}
+
+func (m *BasicGetEmpty) Name() string {
+	return "basic.get-empty"
+}
+
+func (m *BasicGetEmpty) HasContent() bool {
+	return false
+}
+
+func (m *BasicGetEmpty) read(r io.Reader) (err error) {
+	if m.reserved1, err = readShortstr(r); err != nil {
+		return
+	}
+
+	return
+}
+
+func (m *BasicGetEmpty) write(w io.Writer) (err error) {
+	if err = writeShortstr(w, m.reserved1); err != nil {
+		return
+	}
+
+	return
+}
+
+// basic.ack
+type BasicAck struct {
+	DeliveryTag uint64
+	Multiple    bool
+}
+
+func (m *BasicAck) Id() (uint16, uint16) {
+	return 60, 80
+}
+
+func (m *BasicAck) Name() string {
+	return "basic.ack"
+}
+
+func (m *BasicAck) HasContent() bool {
+	return false
+}
+
+func (m *BasicAck) read(r io.Reader) (err error) {
+	var bits byte
+	if m.DeliveryTag, err = readLonglong(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.Multiple = bits&(1<<0) > 0
+
+	return
+}
+
+func (m *BasicAck) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeLonglong(w, m.DeliveryTag); err != nil {
+		return
+	}
+	bits = 0
+	if m.Multiple {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+
+	return
+}
+
+// basic.reject
+type BasicReject struct {
+	DeliveryTag uint64
+	Requeue     bool
+}
+
+func (m *BasicReject) Id() (uint16, uint16) {
+	return 60, 90
+}
+
+func (m *BasicReject) Name() string {
+	return "basic.reject"
+}
+
+func (m *BasicReject) HasContent() bool {
+	return false
+}
+
+func (m *BasicReject) read(r io.Reader) (err error) {
+	var bits byte
+	if m.DeliveryTag, err = readLonglong(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.Requeue = bits&(1<<0) > 0
+
+	return
+}
+
+func (m *BasicReject) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeLonglong(w, m.DeliveryTag); err != nil {
+		return
+	}
+	bits = 0
+	if m.Requeue {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+
+	return
+}
+
+// basic.recover-async
+type BasicRecoverAsync struct {
+	Requeue bool
+}
+
+func (m *BasicRecoverAsync) Id() (uint16, uint16) {
+	return 60, 100
+}
+
+func (m *BasicRecoverAsync) Name() string {
+	return "basic.recover-async"
+}
+
+func (m *BasicRecoverAsync) HasContent() bool {
+	return false
+}
+
+func (m *BasicRecoverAsync) read(r io.Reader) (err error) {
+	var bits byte
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.Requeue = bits&(1<<0) > 0
+
+	return
+}
+
+func (m *BasicRecoverAsync) write(w io.Writer) (err error) {
+	var bits byte
+	bits = 0
+	if m.Requeue {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+
+	return
+}
+
+// basic.recover
+type BasicRecover struct {
+	Requeue bool
+}
+
+func (m *BasicRecover) Id() (uint16, uint16) {
+	return 60, 110
+}
+
+func (m *BasicRecover) Name() string {
+	return "basic.recover"
+}
+
+func (m *BasicRecover) HasContent() bool {
+	return false
+}
+
+func (m *BasicRecover) read(r io.Reader) (err error) {
+	var bits byte
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.Requeue = bits&(1<<0) > 0
+
+	return
+}
+
+func (m *BasicRecover) write(w io.Writer) (err error) {
+	var bits byte
+	bits = 0
+	if m.Requeue {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+
+	return
+}
+
+// basic.recover-ok
+type BasicRecoverOk struct {
+}
+
+func (m *BasicRecoverOk) Id() (uint16, uint16) {
+	return 60, 111
+}
+
+func (m *BasicRecoverOk) Name() string {
+	return "basic.recover-ok"
+}
+
+func (m *BasicRecoverOk) HasContent() bool {
+	return false
+}
+
+func (m *BasicRecoverOk) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *BasicRecoverOk) write(w io.Writer) (err error) {
+
+	return
+}
+
+// basic.nack
+type BasicNack struct {
+	DeliveryTag uint64
+	Multiple    bool
+	Requeue     bool
+}
+
+func (m *BasicNack) Id() (uint16, uint16) {
+	return 60, 120
+}
+
+func (m *BasicNack) Name() string {
+	return "basic.nack"
+}
+
+func (m *BasicNack) HasContent() bool {
+	return false
+}
+
+func (m *BasicNack) read(r io.Reader) (err error) {
+	var bits byte
+	if m.DeliveryTag, err = readLonglong(r); err != nil {
+		return
+	}
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.Multiple = bits&(1<<0) > 0
+	m.Requeue = bits&(1<<1) > 0
+
+	return
+}
+
+func (m *BasicNack) write(w io.Writer) (err error) {
+	var bits byte
+	if err = writeLonglong(w, m.DeliveryTag); err != nil {
+		return
+	}
+	bits = 0
+	if m.Multiple {
+		bits |= 1 << 0
+	}
+	if m.Requeue {
+		bits |= 1 << 1
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+
+	return
+}
+
+// tx.select
+type TxSelect struct {
+}
+
+func (m *TxSelect) Id() (uint16, uint16) {
+	return 90, 10
+}
+
+func (m *TxSelect) Name() string {
+	return "tx.select"
+}
+
+func (m *TxSelect) HasContent() bool {
+	return false
+}
+
+func (m *TxSelect) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *TxSelect) write(w io.Writer) (err error) {
+
+	return
+}
+
+// tx.select-ok
+type TxSelectOk struct {
+}
+
+func (m *TxSelectOk) Id() (uint16, uint16) {
+	return 90, 11
+}
+
+func (m *TxSelectOk) Name() string {
+	return "tx.select-ok"
+}
+
+func (m *TxSelectOk) HasContent() bool {
+	return false
+}
+
+func (m *TxSelectOk) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *TxSelectOk) write(w io.Writer) (err error) {
+
+	return
+}
+
+// tx.commit
+type TxCommit struct {
+}
+
+func (m *TxCommit) Id() (uint16, uint16) {
+	return 90, 20
+}
+
+func (m *TxCommit) Name() string {
+	return "tx.commit"
+}
+
+func (m *TxCommit) HasContent() bool {
+	return false
+}
+
+func (m *TxCommit) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *TxCommit) write(w io.Writer) (err error) {
+
+	return
+}
+
+// tx.commit-ok
+type TxCommitOk struct {
+}
+
+func (m *TxCommitOk) Id() (uint16, uint16) {
+	return 90, 21
+}
+
+func (m *TxCommitOk) Name() string {
+	return "tx.commit-ok"
+}
+
+func (m *TxCommitOk) HasContent() bool {
+	return false
+}
+
+func (m *TxCommitOk) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *TxCommitOk) write(w io.Writer) (err error) {
+
+	return
+}
+
+// tx.rollback
+type TxRollback struct {
+}
+
+func (m *TxRollback) Id() (uint16, uint16) {
+	return 90, 30
+}
+
+func (m *TxRollback) Name() string {
+	return "tx.rollback"
+}
+
+func (m *TxRollback) HasContent() bool {
+	return false
+}
+
+func (m *TxRollback) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *TxRollback) write(w io.Writer) (err error) {
+
+	return
+}
+
+// tx.rollback-ok
+type TxRollbackOk struct {
+}
+
+func (m *TxRollbackOk) Id() (uint16, uint16) {
+	return 90, 31
+}
+
+func (m *TxRollbackOk) Name() string {
+	return "tx.rollback-ok"
+}
+
+func (m *TxRollbackOk) HasContent() bool {
+	return false
+}
+
+func (m *TxRollbackOk) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *TxRollbackOk) write(w io.Writer) (err error) {
+
+	return
+}
+
+// confirm.select
+type ConfirmSelect struct {
+	Nowait bool
+}
+
+func (m *ConfirmSelect) Id() (uint16, uint16) {
+	return 85, 10
+}
+
+func (m *ConfirmSelect) Name() string {
+	return "confirm.select"
+}
+
+func (m *ConfirmSelect) HasContent() bool {
+	return false
+}
+
+func (m *ConfirmSelect) read(r io.Reader) (err error) {
+	var bits byte
+	if bits, err = readOctet(r); err != nil {
+		return
+	}
+	m.Nowait = bits&(1<<0) > 0
+
+	return
+}
+
+func (m *ConfirmSelect) write(w io.Writer) (err error) {
+	var bits byte
+	bits = 0
+	if m.Nowait {
+		bits |= 1 << 0
+	}
+	if err = writeOctet(w, bits); err != nil {
+		return
+	}
+
+	return
+}
+
+// confirm.select-ok
+type ConfirmSelectOk struct {
+}
+
+func (m *ConfirmSelectOk) Id() (uint16, uint16) {
+	return 85, 11
+}
+
+func (m *ConfirmSelectOk) Name() string {
+	return "confirm.select-ok"
+}
+
+func (m *ConfirmSelectOk) HasContent() bool {
+	return false
+}
+
+func (m *ConfirmSelectOk) read(r io.Reader) (err error) {
+
+	return
+}
+
+func (m *ConfirmSelectOk) write(w io.Writer) (err error) {
+
+	return
+}
+
+// basic content properties
+type BasicProperties struct {
+	ContentType     string
+	ContentEncoding string
+	Headers         transfer.Table
+	DeliveryMode    byte
+	Priority        byte
+	CorrelationId   string
+	ReplyTo         string
+	Expiration      string
+	MessageId       string
+	Timestamp       time.Time
+	Type            string
+	UserId          string
+	AppId           string
+	Reserved        string
+	// properties present on the wire, the ones with a non zero value are always written
+	flags uint16
+}
+
+func (p *BasicProperties) read(r io.Reader) (err error) {
+	if p.flags, err = readShort(r); err != nil {
+		return
+	}
+
+	// the flags continue in the next word, no property is defined there
+	for more := p.flags&1 != 0; more; {
+		var next uint16
+		if next, err = readShort(r); err != nil {
+			return
+		}
+		more = next&1 != 0
+	}
+
+	if p.flags&0x8000 != 0 {
+		if p.ContentType, err = readShortstr(r); err != nil {
+			return
+		}
+	}
+	if p.flags&0x4000 != 0 {
+		if p.ContentEncoding, err = readShortstr(r); err != nil {
+			return
+		}
+	}
+	if p.flags&0x2000 != 0 {
+		if p.Headers, err = readTable(r); err != nil {
+			return
+		}
+	}
+	if p.flags&0x1000 != 0 {
+		if p.DeliveryMode, err = readOctet(r); err != nil {
+			return
+		}
+	}
+	if p.flags&0x0800 != 0 {
+		if p.Priority, err = readOctet(r); err != nil {
+			return
+		}
+	}
+	if p.flags&0x0400 != 0 {
+		if p.CorrelationId, err = readShortstr(r); err != nil {
+			return
+		}
+	}
+	if p.flags&0x0200 != 0 {
+		if p.ReplyTo, err = readShortstr(r); err != nil {
+			return
+		}
+	}
+	if p.flags&0x0100 != 0 {
+		if p.Expiration, err = readShortstr(r); err != nil {
+			return
+		}
+	}
+	if p.flags&0x0080 != 0 {
+		if p.MessageId, err = readShortstr(r); err != nil {
+			return
+		}
+	}
+	if p.flags&0x0040 != 0 {
+		if p.Timestamp, err = readTimestamp(r); err != nil {
+			return
+		}
+	}
+	if p.flags&0x0020 != 0 {
+		if p.Type, err = readShortstr(r); err != nil {
+			return
+		}
+	}
+	if p.flags&0x0010 != 0 {
+		if p.UserId, err = readShortstr(r); err != nil {
+			return
+		}
+	}
+	if p.flags&0x0008 != 0 {
+		if p.AppId, err = readShortstr(r); err != nil {
+			return
+		}
+	}
+	if p.flags&0x0004 != 0 {
+		if p.Reserved, err = readShortstr(r); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (p *BasicProperties) write(w io.Writer) (err error) {
+	flags := p.flags &^ 1
+	if p.ContentType != "" {
+		flags |= 0x8000
+	}
+	if p.ContentEncoding != "" {
+		flags |= 0x4000
+	}
+	if p.Headers != nil {
+		flags |= 0x2000
+	}
+	if p.DeliveryMode != 0 {
+		flags |= 0x1000
+	}
+	if p.Priority != 0 {
+		flags |= 0x0800
+	}
+	if p.CorrelationId != "" {
+		flags |= 0x0400
+	}
+	if p.ReplyTo != "" {
+		flags |= 0x0200
+	}
+	if p.Expiration != "" {
+		flags |= 0x0100
+	}
+	if p.MessageId != "" {
+		flags |= 0x0080
+	}
+	if !p.Timestamp.IsZero() {
+		flags |= 0x0040
+	}
+	if p.Type != "" {
+		flags |= 0x0020
+	}
+	if p.UserId != "" {
+		flags |= 0x0010
+	}
+	if p.AppId != "" {
+		flags |= 0x0008
+	}
+	if p.Reserved != "" {
+		flags |= 0x0004
+	}
+
+	if err = writeShort(w, flags); err != nil {
+		return
+	}
+
+	if flags&0x8000 != 0 {
+		if err = writeShortstr(w, p.ContentType); err != nil {
+			return
+		}
+	}
+	if flags&0x4000 != 0 {
+		if err = writeShortstr(w, p.ContentEncoding); err != nil {
+			return
+		}
+	}
+	if flags&0x2000 != 0 {
+		if err = writeTable(w, p.Headers); err != nil {
+			return
+		}
+	}
+	if flags&0x1000 != 0 {
+		if err = writeOctet(w, p.DeliveryMode); err != nil {
+			return
+		}
+	}
+	if flags&0x0800 != 0 {
+		if err = writeOctet(w, p.Priority); err != nil {
+			return
+		}
+	}
+	if flags&0x0400 != 0 {
+		if err = writeShortstr(w, p.CorrelationId); err != nil {
+			return
+		}
+	}
+	if flags&0x0200 != 0 {
+		if err = writeShortstr(w, p.ReplyTo); err != nil {
+			return
+		}
+	}
+	if flags&0x0100 != 0 {
+		if err = writeShortstr(w, p.Expiration); err != nil {
+			return
+		}
+	}
+	if flags&0x0080 != 0 {
+		if err = writeShortstr(w, p.MessageId); err != nil {
+			return
+		}
+	}
+	if flags&0x0040 != 0 {
+		if err = writeTimestamp(w, p.Timestamp); err != nil {
+			return
+		}
+	}
+	if flags&0x0020 != 0 {
+		if err = writeShortstr(w, p.Type); err != nil {
+			return
+		}
+	}
+	if flags&0x0010 != 0 {
+		if err = writeShortstr(w, p.UserId); err != nil {
+			return
+		}
+	}
+	if flags&0x0008 != 0 {
+		if err = writeShortstr(w, p.AppId); err != nil {
+			return
+		}
+	}
+	if flags&0x0004 != 0 {
+		if err = writeShortstr(w, p.Reserved); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Empty method for the class and method id
+func newMethod(classId uint16, methodId uint16) (Method, error) {
+	switch classId {
+	case 10: // connection
+		switch methodId {
+		case 10: // connection start
+			return &ConnectionStart{}, nil
+		case 11: // connection start-ok
+			return &ConnectionStartOk{}, nil
+		case 20: // connection secure
+			return &ConnectionSecure{}, nil
+		case 21: // connection secure-ok
+			return &ConnectionSecureOk{}, nil
+		case 30: // connection tune
+			return &ConnectionTune{}, nil
+		case 31: // connection tune-ok
+			return &ConnectionTuneOk{}, nil
+		case 40: // connection open
+			return &ConnectionOpen{}, nil
+		case 41: // connection open-ok
+			return &ConnectionOpenOk{}, nil
+		case 50: // connection close
+			return &ConnectionClose{}, nil
+		case 51: // connection close-ok
+			return &ConnectionCloseOk{}, nil
+		case 60: // connection blocked
+			return &ConnectionBlocked{}, nil
+		case 61: // connection unblocked
+			return &ConnectionUnblocked{}, nil
+		}
+		return nil, fmt.Errorf("bad method frame, unknown method %d for class %d", methodId, classId)
+	case 20: // channel
+		switch methodId {
+		case 10: // channel open
+			return &ChannelOpen{}, nil
+		case 11: // channel open-ok
+			return &ChannelOpenOk{}, nil
+		case 20: // channel flow
+			return &ChannelFlow{}, nil
+		case 21: // channel flow-ok
+			return &ChannelFlowOk{}, nil
+		case 40: // channel close
+			return &ChannelClose{}, nil
+		case 41: // channel close-ok
+			return &ChannelCloseOk{}, nil
+		}
+		return nil, fmt.Errorf("bad method frame, unknown method %d for class %d", methodId, classId)
+	case 40: // exchange
+		switch methodId {
+		case 10: // exchange declare
+			return &ExchangeDeclare{}, nil
+		case 11: // exchange declare-ok
+			return &ExchangeDeclareOk{}, nil
+		case 20: // exchange delete
+			return &ExchangeDelete{}, nil
+		case 21: // exchange delete-ok
+			return &ExchangeDeleteOk{}, nil
+		case 30: // exchange bind
+			return &ExchangeBind{}, nil
+		case 31: // exchange bind-ok
+			return &ExchangeBindOk{}, nil
+		case 40: // exchange unbind
+			return &ExchangeUnbind{}, nil
+		case 51: // exchange unbind-ok
+			return &ExchangeUnbindOk{}, nil
+		}
+		return nil, fmt.Errorf("bad method frame, unknown method %d for class %d", methodId, classId)
+	case 50: // queue
+		switch methodId {
+		case 10: // queue declare
+			return &QueueDeclare{}, nil
+		case 11: // queue declare-ok
+			return &QueueDeclareOk{}, nil
+		case 20: // queue bind
+			return &QueueBind{}, nil
+		case 21: // queue bind-ok
+			return &QueueBindOk{}, nil
+		case 50: // queue unbind
+			return &QueueUnbind{}, nil
+		case 51: // queue unbind-ok
+			return &QueueUnbindOk{}, nil
+		case 30: // queue purge
+			return &QueuePurge{}, nil
+		case 31: // queue purge-ok
+			return &QueuePurgeOk{}, nil
+		case 40: // queue delete
+			return &QueueDelete{}, nil
+		case 41: // queue delete-ok
+			return &QueueDeleteOk{}, nil
+		}
+		return nil, fmt.Errorf("bad method frame, unknown method %d for class %d", methodId, classId)
+	case 60: // basic
+		switch methodId {
+		case 10: // basic qos
+			return &BasicQos{}, nil
+		case 11: // basic qos-ok
+			return &BasicQosOk{}, nil
+		case 20: // basic consume
+			return &BasicConsume{}, nil
+		case 21: // basic consume-ok
+			return &BasicConsumeOk{}, nil
+		case 30: // basic cancel
+			return &BasicCancel{}, nil
+		case 31: // basic cancel-ok
+			return &BasicCancelOk{}, nil
+		case 40: // basic publish
+			return &BasicPublish{}, nil
+		case 50: // basic return
+			return &BasicReturn{}, nil
+		case 60: // basic deliver
+			return &BasicDeliver{}, nil
+		case 70: // basic get
+			return &BasicGet{}, nil
+		case 71: // basic get-ok
+			return &BasicGetOk{}, nil
+		case 72: // basic get-empty
+			return &BasicGetEmpty{}, nil
+		case 80: // basic ack
+			return &BasicAck{}, nil
+		case 90: // basic reject
+			return &BasicReject{}, nil
+		case 100: // basic recover-async
+			return &BasicRecoverAsync{}, nil
+		case 110: // basic recover
+			return &BasicRecover{}, nil
+		case 111: // basic recover-ok
+			return &BasicRecoverOk{}, nil
+		case 120: // basic nack
+			return &BasicNack{}, nil
+		}
+		return nil, fmt.Errorf("bad method frame, unknown method %d for class %d", methodId, classId)
+	case 90: // tx
+		switch methodId {
+		case 10: // tx select
+			return &TxSelect{}, nil
+		case 11: // tx select-ok
+			return &TxSelectOk{}, nil
+		case 20: // tx commit
+			return &TxCommit{}, nil
+		case 21: // tx commit-ok
+			return &TxCommitOk{}, nil
+		case 30: // tx rollback
+			return &TxRollback{}, nil
+		case 31: // tx rollback-ok
+			return &TxRollbackOk{}, nil
+		}
+		return nil, fmt.Errorf("bad method frame, unknown method %d for class %d", methodId, classId)
+	case 85: // confirm
+		switch methodId {
+		case 10: // confirm select
+			return &ConfirmSelect{}, nil
+		case 11: // confirm select-ok
+			return &ConfirmSelectOk{}, nil
+		}
+		return nil, fmt.Errorf("bad method frame, unknown method %d for class %d", methodId, classId)
+	}
+
+	return nil, fmt.Errorf("bad method frame, unknown class %d", classId)
+}
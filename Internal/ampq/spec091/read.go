@@ -1,185 +1,95 @@
 package spec091
 
 import (
+	"bytes"
 	"encoding/binary"
-	"fmt"
-	transfer "github.com/sv-z/amqproxy/Internal/ampq/data-transfer"
 	"io"
 )
 
-func readFrame(reader io.Reader) (fm interface{}, err error) {
+// Read a whole frame from the stream without decoding the payload.
+// Frames bigger than frameMax are refused before their payload is read, zero means no limit.
+func readRawFrame(reader io.Reader, frameMax uint32) (frame *Frame, err error) {
 	var scratch [7]byte
 
 	if _, err = io.ReadFull(reader, scratch[:7]); err != nil {
 		return
 	}
 
-	typ := uint8(scratch[0])
-	channel := binary.BigEndian.Uint16(scratch[1:3])
+	frame = &Frame{
+		Type:    uint8(scratch[0]),
+		Channel: binary.BigEndian.Uint16(scratch[1:3]),
+	}
 	size := binary.BigEndian.Uint32(scratch[3:7])
 
-	fmt.Println(typ, "  ", channel, "   ", size)
-
-	switch typ {
-	case frameMethod:
-		if fm, err = parseMethodFrame(reader); err != nil {
-			return
-		}
-
-	case frameHeader:
-		//if frame, err = r.parseHeaderFrame(channel, size); err != nil {
-		//	return
-		//}
-
-	case frameBody:
-		//if frame, err = r.parseBodyFrame(channel, size); err != nil {
-		//	return nil, err
-		//}
-
-	case frameHeartbeat:
-		//if frame, err = r.parseHeartbeatFrame(channel, size); err != nil {
-		//	return
-		//}
+	if frameMax != 0 && uint64(size)+8 > uint64(frameMax) {
+		return nil, NewError(FrameError, "frame of %d bytes exceeds frame-max %d", uint64(size)+8, frameMax)
+	}
 
-	default:
-		return fm, fmt.Errorf("frame could not be parsed")
+	frame.Payload = make([]byte, size)
+	if _, err = io.ReadFull(reader, frame.Payload); err != nil {
+		return nil, err
 	}
 
 	if _, err = io.ReadFull(reader, scratch[:1]); err != nil {
-		return fm, err
+		return nil, err
 	}
 
 	if scratch[0] != frameEnd {
-		return fm, fmt.Errorf("frame could not be parsed")
+		return nil, NewError(FrameError, "frame end marker is missing")
+	}
+
+	switch frame.Type {
+	case FrameMethod, FrameHeader, FrameBody:
+
+	case FrameHeartbeat:
+		if frame.Channel != 0 || size != 0 {
+			return nil, NewError(FrameError, "heartbeat frame must be empty and sent on channel 0")
+		}
+
+	default:
+		return nil, NewError(FrameError, "frame type %d is unknown", frame.Type)
 	}
 
 	return
 }
 
-func parseMethodFrame(reader io.Reader) (mf *methodFrame, err error) {
+// Decode the method carried by a method frame
+func (frame *Frame) Method() (Method, error) {
+	if frame.Type != FrameMethod {
+		return nil, NewError(UnexpectedFrame, "frame type %d on channel %d is not a method frame", frame.Type, frame.Channel)
+	}
 
-	mf = &methodFrame{}
+	method, err := parseMethodFrame(bytes.NewReader(frame.Payload))
+	if e, ok := err.(*Error); ok {
+		e.Channel = frame.Channel
+	}
 
-	dataReader := transfer.NewDataReader(reader)
+	return method, err
+}
 
+func parseMethodFrame(reader io.Reader) (method Method, err error) {
 	var classId uint16
 	var methodId uint16
 
 	if err = binary.Read(reader, binary.BigEndian, &classId); err != nil {
-		return
+		return nil, NewError(SyntaxError, "method frame is too short")
 	}
 
 	if err = binary.Read(reader, binary.BigEndian, &methodId); err != nil {
-		return
+		return nil, NewError(SyntaxError, "method frame is too short")
 	}
 
-	switch classId {
-	case 10: // connection
-		switch methodId {
-		//case 10: // connection start
-		case 11: // connection start-ok
-			method := connectionStartOk{}
-			mf.Method = &method
-			if method.ClientProperties, err = dataReader.ReadTable(); err != nil {
-				return
-			}
-			if method.Mechanism, err = dataReader.ReadShortstr(); err != nil {
-				return
-			}
-
-			if method.Response, err = dataReader.ReadLongstr(); err != nil {
-				return
-			}
-
-			if method.Locale, err = dataReader.ReadShortstr(); err != nil {
-				return
-			}
-
-		//case 20: // connection secure
-		//case 21: // connection secure-ok
-		//case 30: // connection tune
-		case 31: // connection tune-ok
-			method := connectionTuneOk{}
-			mf.Method = &method
-			if err = binary.Read(reader, binary.BigEndian, &method.ChannelMax); err != nil {
-				return
-			}
-
-			if err = binary.Read(reader, binary.BigEndian, &method.FrameMax); err != nil {
-				return
-			}
-
-			if err = binary.Read(reader, binary.BigEndian, &method.Heartbeat); err != nil {
-				return
-			}
-
-		case 40: // connection open
-			method := connectionOpen{}
-			mf.Method = &method
-			if method.VirtualHost, err = dataReader.ReadShortstr(); err != nil {
-				return
-			}
-
-			if method.reserved1, err = dataReader.ReadShortstr(); err != nil {
-				return
-			}
-
-			var bits byte
-			if err = binary.Read(reader, binary.BigEndian, &bits); err != nil {
-				return
-			}
-			method.reserved2 = bits&(1<<0) > 0
-
-		//case 41: // connection open-ok
-		//case 50: // connection close
-		//case 51: // connection close-ok
-		//case 60: // connection blocked
-		//case 61: // connection unblocked
-		default:
-			return mf, fmt.Errorf("bad method frame, unknown method %d for class %d", methodId, classId)
-		}
-	case 20: // channel
-		switch methodId {
-		//case 10: // channel open
-		default:
-			return mf, fmt.Errorf("bad method frame, unknown method %d for class %d", methodId, classId)
-		}
-	case 40: // exchange
-		switch methodId {
-		//case 10: // exchange declare
-		default:
-			return mf, fmt.Errorf("bad method frame, unknown method %d for class %d", methodId, classId)
-		}
-	case 50: // queue
-		switch methodId {
-		//case 10: // queue declare
-		default:
-			return mf, fmt.Errorf("bad method frame, unknown method %d for class %d", methodId, classId)
-		}
-	case 60: // basic
-		switch methodId {
-		//case 10: // basic qos
-		default:
-			return mf, fmt.Errorf("bad method frame, unknown method %d for class %d", methodId, classId)
-		}
-	case 85: // confirm
-		switch methodId {
-		//case 10: // confirm select
-		default:
-			return mf, fmt.Errorf("bad method frame, unknown method %d for class %d", methodId, classId)
-		}
-	case 90: // tx
-		switch methodId {
-		//case 10: // tx select
-		default:
-			return mf, fmt.Errorf("bad method frame, unknown method %d for class %d", methodId, classId)
-		}
-	default:
-		return mf, fmt.Errorf("bad method frame, unknown class %d", classId)
+	if method, err = newMethod(classId, methodId); err != nil {
+		e := NewError(NotImplemented, "%s", err)
+		e.ClassId, e.MethodId = classId, methodId
+		return nil, e
 	}
 
-	mf.ClassId = classId
-	mf.MethodId = methodId
+	if err = method.read(reader); err != nil {
+		e := NewError(SyntaxError, "arguments of %s could not be parsed", method.Name())
+		e.ClassId, e.MethodId = classId, methodId
+		return nil, e
+	}
 
 	return
 }
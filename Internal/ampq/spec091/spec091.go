@@ -1,18 +1,26 @@
 package spec091
 
 import (
-	"fmt"
 	transfer "github.com/sv-z/amqproxy/Internal/ampq/data-transfer"
 	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func NewSpec091(readWriter *io.ReadWriter) *Spec {
+	now := time.Now().UnixNano()
+
 	return &Spec{
 		readWriter:   *readWriter,
 		versionMajor: byte(0),
 		versionMinor: byte(9),
 		locales:      "en_US",
 		mechanisms:   "PLAIN",
+		frameMax:     FrameMinSize,
+		lastRead:     now,
+		lastWrite:    now,
 	}
 }
 
@@ -22,97 +30,322 @@ type Spec struct {
 	versionMinor byte
 	locales      string
 	mechanisms   string
+	frameMax     uint32 // biggest frame accepted from the peer, the spec minimum until the tuning is done
+	writeMu      sync.Mutex
+	lastRead     int64 // unix nano, updated atomically
+	lastWrite    int64 // unix nano, updated atomically
+	observer     Observer
+}
+
+// Observer sees every frame read from the peer and written to it, it must not block
+type Observer func(out bool, frame *Frame)
+
+// Watch the frames, set before the first frame is read or written
+func (spec *Spec) SetObserver(observer Observer) {
+	spec.observer = observer
+}
+
+// Offer the SASL mechanisms in connection.start, the preferred one first
+func (spec *Spec) SetMechanisms(mechanisms []string) {
+	spec.mechanisms = strings.Join(mechanisms, " ")
 }
 
 func (spec *Spec) PushConnectionStart(args *transfer.Table) bool {
-	payload := prepareMethod(
-		uint16(10), //class,
-		uint16(10), //method,
-		spec.versionMajor,
-		spec.versionMinor,
-		transfer.MapToByte(*args),
-		transfer.LongStrToByte(spec.mechanisms),
-		transfer.LongStrToByte(spec.locales),
-	)
-	if payload == nil {
-		return false
+	return spec.pushMethod(0, &ConnectionStart{
+		VersionMajor:     spec.versionMajor,
+		VersionMinor:     spec.versionMinor,
+		ServerProperties: *args,
+		Mechanisms:       spec.mechanisms,
+		Locales:          spec.locales,
+	})
+}
+
+func (spec *Spec) PullConnectionStartOk() (*ConnectionStartOk, error) {
+	method, err := spec.pullMethod()
+	if err != nil {
+		return nil, err
 	}
 
-	return writeFrame(spec.readWriter, frameMethod, 0, payload) == nil
+	if resp, ok := method.(*ConnectionStartOk); ok {
+		return resp, nil
+	}
+
+	return nil, unexpectedMethod(method, "connection.start-ok")
 }
 
-func (spec *Spec) PullConnectionStartOk() (*connectionStartOk, error) {
+// connection.secure
+func (spec *Spec) PushConnectionSecure(challenge string) bool {
+	return spec.pushMethod(0, &ConnectionSecure{Challenge: challenge})
+}
 
-	mfi, err := readFrame(spec.readWriter)
+func (spec *Spec) PullConnectionSecureOk() (*ConnectionSecureOk, error) {
+	method, err := spec.pullMethod()
 	if err != nil {
 		return nil, err
 	}
 
-	if mf, ok := mfi.(*methodFrame); ok {
-		if resp, ok := mf.Method.(*connectionStartOk); ok {
-			return resp, nil
-		}
+	if resp, ok := method.(*ConnectionSecureOk); ok {
+		return resp, nil
 	}
 
-	return nil, fmt.Errorf("invalid C:START-OK receive")
+	return nil, unexpectedMethod(method, "connection.secure-ok")
 }
 
 // connection.tune
-func (spec *Spec) PushConnectionTune() bool {
-	payload := prepareMethod(
-		uint16(10),     //class,
-		uint16(30),     //method
-		uint16(2047),   //ChannelMax
-		uint32(131072), //FrameMax
-		uint16(60),     //Heartbeat
-	)
-	if payload == nil {
-		return false
+func (spec *Spec) PushConnectionTune(channelMax uint16, frameMax uint32, heartbeat uint16) bool {
+	return spec.pushMethod(0, &ConnectionTune{
+		ChannelMax: channelMax,
+		FrameMax:   frameMax,
+		Heartbeat:  heartbeat,
+	})
+}
+
+func (spec *Spec) PullConnectionTuneOK() (*ConnectionTuneOk, error) {
+	method, err := spec.pullMethod()
+	if err != nil {
+		return nil, err
 	}
 
-	return writeFrame(spec.readWriter, frameMethod, 0, payload) == nil
+	if resp, ok := method.(*ConnectionTuneOk); ok {
+		return resp, nil
+	}
+
+	return nil, unexpectedMethod(method, "connection.tune-ok")
 }
 
-func (spec *Spec) PullConnectionTuneOK() (*connectionTuneOk, error) {
+func (spec *Spec) PullConnectionOpen() (*ConnectionOpen, error) {
+	method, err := spec.pullMethod()
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := method.(*ConnectionOpen); ok {
+		return resp, nil
+	}
 
-	mfi, err := readFrame(spec.readWriter)
+	return nil, unexpectedMethod(method, "connection.open")
+}
+
+func (spec *Spec) PushConnectionOpenOK() bool {
+	return spec.pushMethod(0, &ConnectionOpenOk{})
+}
+
+// ---------------------------------------- CLIENT SIDE ----------------------------------------------------------------
+
+// The client starts a new connection by sending a protocol header
+func (spec *Spec) PushProtocolHeader() bool {
+	spec.writeMu.Lock()
+	defer spec.writeMu.Unlock()
+
+	_, err := spec.readWriter.Write([]byte{'A', 'M', 'Q', 'P', 0, 0, 9, 1})
+
+	return err == nil
+}
+
+func (spec *Spec) PullConnectionStart() (*ConnectionStart, error) {
+	method, err := spec.pullMethod()
 	if err != nil {
 		return nil, err
 	}
 
-	if mf, ok := mfi.(*methodFrame); ok {
-		if resp, ok := mf.Method.(*connectionTuneOk); ok {
-			return resp, nil
-		}
+	if resp, ok := method.(*ConnectionStart); ok {
+		return resp, nil
 	}
 
-	return nil, fmt.Errorf("invalid C:TUNE-OK receive")
+	return nil, unexpectedMethod(method, "connection.start")
+}
+
+// connection.start-ok
+func (spec *Spec) PushConnectionStartOk(clientProperties *transfer.Table, mechanism string, response string) bool {
+	return spec.pushMethod(0, &ConnectionStartOk{
+		ClientProperties: *clientProperties,
+		Mechanism:        mechanism,
+		Response:         response,
+		Locale:           spec.locales,
+	})
 }
 
-func (spec *Spec) PullConnectionOpen() (*connectionOpen, error) {
-	mfi, err := readFrame(spec.readWriter)
+func (spec *Spec) PullConnectionTune() (*ConnectionTune, error) {
+	method, err := spec.pullMethod()
 	if err != nil {
 		return nil, err
 	}
 
-	if mf, ok := mfi.(*methodFrame); ok {
-		if resp, ok := mf.Method.(*connectionOpen); ok {
-			return resp, nil
-		}
+	if resp, ok := method.(*ConnectionTune); ok {
+		return resp, nil
 	}
 
-	return nil, fmt.Errorf("invalid C:OPEN receive")
+	return nil, unexpectedMethod(method, "connection.tune")
 }
 
-func (spec *Spec) PushConnectionOpenOK() bool {
-	payload := prepareMethod(
-		uint16(10),                  //class,
-		uint16(41),                  //method
-		transfer.ShortStrToByte(""), // reserved1
-	)
-	if payload == nil {
-		return false
+// connection.tune-ok
+func (spec *Spec) PushConnectionTuneOk(channelMax uint16, frameMax uint32, heartbeat uint16) bool {
+	return spec.pushMethod(0, &ConnectionTuneOk{
+		ChannelMax: channelMax,
+		FrameMax:   frameMax,
+		Heartbeat:  heartbeat,
+	})
+}
+
+// connection.open
+func (spec *Spec) PushConnectionOpen(virtualHost string) bool {
+	return spec.pushMethod(0, &ConnectionOpen{
+		VirtualHost: virtualHost,
+	})
+}
+
+func (spec *Spec) PullConnectionOpenOk() (*ConnectionOpenOk, error) {
+	method, err := spec.pullMethod()
+	if err != nil {
+		return nil, err
+	}
+
+	if resp, ok := method.(*ConnectionOpenOk); ok {
+		return resp, nil
+	}
+
+	return nil, unexpectedMethod(method, "connection.open-ok")
+}
+
+// ------------------------------------------- RELAY -------------------------------------------------------------------
+
+// Read the next frame as is
+func (spec *Spec) ReadFrame() (*Frame, error) {
+	frame, err := readRawFrame(spec.readWriter, spec.frameMax)
+	if err != nil {
+		return nil, err
 	}
 
-	return writeFrame(spec.readWriter, frameMethod, 0, payload) == nil
+	atomic.StoreInt64(&spec.lastRead, time.Now().UnixNano())
+
+	if spec.observer != nil {
+		spec.observer(false, frame)
+	}
+
+	return frame, nil
+}
+
+// Accept frames up to the negotiated frame-max, zero means no limit.
+// It is set before the frames are read concurrently.
+func (spec *Spec) SetFrameMax(frameMax uint32) {
+	spec.frameMax = frameMax
+}
+
+// Write the frame as is, it is safe to write from several goroutines
+func (spec *Spec) WriteFrame(frame *Frame) error {
+	spec.writeMu.Lock()
+	defer spec.writeMu.Unlock()
+
+	if err := writeFrame(spec.readWriter, frame.Type, frame.Channel, frame.Payload); err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&spec.lastWrite, time.Now().UnixNano())
+
+	if spec.observer != nil {
+		spec.observer(true, frame)
+	}
+
+	return nil
+}
+
+// When the last frame was received from the peer
+func (spec *Spec) LastRead() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&spec.lastRead))
+}
+
+// When the last frame was sent to the peer
+func (spec *Spec) LastWrite() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&spec.lastWrite))
+}
+
+// Encode the method and write it on the channel
+func (spec *Spec) WriteMethod(channel uint16, method Method) error {
+	frame, err := NewMethodFrame(channel, method)
+	if err != nil {
+		return err
+	}
+
+	return spec.WriteFrame(frame)
+}
+
+// ----------------------------------------- CLOSE / RESET -------------------------------------------------------------
+
+// connection.close-ok
+func (spec *Spec) PushConnectionCloseOk() bool {
+	return spec.pushMethod(0, &ConnectionCloseOk{})
+}
+
+// channel.open-ok
+func (spec *Spec) PushChannelOpenOk(channel uint16) bool {
+	return spec.pushMethod(channel, &ChannelOpenOk{})
+}
+
+// channel.close
+func (spec *Spec) PushChannelClose(channel uint16, replyCode uint16, replyText string) bool {
+	return spec.pushMethod(channel, &ChannelClose{
+		ReplyCode: replyCode,
+		ReplyText: replyText,
+	})
+}
+
+// channel.close-ok
+func (spec *Spec) PushChannelCloseOk(channel uint16) bool {
+	return spec.pushMethod(channel, &ChannelCloseOk{})
+}
+
+// basic.qos
+func (spec *Spec) PushBasicQos(channel uint16, prefetchSize uint32, prefetchCount uint16, global bool) bool {
+	return spec.pushMethod(channel, &BasicQos{
+		PrefetchSize:  prefetchSize,
+		PrefetchCount: prefetchCount,
+		Global:        global,
+	})
+}
+
+// Heartbeat frames are always sent on channel 0 with an empty payload
+func (spec *Spec) PushHeartbeat() bool {
+	return spec.WriteFrame(&Frame{Type: FrameHeartbeat, Channel: 0, Payload: []byte{}}) == nil
+}
+
+// --------------------------------------------------------------------------------------------------------------------
+
+func (spec *Spec) pushMethod(channel uint16, method Method) bool {
+	return spec.WriteMethod(channel, method) == nil
+}
+
+// Read the next frame, it must be a method frame.
+// A connection.close from the peer is confirmed and returned as the error it carries.
+func (spec *Spec) pullMethod() (Method, error) {
+	frame, err := spec.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	method, err := frame.Method()
+	if err != nil {
+		return nil, err
+	}
+
+	if closeMethod, ok := method.(*ConnectionClose); ok {
+		spec.pushMethod(0, &ConnectionCloseOk{})
+
+		return nil, &Error{
+			Code:     closeMethod.ReplyCode,
+			Text:     closeMethod.ReplyText,
+			ClassId:  closeMethod.ClassId,
+			MethodId: closeMethod.MethodId,
+			Received: true,
+		}
+	}
+
+	return method, nil
+}
+
+// The handshake got another method than the expected one
+func unexpectedMethod(method Method, expected string) *Error {
+	e := NewError(CommandInvalid, "expected %s, got %s", expected, method.Name())
+	e.ClassId, e.MethodId = method.Id()
+
+	return e
 }
@@ -1,29 +1,27 @@
 package spec091
 
-import transfer "github.com/sv-z/amqproxy/Internal/ampq/data-transfer"
-
-type methodFrame struct {
-	ClassId  uint16
-	MethodId uint16
-	Method   interface{}
+// Frame is an AMQP frame as it travels over the wire, the payload is not decoded
+type Frame struct {
+	Type    uint8
+	Channel uint16
+	Payload []byte
 }
 
-// ------------------------------------------ CLASS 10 -----------------------------------------------------------------
-type connectionStartOk struct {
-	ClientProperties transfer.Table
-	Mechanism        string
-	Response         string
-	Locale           string
-}
+// Class and method ids of a method frame without decoding the arguments
+func (frame *Frame) MethodId() (classId uint16, methodId uint16, ok bool) {
+	if frame.Type != FrameMethod || len(frame.Payload) < 4 {
+		return 0, 0, false
+	}
 
-type connectionTuneOk struct {
-	ChannelMax uint16
-	FrameMax   uint32
-	Heartbeat  uint16
+	return uint16(frame.Payload[0])<<8 | uint16(frame.Payload[1]), uint16(frame.Payload[2])<<8 | uint16(frame.Payload[3]), true
 }
 
-type connectionOpen struct {
-	VirtualHost string
-	reserved1   string
-	reserved2   bool
+// Name of a method like "basic.publish", empty for an unknown one
+func MethodName(classId uint16, methodId uint16) string {
+	method, err := newMethod(classId, methodId)
+	if err != nil {
+		return ""
+	}
+
+	return method.Name()
 }
@@ -2,48 +2,46 @@ package spec091
 
 import (
 	"bytes"
-	"encoding/binary"
 	"io"
 )
 
-// Prepare method header
-func prepareMethod(args ...interface{}) []byte {
+// Encode the method into a method frame
+func NewMethodFrame(channel uint16, method Method) (*Frame, error) {
 	var payload bytes.Buffer
 
-	for _, val := range args {
-		if err := binary.Write(&payload, binary.BigEndian, val); err != nil {
-			return nil
-		}
+	classId, methodId := method.Id()
+	if err := writeShort(&payload, classId); err != nil {
+		return nil, err
+	}
+	if err := writeShort(&payload, methodId); err != nil {
+		return nil, err
+	}
+
+	if err := method.write(&payload); err != nil {
+		return nil, err
 	}
 
-	return payload.Bytes()
+	return &Frame{Type: FrameMethod, Channel: channel, Payload: payload.Bytes()}, nil
 }
 
 func writeFrame(w io.Writer, typ uint8, channel uint16, payload []byte) (err error) {
-	end := []byte{frameEnd}
 	size := uint(len(payload))
 
-	_, err = w.Write([]byte{
+	// the whole frame goes out in a single write so it is never interleaved with another one
+	buf := make([]byte, 0, 7+size+1)
+	buf = append(buf,
 		byte(typ),
-		byte((channel & 0xff00) >> 8),
-		byte((channel & 0x00ff) >> 0),
-		byte((size & 0xff000000) >> 24),
-		byte((size & 0x00ff0000) >> 16),
-		byte((size & 0x0000ff00) >> 8),
-		byte((size & 0x000000ff) >> 0),
-	})
-
-	if err != nil {
-		return
-	}
-
-	if _, err = w.Write(payload); err != nil {
-		return
-	}
-
-	if _, err = w.Write(end); err != nil {
-		return
-	}
+		byte((channel&0xff00)>>8),
+		byte((channel&0x00ff)>>0),
+		byte((size&0xff000000)>>24),
+		byte((size&0x00ff0000)>>16),
+		byte((size&0x0000ff00)>>8),
+		byte((size&0x000000ff)>>0),
+	)
+	buf = append(buf, payload...)
+	buf = append(buf, frameEnd)
+
+	_, err = w.Write(buf)
 
 	return
 }
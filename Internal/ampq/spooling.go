@@ -0,0 +1,639 @@
+package ampq
+
+import (
+	"fmt"
+	logger "github.com/sirupsen/logrus"
+	transfer "github.com/sv-z/amqproxy/Internal/ampq/data-transfer"
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+	"io"
+	"time"
+)
+
+// How many messages a spool session stores with one write to the disk
+const spoolBatch = 256
+
+// How long the broker has to confirm the spooled messages
+const forwardTimeout = 30 * time.Second
+
+// Spool serves a client while no upstream is reachable.
+// The published messages are handed to store and confirmed once it returns, store keeps the first
+// messages it has room for and tells how many. The messages it has no room for are nacked on the
+// confirm channels and dropped on the others, like a queue with the reject-publish overflow.
+// The declarations of exchanges, named queues and bindings are stored along with the messages,
+// so they are replayed first. Anything else needs the broker and closes the channel.
+func Spool(client *Connection, store func(messages []*spec091.Message) (int, error)) error {
+	s := &spoolSession{
+		client:    client,
+		store:     store,
+		assembler: spec091.NewAssembler(),
+		channels:  make(map[uint16]*spoolChannel),
+		closing:   make(map[uint16]bool),
+	}
+
+	return s.run()
+}
+
+type spoolSession struct {
+	client    *Connection
+	store     func(messages []*spec091.Message) (int, error)
+	assembler *spec091.Assembler
+	channels  map[uint16]*spoolChannel
+	// channels the proxy closed, waiting for close-ok
+	closing map[uint16]bool
+	// messages and declarations not stored yet, they are answered once they are
+	batch []spooled
+}
+
+type spoolChannel struct {
+	confirm   bool
+	published uint64 // publish sequence number of the confirm mode
+}
+
+type spooled struct {
+	message *spec091.Message
+	seq     uint64         // of a message published in confirm mode, zero otherwise
+	reply   spec091.Method // of a declaration, nil with nowait
+}
+
+func (s *spoolSession) run() error {
+	for {
+		var (
+			frame *spec091.Frame
+			ok    bool
+		)
+
+		// the batch is stored once the client has nothing more to send right away
+		if len(s.batch) > 0 {
+			select {
+			case frame, ok = <-s.client.frames:
+			default:
+				if err := s.handle(s.flush()); err != nil {
+					return err
+				}
+				continue
+			}
+		} else {
+			select {
+			case frame, ok = <-s.client.frames:
+			case <-s.client.killed:
+				return s.client.killErr
+			// the stored messages are confirmed already, nothing is in flight between the batches
+			case <-s.client.draining:
+				return s.client.drainErr
+			}
+		}
+
+		if !ok {
+			if s.client.err == io.EOF {
+				return nil
+			}
+			return s.client.err
+		}
+
+		stop, err := s.fromClient(frame)
+		if err = s.handle(err); err != nil || stop {
+			return err
+		}
+
+		if len(s.batch) >= spoolBatch {
+			if err := s.handle(s.flush()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Soft exceptions close the channel, anything else ends the session
+func (s *spoolSession) handle(err error) error {
+	if e, ok := err.(*spec091.Error); ok && !e.Hard() {
+		return s.closeChannel(e)
+	}
+
+	return err
+}
+
+func (s *spoolSession) fromClient(frame *spec091.Frame) (bool, error) {
+	var method spec091.Method
+	if frame.Type == spec091.FrameMethod {
+		var err error
+		if method, err = frame.Method(); err != nil {
+			return true, err
+		}
+	}
+
+	// after the proxy closed a channel only its close-ok is expected
+	if s.closing[frame.Channel] {
+		if _, ok := method.(*spec091.ChannelCloseOk); ok {
+			delete(s.closing, frame.Channel)
+		}
+		return false, nil
+	}
+
+	if frame.Channel == 0 {
+		if _, ok := method.(*spec091.ConnectionClose); ok {
+			if err := s.flush(); err != nil {
+				return true, err
+			}
+			s.client.spec.PushConnectionCloseOk()
+			return true, nil
+		}
+		return false, nil
+	}
+
+	if _, ok := method.(*spec091.ChannelOpen); ok {
+		return false, s.openChannel(frame.Channel)
+	}
+
+	ch := s.channels[frame.Channel]
+	if ch == nil {
+		return true, spec091.NewError(spec091.ChannelError, "channel %d is not open", frame.Channel)
+	}
+
+	if method == nil || method.HasContent() {
+		message, err := s.assembler.Push(frame)
+		if err != nil {
+			return true, err
+		}
+		if message != nil {
+			if name := s.client.IdentityHeader; name != "" {
+				if message.Header.Properties.Headers == nil {
+					message.Header.Properties.Headers = transfer.Table{}
+				}
+				message.Header.Properties.Headers[name] = s.client.User
+			}
+
+			var seq uint64
+			if ch.confirm {
+				ch.published++
+				seq = ch.published
+			}
+			s.batch = append(s.batch, spooled{message: message, seq: seq})
+		}
+		return false, nil
+	}
+
+	if declaration, reply, err := spoolDeclaration(method); declaration && !isPassive(method) {
+		if err != nil {
+			err.Channel = frame.Channel
+			return false, err
+		}
+		s.batch = append(s.batch, spooled{message: &spec091.Message{Channel: frame.Channel, Method: method}, reply: reply})
+		return false, nil
+	}
+
+	// the other methods are answered in order with the stored messages
+	if err := s.flush(); err != nil {
+		return false, err
+	}
+
+	// the passive declarations only check the broker has the entity, they cannot be told apart
+	if isPassive(method) {
+		if _, reply, _ := spoolDeclaration(method); reply != nil {
+			return false, s.client.spec.WriteMethod(frame.Channel, reply)
+		}
+		return false, nil
+	}
+
+	switch m := method.(type) {
+	case *spec091.ChannelClose:
+		s.forget(frame.Channel)
+		return false, s.client.spec.WriteMethod(frame.Channel, &spec091.ChannelCloseOk{})
+
+	case *spec091.ChannelCloseOk:
+		s.forget(frame.Channel)
+		return false, nil
+
+	case *spec091.ConfirmSelect:
+		ch.confirm = true
+		if m.Nowait {
+			return false, nil
+		}
+		return false, s.client.spec.WriteMethod(frame.Channel, &spec091.ConfirmSelectOk{})
+
+	case *spec091.BasicQos:
+		return false, s.client.spec.WriteMethod(frame.Channel, &spec091.BasicQosOk{})
+	}
+
+	e := spec091.NewError(spec091.PreconditionFailed, "%s is not available while the upstream is unreachable", method.Name())
+	e.Channel = frame.Channel
+	e.ClassId, e.MethodId = method.Id()
+	return false, e
+}
+
+func (s *spoolSession) openChannel(id uint16) error {
+	if max := s.client.Tune.ChannelMax; max != 0 && id > max {
+		return spec091.NewError(spec091.NotAllowed, "channel %d is out of the negotiated channel_max (%d)", id, max)
+	}
+	if _, exists := s.channels[id]; exists {
+		return spec091.NewError(spec091.ChannelError, "channel %d is already open", id)
+	}
+
+	s.channels[id] = &spoolChannel{}
+	return s.client.spec.WriteMethod(id, &spec091.ChannelOpenOk{})
+}
+
+func (s *spoolSession) forget(id uint16) {
+	delete(s.channels, id)
+	s.assembler.Reset(id)
+}
+
+func (s *spoolSession) closeChannel(e *spec091.Error) error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	s.forget(e.Channel)
+	s.closing[e.Channel] = true
+
+	return s.client.spec.WriteMethod(e.Channel, &spec091.ChannelClose{
+		ReplyCode: e.Code,
+		ReplyText: e.Text,
+		ClassId:   e.ClassId,
+		MethodId:  e.MethodId,
+	})
+}
+
+// Store the batch and answer the client: confirms, nacks and the replies of the declarations
+func (s *spoolSession) flush() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+
+	batch := s.batch
+	s.batch = nil
+
+	messages := make([]*spec091.Message, len(batch))
+	for i, item := range batch {
+		messages[i] = item.message
+	}
+
+	stored, err := s.store(messages)
+	if err != nil {
+		return err
+	}
+
+	for i, item := range batch {
+		channel := item.message.Channel
+		if s.closing[channel] || s.channels[channel] == nil {
+			continue
+		}
+
+		switch {
+		case i < stored && item.reply != nil:
+			err = s.client.spec.WriteMethod(channel, item.reply)
+
+		case i < stored && item.seq > 0:
+			err = s.client.spec.WriteMethod(channel, &spec091.BasicAck{DeliveryTag: item.seq})
+
+		case i < stored:
+
+		case item.message.Header == nil:
+			// a declaration that does not fit cannot be confirmed
+			e := spec091.NewError(spec091.PreconditionFailed, "the spool is full")
+			e.Channel = channel
+			e.ClassId, e.MethodId = item.message.Method.Id()
+			s.forget(channel)
+			s.closing[channel] = true
+			err = s.client.spec.WriteMethod(channel, &spec091.ChannelClose{
+				ReplyCode: e.Code,
+				ReplyText: e.Text,
+				ClassId:   e.ClassId,
+				MethodId:  e.MethodId,
+			})
+
+		case item.seq > 0:
+			err = s.client.spec.WriteMethod(channel, &spec091.BasicNack{DeliveryTag: item.seq})
+
+		default:
+			logger.Warn(fmt.Sprintf("Spool is full, message of user %q vhost %q dropped", s.client.User, s.client.VirtualHost))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Whether the method is a declaration the spool keeps, with the reply the client expects.
+// The broker names the server-named queues, they cannot be declared without it.
+func spoolDeclaration(method spec091.Method) (bool, spec091.Method, *spec091.Error) {
+	switch m := method.(type) {
+	case *spec091.ExchangeDeclare:
+		if m.NoWait {
+			return true, nil, nil
+		}
+		return true, &spec091.ExchangeDeclareOk{}, nil
+
+	case *spec091.QueueDeclare:
+		if m.Queue == "" && !m.Passive {
+			e := spec091.NewError(spec091.PreconditionFailed, "server-named queues cannot be declared while the upstream is unreachable")
+			e.ClassId, e.MethodId = m.Id()
+			return true, nil, e
+		}
+		if m.NoWait {
+			return true, nil, nil
+		}
+		return true, &spec091.QueueDeclareOk{Queue: m.Queue}, nil
+
+	case *spec091.ExchangeBind:
+		if m.NoWait {
+			return true, nil, nil
+		}
+		return true, &spec091.ExchangeBindOk{}, nil
+
+	case *spec091.QueueBind:
+		if m.NoWait {
+			return true, nil, nil
+		}
+		return true, &spec091.QueueBindOk{}, nil
+	}
+
+	return false, nil, nil
+}
+
+func isPassive(method spec091.Method) bool {
+	switch m := method.(type) {
+	case *spec091.ExchangeDeclare:
+		return m.Passive
+	case *spec091.QueueDeclare:
+		return m.Passive
+	}
+
+	return false
+}
+
+// Forward publishes spooled messages and declarations in order on a channel of its own
+// and waits for the broker to confirm the messages.
+// It returns how many are done with: confirmed, or refused or nacked by the broker and dropped.
+// An error means the rest has to be forwarded again later.
+func Forward(u *Upstream, messages []*spec091.Message) (int, error) {
+	done := 0
+
+	for done < len(messages) {
+		n, err := u.forward(messages[done:])
+		done += n
+
+		// the broker closed the channel over the first unconfirmed one, or after all of them
+		if e, ok := err.(*spec091.Error); ok && e.Channel != 0 {
+			if done < len(messages) {
+				logger.Warn(fmt.Sprintf("Spooled %s refused by the upstream and dropped: %s", messages[done].Method.Name(), e.Text))
+				done++
+			}
+			continue
+		}
+		if err != nil {
+			return done, err
+		}
+	}
+
+	return done, nil
+}
+
+func (u *Upstream) forward(messages []*spec091.Message) (int, error) {
+	id, reused, err := u.allocateChannel(func(uint16) bool { return false })
+	if err != nil {
+		return 0, err
+	}
+
+	// a refusal here is not about the messages
+	if !reused {
+		u.channels[id] = &channelState{}
+		if _, err := u.call(id, &spec091.ChannelOpen{}); err != nil {
+			return 0, fmt.Errorf("cannot open an upstream channel: %s", err.Error())
+		}
+		u.channels[id].open = true
+	}
+
+	if _, err := u.call(id, &spec091.ConfirmSelect{}); err != nil {
+		return 0, fmt.Errorf("cannot select the confirm mode: %s", err.Error())
+	}
+	u.channels[id].confirm = true
+
+	// publish sequence number of each message, zero for the declarations
+	var (
+		seqs      = make([]uint64, len(messages))
+		published uint64
+		settled   = make(map[uint64]bool) // acked or nacked
+		sent      int                     // messages and declarations handed to the broker
+	)
+
+	// the messages before a declaration have to be confirmed first, the broker may close the channel over it
+	for i, message := range messages {
+		if message.Header != nil {
+			out := *message
+			out.Channel = id
+			frames, err := out.Frames(u.Tune.FrameMax)
+			if err != nil {
+				return countSettled(seqs[:sent], settled), err
+			}
+			for _, frame := range frames {
+				if err := u.spec.WriteFrame(frame); err != nil {
+					return countSettled(seqs[:sent], settled), err
+				}
+			}
+
+			published++
+			seqs[i] = published
+			sent = i + 1
+			continue
+		}
+
+		nacked, err := u.awaitConfirms(id, published, settled)
+		dropNacked(messages, seqs, nacked)
+		if err != nil {
+			return countSettled(seqs[:sent], settled), err
+		}
+
+		if _, err := u.call(id, noWait(message.Method)); err != nil {
+			return i, err
+		}
+		sent = i + 1
+	}
+
+	nacked, err := u.awaitConfirms(id, published, settled)
+	dropNacked(messages, seqs, nacked)
+	if err != nil {
+		return countSettled(seqs[:sent], settled), err
+	}
+
+	// every message is done with, a refused close is not about them
+	if _, err := u.call(id, &spec091.ChannelClose{ReplyCode: spec091.ReplySuccess, ReplyText: "spool forwarded"}); err != nil {
+		logger.Debug(fmt.Sprintf("Cannot close the spool channel: %s", err.Error()))
+		return len(messages), nil
+	}
+	delete(u.channels, id)
+
+	return len(messages), nil
+}
+
+// Position of the first message the broker did not answer yet.
+// The declarations before it are done, the broker answered them before the next messages were sent.
+func countSettled(seqs []uint64, settled map[uint64]bool) int {
+	for i, seq := range seqs {
+		if seq != 0 && !settled[seq] {
+			return i
+		}
+	}
+
+	return len(seqs)
+}
+
+// The broker could not take the nacked messages, they are dropped so they do not come back forever
+func dropNacked(messages []*spec091.Message, seqs []uint64, nacked []uint64) {
+	for _, seq := range nacked {
+		for i := range seqs {
+			if seqs[i] != seq {
+				continue
+			}
+			if publish, ok := messages[i].Method.(*spec091.BasicPublish); ok {
+				logger.Warn(fmt.Sprintf("Spooled message to exchange %q routing key %q nacked by the upstream and dropped", publish.Exchange, publish.RoutingKey))
+			} else {
+				logger.Warn(fmt.Sprintf("Spooled %s nacked by the upstream and dropped", messages[i].Method.Name()))
+			}
+			break
+		}
+	}
+}
+
+// Wait until the broker answered the messages up to published, in any order.
+// It returns the sequence numbers it nacked.
+func (u *Upstream) awaitConfirms(id uint16, published uint64, settled map[uint64]bool) ([]uint64, error) {
+	timeout := time.After(forwardTimeout)
+	var nacked []uint64
+
+	for uint64(len(settled)) < published {
+		select {
+		case frame, ok := <-u.frames:
+			if !ok {
+				return nacked, u.lostError()
+			}
+			if frame.Channel != id || frame.Type != spec091.FrameMethod {
+				u.handleStray(frame)
+				continue
+			}
+
+			method, err := frame.Method()
+			if err != nil {
+				return nacked, err
+			}
+
+			switch m := method.(type) {
+			case *spec091.BasicAck:
+				settle(settled, m.DeliveryTag, m.Multiple, published)
+			case *spec091.BasicNack:
+				nacked = append(nacked, settle(settled, m.DeliveryTag, m.Multiple, published)...)
+			case *spec091.ChannelClose:
+				return nacked, u.channelClosed(id, m)
+			}
+
+		case <-timeout:
+			return nacked, fmt.Errorf("upstream did not confirm the spooled messages within %s", forwardTimeout)
+		}
+	}
+
+	return nacked, nil
+}
+
+// Mark the messages the broker answered, with multiple every one up to the tag.
+// It returns the ones not answered before.
+func settle(settled map[uint64]bool, tag uint64, multiple bool, published uint64) []uint64 {
+	first := tag
+	if multiple {
+		first = 1
+	}
+
+	var answered []uint64
+	for seq := first; seq <= tag && seq <= published; seq++ {
+		if !settled[seq] {
+			settled[seq] = true
+			answered = append(answered, seq)
+		}
+	}
+
+	return answered
+}
+
+// Send a method to the broker and wait for its answer, the frames of the other channels are strays
+func (u *Upstream) call(id uint16, method spec091.Method) (spec091.Method, error) {
+	if err := u.spec.WriteMethod(id, method); err != nil {
+		return nil, err
+	}
+
+	timeout := time.After(replayTimeout)
+
+	for {
+		select {
+		case frame, ok := <-u.frames:
+			if !ok {
+				return nil, u.lostError()
+			}
+			if frame.Channel != id || frame.Type != spec091.FrameMethod {
+				u.handleStray(frame)
+				continue
+			}
+
+			reply, err := frame.Method()
+			if err != nil {
+				return nil, err
+			}
+
+			if closeMethod, ok := reply.(*spec091.ChannelClose); ok {
+				return nil, u.channelClosed(id, closeMethod)
+			}
+
+			if reply.Name() == method.Name()+"-ok" {
+				return reply, nil
+			}
+
+		case <-timeout:
+			return nil, fmt.Errorf("upstream did not answer %s within %s", method.Name(), replayTimeout)
+		}
+	}
+}
+
+// Confirm the broker closed the channel, its reason is returned as a channel exception
+func (u *Upstream) channelClosed(id uint16, closeMethod *spec091.ChannelClose) *spec091.Error {
+	u.spec.PushChannelCloseOk(id)
+	delete(u.channels, id)
+
+	return &spec091.Error{
+		Code:     closeMethod.ReplyCode,
+		Text:     closeMethod.ReplyText,
+		Channel:  id,
+		ClassId:  closeMethod.ClassId,
+		MethodId: closeMethod.MethodId,
+	}
+}
+
+func (u *Upstream) lostError() error {
+	if u.err != nil {
+		return u.err
+	}
+	return fmt.Errorf("upstream connection lost")
+}
+
+// Copy of a declaration that waits for the broker's answer
+func noWait(method spec091.Method) spec091.Method {
+	switch m := method.(type) {
+	case *spec091.ExchangeDeclare:
+		declare := *m
+		declare.NoWait = false
+		return &declare
+	case *spec091.QueueDeclare:
+		declare := *m
+		declare.NoWait = false
+		return &declare
+	case *spec091.ExchangeBind:
+		bind := *m
+		bind.NoWait = false
+		return &bind
+	case *spec091.QueueBind:
+		bind := *m
+		bind.NoWait = false
+		return &bind
+	}
+
+	return method
+}
@@ -0,0 +1,266 @@
+package ampq
+
+import (
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+	"sort"
+)
+
+// tagTable numbers again the tags one side gives, so the other side sees its own sequence from 1.
+// Delivery tags are given by the broker and numbered again for the client,
+// publish sequence numbers are given by the client and numbered again for the broker.
+type tagTable struct {
+	next        uint64            // last tag given on the translated side
+	outstanding map[uint64]uint64 // original tag by translated tag, until it is acknowledged
+	stale       uint64            // translated tags up to it cannot be acknowledged anymore, they are ignored
+}
+
+func newTagTable() *tagTable {
+	return &tagTable{outstanding: make(map[uint64]uint64)}
+}
+
+// Translated tag for the original one
+func (t *tagTable) add(original uint64) uint64 {
+	t.next++
+	t.outstanding[t.next] = original
+
+	return t.next
+}
+
+// Translated tag for a delivery that is not acknowledged, it is not kept
+func (t *tagTable) skip() uint64 {
+	t.next++
+
+	return t.next
+}
+
+// Original tags acknowledged by the translated tag, in ascending order.
+// With multiple, contiguous tells that no other original tag up to the last one is outstanding,
+// so one acknowledgement with multiple set covers exactly them.
+func (t *tagTable) resolve(tag uint64, multiple bool) (originals []uint64, contiguous bool, err error) {
+	if tag > t.next {
+		return nil, false, spec091.NewError(spec091.PreconditionFailed, "unknown delivery tag %d", tag)
+	}
+
+	if !multiple {
+		if tag <= t.stale {
+			return nil, false, nil
+		}
+
+		original, exists := t.outstanding[tag]
+		if !exists {
+			return nil, false, spec091.NewError(spec091.PreconditionFailed, "unknown delivery tag %d", tag)
+		}
+		delete(t.outstanding, tag)
+
+		return []uint64{original}, true, nil
+	}
+
+	// zero with multiple acknowledges everything outstanding
+	if tag == 0 {
+		tag = t.next
+	}
+
+	for translated, original := range t.outstanding {
+		if translated <= tag {
+			originals = append(originals, original)
+			delete(t.outstanding, translated)
+		}
+	}
+	sort.Slice(originals, func(i, j int) bool { return originals[i] < originals[j] })
+
+	contiguous = true
+	if len(originals) > 0 {
+		last := originals[len(originals)-1]
+		for _, original := range t.outstanding {
+			if original < last {
+				contiguous = false
+				break
+			}
+		}
+	}
+
+	return originals, contiguous, nil
+}
+
+// Forget the outstanding tags, the ones given so far are ignored when they come back
+func (t *tagTable) expire() {
+	t.stale = t.next
+	t.outstanding = make(map[uint64]uint64)
+}
+
+// Tags of one client channel
+type channelTags struct {
+	deliveries *tagTable // client delivery tags for the broker ones
+	confirms   *tagTable // broker publish sequence numbers for the client ones, nil until confirm.select
+	published  uint64    // sequence number of the last publish of the client in confirm mode
+	getNoAck   bool      // of the basic.get waiting for its answer
+}
+
+func newChannelTags() *channelTags {
+	return &channelTags{deliveries: newTagTable()}
+}
+
+// Acknowledgement frames for the original tags, one with multiple set when it covers exactly them
+func ackFrames(channel uint16, originals []uint64, multiple bool, contiguous bool, ack func(tag uint64, multiple bool) spec091.Method) ([]*spec091.Frame, error) {
+	if len(originals) == 0 {
+		return nil, nil
+	}
+
+	if multiple && contiguous {
+		frame, err := spec091.NewMethodFrame(channel, ack(originals[len(originals)-1], true))
+		if err != nil {
+			return nil, err
+		}
+		return []*spec091.Frame{frame}, nil
+	}
+
+	frames := make([]*spec091.Frame, 0, len(originals))
+	for _, original := range originals {
+		frame, err := spec091.NewMethodFrame(channel, ack(original, false))
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+
+	return frames, nil
+}
+
+// Translate a client method on the upstream channel id.
+// Handled is false when the frame goes to the broker as it is.
+func (r *relay) translateFromClient(client uint16, id uint16, method spec091.Method) (frames []*spec091.Frame, handled bool, err error) {
+	tags := r.tags[client]
+	if tags == nil {
+		return nil, false, nil
+	}
+
+	var (
+		tag      uint64
+		multiple bool
+		ack      func(tag uint64, multiple bool) spec091.Method
+	)
+
+	switch m := method.(type) {
+	case *spec091.ConfirmSelect:
+		if tags.confirms == nil {
+			tags.confirms = newTagTable()
+		}
+		return nil, false, nil
+
+	case *spec091.BasicPublish:
+		if tags.confirms != nil {
+			tags.published++
+			tags.confirms.add(tags.published)
+		}
+		return nil, false, nil
+
+	case *spec091.BasicGet:
+		tags.getNoAck = m.NoAck
+		return nil, false, nil
+
+	case *spec091.BasicRecover, *spec091.BasicRecoverAsync:
+		// the broker delivers the unacknowledged messages again with new tags
+		tags.deliveries.expire()
+		return nil, false, nil
+
+	case *spec091.BasicAck:
+		tag, multiple = m.DeliveryTag, m.Multiple
+		ack = func(tag uint64, multiple bool) spec091.Method {
+			return &spec091.BasicAck{DeliveryTag: tag, Multiple: multiple}
+		}
+
+	case *spec091.BasicNack:
+		tag, multiple = m.DeliveryTag, m.Multiple
+		ack = func(tag uint64, multiple bool) spec091.Method {
+			return &spec091.BasicNack{DeliveryTag: tag, Multiple: multiple, Requeue: m.Requeue}
+		}
+
+	case *spec091.BasicReject:
+		tag = m.DeliveryTag
+		ack = func(tag uint64, multiple bool) spec091.Method {
+			return &spec091.BasicReject{DeliveryTag: tag, Requeue: m.Requeue}
+		}
+
+	default:
+		return nil, false, nil
+	}
+
+	originals, contiguous, err := tags.deliveries.resolve(tag, multiple)
+	if err != nil {
+		e := err.(*spec091.Error)
+		e.Channel = client
+		e.ClassId, e.MethodId = method.Id()
+		return nil, true, e
+	}
+
+	frames, err = ackFrames(id, originals, multiple, contiguous, ack)
+
+	return frames, true, err
+}
+
+// Translate a broker method for the client channel.
+// Handled is false when the frame goes to the client as it is.
+func (r *relay) translateFromUpstream(client uint16, method spec091.Method) (frames []*spec091.Frame, handled bool, err error) {
+	tags := r.tags[client]
+	if tags == nil {
+		return nil, false, nil
+	}
+
+	var rewritten spec091.Method
+
+	// the deliveries without acknowledgement only take the next tag
+	switch m := method.(type) {
+	case *spec091.BasicDeliver:
+		if r.topology.noAck(client, m.ConsumerTag) {
+			m.DeliveryTag = tags.deliveries.skip()
+		} else {
+			m.DeliveryTag = tags.deliveries.add(m.DeliveryTag)
+		}
+		rewritten = m
+
+	case *spec091.BasicGetOk:
+		if tags.getNoAck {
+			m.DeliveryTag = tags.deliveries.skip()
+		} else {
+			m.DeliveryTag = tags.deliveries.add(m.DeliveryTag)
+		}
+		rewritten = m
+
+	// publisher confirms
+	case *spec091.BasicAck:
+		if tags.confirms == nil {
+			return nil, false, nil
+		}
+		originals, contiguous, err := tags.confirms.resolve(m.DeliveryTag, m.Multiple)
+		if err != nil {
+			return nil, true, nil
+		}
+		frames, err = ackFrames(client, originals, m.Multiple, contiguous, func(tag uint64, multiple bool) spec091.Method {
+			return &spec091.BasicAck{DeliveryTag: tag, Multiple: multiple}
+		})
+		return frames, true, err
+
+	case *spec091.BasicNack:
+		if tags.confirms == nil {
+			return nil, false, nil
+		}
+		originals, contiguous, err := tags.confirms.resolve(m.DeliveryTag, m.Multiple)
+		if err != nil {
+			return nil, true, nil
+		}
+		frames, err = ackFrames(client, originals, m.Multiple, contiguous, func(tag uint64, multiple bool) spec091.Method {
+			return &spec091.BasicNack{DeliveryTag: tag, Multiple: multiple, Requeue: m.Requeue}
+		})
+		return frames, true, err
+
+	default:
+		return nil, false, nil
+	}
+
+	frame, err := spec091.NewMethodFrame(client, rewritten)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return []*spec091.Frame{frame}, true, nil
+}
@@ -0,0 +1,396 @@
+package ampq
+
+import (
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+	"sort"
+	"sync"
+)
+
+// topology is what a client declared through the relay, replayed on a new upstream connection when the broker is lost.
+// The methods are recorded once the broker confirmed them, with the names the client knows.
+// The relay changes it, the channels may be read by anybody under the lock.
+type topology struct {
+	mu               sync.RWMutex
+	exchanges        map[string]*spec091.ExchangeDeclare
+	queues           map[string]*spec091.QueueDeclare
+	exchangeBindings []*spec091.ExchangeBind
+	queueBindings    []*spec091.QueueBind
+	// queues the broker named, they get a new name on each replay
+	serverNamed map[string]bool
+	// broker names of the replayed server-named queues by the names the client knows
+	renamed  map[string]string
+	channels map[uint16]*channelTopology
+}
+
+// What a client channel set up, by client channel id
+type channelTopology struct {
+	qos       *spec091.BasicQos // per consumer prefetch
+	globalQos *spec091.BasicQos // per channel prefetch
+	confirm   bool
+	tx        bool
+	// publishes or acknowledgements since the last commit or rollback, the broker drops them with the connection
+	txWork    bool
+	consumers map[string]*spec091.BasicConsume
+	// synchronous method sent to the broker and not answered yet
+	pending spec091.Method
+}
+
+func newTopology() *topology {
+	return &topology{
+		exchanges:   make(map[string]*spec091.ExchangeDeclare),
+		queues:      make(map[string]*spec091.QueueDeclare),
+		serverNamed: make(map[string]bool),
+		renamed:     make(map[string]string),
+		channels:    make(map[uint16]*channelTopology),
+	}
+}
+
+func (t *topology) open(client uint16) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.channels[client] = &channelTopology{consumers: make(map[string]*spec091.BasicConsume)}
+}
+
+func (t *topology) close(client uint16) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.channels, client)
+}
+
+// Whether the consumer of the client channel takes its deliveries without acknowledging them
+func (t *topology) noAck(client uint16, tag string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	ch := t.channels[client]
+	if ch == nil {
+		return false
+	}
+
+	consume, exists := ch.consumers[tag]
+	return exists && consume.NoAck
+}
+
+// Mark the transaction of the client channel as holding work when the method is a publish or an acknowledgement
+func (t *topology) transact(client uint16, method spec091.Method) {
+	switch method.(type) {
+	case *spec091.BasicPublish, *spec091.BasicAck, *spec091.BasicNack, *spec091.BasicReject:
+	default:
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if ch := t.channels[client]; ch != nil && ch.tx {
+		ch.txWork = true
+	}
+}
+
+// Record a method the client sends, the synchronous ones wait for the answer of the broker
+func (t *topology) request(client uint16, method spec091.Method) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ch := t.channels[client]
+	if ch == nil {
+		return
+	}
+
+	wait, synchronous := replyExpected(method)
+	if !synchronous {
+		return
+	}
+
+	if wait {
+		ch.pending = method
+		return
+	}
+
+	t.commit(ch, method, nil)
+}
+
+// Record the answer of the broker to the pending method of the client channel
+func (t *topology) reply(client uint16, method spec091.Method) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ch := t.channels[client]
+	if ch == nil {
+		return
+	}
+
+	switch m := method.(type) {
+	case *spec091.BasicCancel:
+		// the broker cancelled the consumer, the queue was deleted for example
+		delete(ch.consumers, m.ConsumerTag)
+		return
+
+	case *spec091.BasicDeliver, *spec091.BasicReturn, *spec091.BasicAck, *spec091.BasicNack, *spec091.ChannelFlow:
+		return
+	}
+
+	pending := ch.pending
+	ch.pending = nil
+
+	if pending != nil && method.Name() == pending.Name()+"-ok" {
+		t.commit(ch, pending, method)
+	}
+}
+
+// Consumer tags by client channel id, sorted
+func (t *topology) consumers() map[uint16][]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	consumers := make(map[uint16][]string, len(t.channels))
+	for client, ch := range t.channels {
+		tags := make([]string, 0, len(ch.consumers))
+		for tag := range ch.consumers {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		consumers[client] = tags
+	}
+
+	return consumers
+}
+
+// Whether the broker answers the method, wait is false when the client asked for no answer
+func replyExpected(method spec091.Method) (wait bool, synchronous bool) {
+	switch m := method.(type) {
+	case *spec091.ExchangeDeclare:
+		return !m.NoWait, true
+	case *spec091.ExchangeDelete:
+		return !m.NoWait, true
+	case *spec091.ExchangeBind:
+		return !m.NoWait, true
+	case *spec091.ExchangeUnbind:
+		return !m.NoWait, true
+	case *spec091.QueueDeclare:
+		return !m.NoWait, true
+	case *spec091.QueueDelete:
+		return !m.NoWait, true
+	case *spec091.QueueBind:
+		return !m.NoWait, true
+	case *spec091.QueuePurge:
+		return !m.NoWait, true
+	case *spec091.BasicConsume:
+		return !m.NoWait, true
+	case *spec091.BasicCancel:
+		return !m.NoWait, true
+	case *spec091.ConfirmSelect:
+		return !m.Nowait, true
+	case *spec091.ChannelClose, *spec091.QueueUnbind, *spec091.BasicQos, *spec091.BasicGet, *spec091.BasicRecover,
+		*spec091.TxSelect, *spec091.TxCommit, *spec091.TxRollback, *spec091.ChannelFlow:
+		return true, true
+	}
+
+	return false, false
+}
+
+// Keep what the broker accepted, reply is nil for the methods sent without waiting
+func (t *topology) commit(ch *channelTopology, method spec091.Method, reply spec091.Method) {
+	switch m := method.(type) {
+	case *spec091.ExchangeDeclare:
+		if !m.Passive {
+			t.exchanges[m.Exchange] = m
+		}
+
+	case *spec091.ExchangeDelete:
+		delete(t.exchanges, m.Exchange)
+		t.unbindExchange(m.Exchange)
+
+	case *spec091.ExchangeBind:
+		t.exchangeBindings = append(removeExchangeBinding(t.exchangeBindings, m.Destination, m.Source, m.RoutingKey), m)
+
+	case *spec091.ExchangeUnbind:
+		t.exchangeBindings = removeExchangeBinding(t.exchangeBindings, m.Destination, m.Source, m.RoutingKey)
+
+	case *spec091.QueueDeclare:
+		if m.Passive {
+			return
+		}
+		declared := *m
+		if ok, _ := reply.(*spec091.QueueDeclareOk); ok != nil && m.Queue == "" {
+			declared.Queue = ok.Queue
+			t.serverNamed[ok.Queue] = true
+		}
+		t.queues[declared.Queue] = &declared
+
+	case *spec091.QueueDelete:
+		t.deleteQueue(m.Queue)
+
+	case *spec091.QueueBind:
+		t.queueBindings = append(removeQueueBinding(t.queueBindings, m.Queue, m.Exchange, m.RoutingKey), m)
+
+	case *spec091.QueueUnbind:
+		t.queueBindings = removeQueueBinding(t.queueBindings, m.Queue, m.Exchange, m.RoutingKey)
+
+	case *spec091.BasicQos:
+		if m.Global {
+			ch.globalQos = m
+		} else {
+			ch.qos = m
+		}
+
+	case *spec091.BasicConsume:
+		consume := *m
+		if ok, _ := reply.(*spec091.BasicConsumeOk); ok != nil {
+			consume.ConsumerTag = ok.ConsumerTag
+		}
+		ch.consumers[consume.ConsumerTag] = &consume
+
+	case *spec091.BasicCancel:
+		delete(ch.consumers, m.ConsumerTag)
+
+	case *spec091.ConfirmSelect:
+		ch.confirm = true
+
+	case *spec091.TxSelect:
+		ch.tx = true
+
+	case *spec091.TxCommit, *spec091.TxRollback:
+		ch.txWork = false
+	}
+}
+
+// Forget a deleted queue with its bindings and consumers
+func (t *topology) deleteQueue(queue string) {
+	delete(t.queues, queue)
+	delete(t.serverNamed, queue)
+	delete(t.renamed, queue)
+
+	bindings := t.queueBindings[:0]
+	for _, binding := range t.queueBindings {
+		if binding.Queue != queue {
+			bindings = append(bindings, binding)
+		}
+	}
+	t.queueBindings = bindings
+
+	for _, ch := range t.channels {
+		for tag, consume := range ch.consumers {
+			if consume.Queue == queue {
+				delete(ch.consumers, tag)
+			}
+		}
+	}
+}
+
+// Forget the bindings of a deleted exchange
+func (t *topology) unbindExchange(exchange string) {
+	exchangeBindings := t.exchangeBindings[:0]
+	for _, binding := range t.exchangeBindings {
+		if binding.Source != exchange && binding.Destination != exchange {
+			exchangeBindings = append(exchangeBindings, binding)
+		}
+	}
+	t.exchangeBindings = exchangeBindings
+
+	queueBindings := t.queueBindings[:0]
+	for _, binding := range t.queueBindings {
+		if binding.Exchange != exchange {
+			queueBindings = append(queueBindings, binding)
+		}
+	}
+	t.queueBindings = queueBindings
+}
+
+func removeExchangeBinding(bindings []*spec091.ExchangeBind, destination string, source string, routingKey string) []*spec091.ExchangeBind {
+	kept := bindings[:0]
+	for _, binding := range bindings {
+		if binding.Destination != destination || binding.Source != source || binding.RoutingKey != routingKey {
+			kept = append(kept, binding)
+		}
+	}
+
+	return kept
+}
+
+func removeQueueBinding(bindings []*spec091.QueueBind, queue string, exchange string, routingKey string) []*spec091.QueueBind {
+	kept := bindings[:0]
+	for _, binding := range bindings {
+		if binding.Queue != queue || binding.Exchange != exchange || binding.RoutingKey != routingKey {
+			kept = append(kept, binding)
+		}
+	}
+
+	return kept
+}
+
+// Broker name of a queue the client knows
+func (t *topology) queueName(queue string) string {
+	if renamed, exists := t.renamed[queue]; exists {
+		return renamed
+	}
+
+	return queue
+}
+
+// Copy of a client method with the broker names of the replayed server-named queues, nil when it has none
+func (t *topology) rename(method spec091.Method) spec091.Method {
+	if len(t.renamed) == 0 {
+		return nil
+	}
+
+	var (
+		copied spec091.Method
+		queue  *string
+	)
+
+	switch m := method.(type) {
+	case *spec091.QueueDeclare:
+		c := *m
+		copied, queue = &c, &c.Queue
+	case *spec091.QueueBind:
+		c := *m
+		copied, queue = &c, &c.Queue
+	case *spec091.QueueUnbind:
+		c := *m
+		copied, queue = &c, &c.Queue
+	case *spec091.QueuePurge:
+		c := *m
+		copied, queue = &c, &c.Queue
+	case *spec091.QueueDelete:
+		c := *m
+		copied, queue = &c, &c.Queue
+	case *spec091.BasicConsume:
+		c := *m
+		copied, queue = &c, &c.Queue
+	case *spec091.BasicGet:
+		c := *m
+		copied, queue = &c, &c.Queue
+	case *spec091.BasicPublish:
+		// the default exchange routes by queue name
+		if m.Exchange == "" {
+			c := *m
+			copied, queue = &c, &c.RoutingKey
+		}
+	}
+
+	if queue == nil {
+		return nil
+	}
+
+	name, exists := t.renamed[*queue]
+	if !exists {
+		return nil
+	}
+	*queue = name
+
+	return copied
+}
+
+// Name the client knows for a queue the broker named on a replay
+func (t *topology) clientQueueName(queue string) (string, bool) {
+	for name, renamed := range t.renamed {
+		if renamed == queue {
+			return name, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,53 @@
+package ampq
+
+import "github.com/sv-z/amqproxy/Internal/ampq/spec091"
+
+// Limits offered to the clients when none are configured
+var DefaultTune = Tune{ChannelMax: 2047, FrameMax: 131072, Heartbeat: 60}
+
+// Tune holds the connection limits agreed with connection.tune / connection.tune-ok
+type Tune struct {
+	ChannelMax uint16
+	FrameMax   uint32
+	Heartbeat  uint16
+}
+
+// Pick the lowest of two limits, zero means "no limit" for both sides
+func negotiateUint16(server uint16, client uint16) uint16 {
+	if server == 0 || (client != 0 && client < server) {
+		return client
+	}
+	return server
+}
+
+func negotiateUint32(server uint32, client uint32) uint32 {
+	if server == 0 || (client != 0 && client < server) {
+		return client
+	}
+	return server
+}
+
+// Lower the channel and frame limits to the ones of another connection, the heartbeat is left as is
+func (t Tune) Clamp(limit Tune) Tune {
+	t.ChannelMax = negotiateUint16(t.ChannelMax, limit.ChannelMax)
+	t.FrameMax = negotiateUint32(t.FrameMax, limit.FrameMax)
+
+	return t
+}
+
+// The client may lower the offered limits, never raise them
+func (t Tune) check(tuneOk Tune) error {
+	if t.ChannelMax != 0 && (tuneOk.ChannelMax == 0 || tuneOk.ChannelMax > t.ChannelMax) {
+		return spec091.NewError(spec091.NotAllowed, "negotiated channel_max = %d is higher than the maximum allowed value (%d)", tuneOk.ChannelMax, t.ChannelMax)
+	}
+
+	if tuneOk.FrameMax != 0 && tuneOk.FrameMax < spec091.FrameMinSize {
+		return spec091.NewError(spec091.NotAllowed, "negotiated frame_max = %d is lower than the minimum allowed value (%d)", tuneOk.FrameMax, spec091.FrameMinSize)
+	}
+
+	if t.FrameMax != 0 && (tuneOk.FrameMax == 0 || tuneOk.FrameMax > t.FrameMax) {
+		return spec091.NewError(spec091.NotAllowed, "negotiated frame_max = %d is higher than the maximum allowed value (%d)", tuneOk.FrameMax, t.FrameMax)
+	}
+
+	return nil
+}
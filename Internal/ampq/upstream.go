@@ -0,0 +1,345 @@
+package ampq
+
+import (
+	"fmt"
+	logger "github.com/sirupsen/logrus"
+	transfer "github.com/sv-z/amqproxy/Internal/ampq/data-transfer"
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the previous client's channels may take to close before the connection is dropped from the pool
+const resetTimeout = 5 * time.Second
+
+// Upstream is the connection the proxy opens to the broker
+type Upstream struct {
+	Connected        bool
+	ServerProperties transfer.Table
+	Tune             Tune
+	conn             io.ReadWriteCloser
+	spec             *spec091.Spec
+	frames           chan *spec091.Frame
+	closed           chan struct{}
+	closeOnce        sync.Once
+	err              error
+	closing          bool
+	channels         map[uint16]*channelState
+	heartbeat        *heartbeat
+	key              poolKey
+	idleSince        time.Time
+	stopIdle         chan struct{}
+	idleDone         chan struct{}
+}
+
+func NewUpstream(conn io.ReadWriteCloser) *Upstream {
+	var readWriter io.ReadWriter = conn
+
+	return &Upstream{
+		conn:     conn,
+		spec:     spec091.NewSpec091(&readWriter),
+		frames:   make(chan *spec091.Frame, 64),
+		closed:   make(chan struct{}),
+		channels: make(map[uint16]*channelState),
+	}
+}
+
+// The proxy plays the client role of the handshake
+//
+//	open-Connection     = C:protocol-header
+//	                      S:START C:START-OK
+//	                      S:TUNE C:TUNE-OK
+//	                      C:OPEN S:OPEN-OK
+func (u *Upstream) Open(credentials Credentials, properties transfer.Table, limits Tune) error {
+
+	// C:protocol-header
+	if !u.spec.PushProtocolHeader() {
+		return fmt.Errorf("cannot send upstream protocol header")
+	}
+
+	// S:START >> C:START-OK
+	start, err := u.spec.PullConnectionStart()
+	if err != nil {
+		return err
+	}
+	u.ServerProperties = start.ServerProperties
+
+	// EXTERNAL is not used: the broker takes the identity from the proxy certificate, not from the response
+	mechanism, response := "PLAIN", fmt.Sprintf("\x00%s\x00%s", credentials.User, credentials.Password)
+
+	if !strings.Contains(" "+start.Mechanisms+" ", " "+mechanism+" ") {
+		return spec091.NewError(spec091.AccessRefused, "upstream does not offer authentication mechanism %s", mechanism)
+	}
+
+	if !u.spec.PushConnectionStartOk(&properties, mechanism, response) {
+		return fmt.Errorf("cannot send request \"connection.start-ok\"")
+	}
+
+	// S:TUNE >> C:TUNE-OK
+	tune, err := u.spec.PullConnectionTune()
+	if err != nil {
+		return err
+	}
+
+	u.Tune = Tune{
+		ChannelMax: negotiateUint16(tune.ChannelMax, limits.ChannelMax),
+		FrameMax:   negotiateUint32(tune.FrameMax, limits.FrameMax),
+		Heartbeat:  negotiateUint16(tune.Heartbeat, limits.Heartbeat),
+	}
+
+	if !u.spec.PushConnectionTuneOk(u.Tune.ChannelMax, u.Tune.FrameMax, u.Tune.Heartbeat) {
+		return fmt.Errorf("cannot send request \"connection.tune-ok\"")
+	}
+	u.spec.SetFrameMax(u.Tune.FrameMax)
+
+	// C:OPEN >> S:OPEN-OK
+	if !u.spec.PushConnectionOpen(credentials.Vhost) {
+		return fmt.Errorf("cannot send request \"connection.open\"")
+	}
+
+	if _, err := u.spec.PullConnectionOpenOk(); err != nil {
+		return err
+	}
+
+	u.Connected = true
+
+	go u.readLoop()
+
+	u.heartbeat = startHeartbeat(u.spec, u.Tune.Heartbeat, func() {
+		logger.Warn(fmt.Sprintf("Missed heartbeats from upstream, timeout: %ds", u.Tune.Heartbeat))
+		u.conn.Close()
+	})
+
+	return nil
+}
+
+// Read the broker properties from connection.start without opening the connection
+func (u *Upstream) probe() (transfer.Table, error) {
+	if !u.spec.PushProtocolHeader() {
+		return nil, fmt.Errorf("cannot send upstream protocol header")
+	}
+
+	start, err := u.spec.PullConnectionStart()
+	if err != nil {
+		return nil, err
+	}
+
+	return start.ServerProperties, nil
+}
+
+// Check the broker answers the handshake, the connection is closed afterwards.
+// With a user the connection is opened and closed again, otherwise connection.start is enough.
+func Check(conn io.ReadWriteCloser, credentials Credentials) error {
+	u := NewUpstream(conn)
+
+	if credentials.User == "" {
+		defer conn.Close()
+		_, err := u.probe()
+		return err
+	}
+
+	if err := u.Open(credentials, transfer.Table{"product": "amqproxy health check"}, Tune{}); err != nil {
+		conn.Close()
+		return err
+	}
+
+	return u.Close()
+}
+
+// Close the connection with the broker, gracefully when it is still usable.
+// Nothing else may read the frames at the same time.
+func (u *Upstream) Close() error {
+	if u.Connected && !u.broken() {
+		if u.spec.WriteMethod(0, &spec091.ConnectionClose{ReplyCode: spec091.ReplySuccess, ReplyText: "closed by proxy"}) == nil {
+			u.awaitCloseOk()
+		}
+	}
+	u.Connected = false
+
+	if u.heartbeat != nil {
+		u.heartbeat.Stop()
+	}
+
+	return u.conn.Close()
+}
+
+// Wait for the broker to confirm the connection close, the other frames are of no use anymore
+func (u *Upstream) awaitCloseOk() {
+	timeout := time.After(closeTimeout)
+
+	for {
+		select {
+		case frame, ok := <-u.frames:
+			if !ok {
+				return
+			}
+			if method, err := frame.Method(); err == nil {
+				if _, ok := method.(*spec091.ConnectionCloseOk); ok {
+					return
+				}
+			}
+
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// The connection was closed or the broker asked to close it, it cannot be used anymore
+func (u *Upstream) broken() bool {
+	return u.closing || u.disconnected()
+}
+
+// The connection to the broker is gone, safe to call while the connection is idle
+func (u *Upstream) disconnected() bool {
+	select {
+	case <-u.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Read frames from the broker until the connection is gone, the heartbeats are consumed here.
+// The frames channel is closed afterwards and err tells why.
+func (u *Upstream) readLoop() {
+	defer close(u.frames)
+
+	for {
+		frame, err := u.spec.ReadFrame()
+		if err != nil {
+			u.err = err
+			u.closeOnce.Do(func() {
+				close(u.closed)
+			})
+			return
+		}
+
+		if frame.Type == spec091.FrameHeartbeat {
+			continue
+		}
+
+		u.frames <- frame
+	}
+}
+
+// Take care of the frames nobody is waiting for while the connection sits in the pool
+func (u *Upstream) idle(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case frame, ok := <-u.frames:
+			if !ok {
+				return
+			}
+			u.handleStray(frame)
+		}
+	}
+}
+
+// Handle a frame that does not belong to any client
+func (u *Upstream) handleStray(frame *spec091.Frame) {
+	if frame.Type != spec091.FrameMethod {
+		return
+	}
+
+	method, err := frame.Method()
+	if err != nil {
+		return
+	}
+
+	switch method.(type) {
+	case *spec091.ConnectionClose:
+		u.closing = true
+		u.spec.PushConnectionCloseOk()
+
+	case *spec091.ChannelClose:
+		u.spec.PushChannelCloseOk(frame.Channel)
+		delete(u.channels, frame.Channel)
+
+	case *spec091.ChannelCloseOk:
+		delete(u.channels, frame.Channel)
+	}
+}
+
+// Close or reset whatever the previous client left on the channels
+// so the connection can be handed to the next client
+func (u *Upstream) reset() error {
+	pending := 0
+
+	for id, ch := range u.channels {
+		switch {
+		case ch.content:
+			return fmt.Errorf("channel %d was left in the middle of a content", id)
+
+		case ch.closing:
+			pending++
+
+		case !ch.reusable():
+			if !u.spec.PushChannelClose(id, spec091.ReplySuccess, "reset by proxy") {
+				return fmt.Errorf("cannot close upstream channel %d", id)
+			}
+			ch.closing = true
+			pending++
+
+		case ch.qos:
+			// the consumer limit and the channel-wide one
+			if !u.spec.PushBasicQos(id, 0, 0, false) || !u.spec.PushBasicQos(id, 0, 0, true) {
+				return fmt.Errorf("cannot reset qos on upstream channel %d", id)
+			}
+			ch.qos = false
+			pending += 2
+		}
+	}
+
+	timeout := time.After(resetTimeout)
+
+	for pending > 0 {
+		select {
+		case frame, ok := <-u.frames:
+			if !ok {
+				return u.err
+			}
+
+			var method spec091.Method
+			if frame.Type == spec091.FrameMethod {
+				method, _ = frame.Method()
+			}
+
+			switch method.(type) {
+			case *spec091.ChannelCloseOk:
+				if _, exists := u.channels[frame.Channel]; exists {
+					pending--
+				}
+				delete(u.channels, frame.Channel)
+
+			case *spec091.ChannelClose:
+				if ch, exists := u.channels[frame.Channel]; exists && ch.closing {
+					pending--
+				}
+				u.handleStray(frame)
+
+			case *spec091.BasicQosOk:
+				pending--
+
+			default:
+				u.handleStray(frame)
+			}
+
+			if u.closing {
+				return fmt.Errorf("upstream is closing the connection")
+			}
+
+		case <-timeout:
+			return fmt.Errorf("upstream channels were not reset within %s", resetTimeout)
+		}
+	}
+
+	return nil
+}
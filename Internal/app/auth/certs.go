@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CertRule takes the user name from one attribute of the client certificate.
+// The first capture group of Pattern is the user name, the whole match when there is no group.
+type CertRule struct {
+	Field   string // "cn", "dns", "email" or "uri"
+	Pattern *regexp.Regexp
+}
+
+// CertMapper maps the client certificates to user names, the first matching rule wins
+type CertMapper struct {
+	rules []CertRule
+}
+
+// Parse the rules separated by ";", each one is "field" or "field:pattern".
+//
+//	cn:^(.+)\.services\.example\.com$; email:^(.+)@example\.com$
+//
+// Empty rules take the common name as it is.
+func NewCertMapper(rules string) (*CertMapper, error) {
+	mapper := &CertMapper{}
+
+	if strings.TrimSpace(rules) == "" {
+		rules = "cn"
+	}
+
+	for _, rule := range strings.Split(rules, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, ":", 2)
+		field := strings.ToLower(parts[0])
+		pattern := "^.+$"
+		if len(parts) == 2 {
+			pattern = parts[1]
+		}
+
+		switch field {
+		case "cn", "dns", "email", "uri":
+		default:
+			return nil, fmt.Errorf(`certificate rule "%s": unknown field "%s"`, rule, field)
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf(`certificate rule "%s": %s`, rule, err)
+		}
+
+		mapper.rules = append(mapper.rules, CertRule{Field: field, Pattern: re})
+	}
+
+	return mapper, nil
+}
+
+// User name for the certificate, false when no rule matches
+func (m *CertMapper) User(cert *x509.Certificate) (string, bool) {
+	for _, rule := range m.rules {
+		for _, value := range certValues(cert, rule.Field) {
+			match := rule.Pattern.FindStringSubmatch(value)
+			if match == nil {
+				continue
+			}
+
+			user := match[0]
+			if len(match) > 1 {
+				user = match[1]
+			}
+			if user != "" {
+				return user, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+func certValues(cert *x509.Certificate, field string) []string {
+	switch field {
+	case "cn":
+		return []string{cert.Subject.CommonName}
+	case "dns":
+		return cert.DNSNames
+	case "email":
+		return cert.EmailAddresses
+	case "uri":
+		var uris []string
+		for _, uri := range cert.URIs {
+			uris = append(uris, uri.String())
+		}
+		return uris
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+)
+
+// Compared against when the user is unknown, so a missing user takes as long as a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+// Users is a user store read from a file of "user:bcrypt-hash" lines.
+// Empty lines and lines starting with # are skipped.
+//
+//	# htpasswd -nbB app secret
+//	app:$2y$05$...
+type Users struct {
+	hashes map[string][]byte
+}
+
+// Read the users file
+func LoadUsers(path string) (*Users, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := &Users{hashes: make(map[string][]byte)}
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected \"user:bcrypt-hash\"", path, line)
+		}
+
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, fmt.Errorf("%s:%d: bad bcrypt hash of user %q: %s", path, line, parts[0], err)
+		}
+
+		users.hashes[parts[0]] = []byte(parts[1])
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// Check the password of the user
+func (u *Users) Verify(user string, password string) bool {
+	hash, exists := u.hashes[user]
+	if !exists {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// Number of the users in the store
+func (u *Users) Len() int {
+	return len(u.hashes)
+}
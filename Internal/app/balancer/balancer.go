@@ -0,0 +1,218 @@
+package balancer
+
+import (
+	"fmt"
+	logger "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How the next upstream connection picks its node
+const (
+	RoundRobin       = "round-robin"       // the healthy nodes in turn
+	LeastConnections = "least-connections" // the healthy node with the fewest open connections
+	Priority         = "priority"          // the first healthy node of the list, the others are for failover
+)
+
+// HealthCheck dials every node on an interval and checks the broker answers the AMQP handshake
+type HealthCheck struct {
+	Interval time.Duration // zero disables the checks, every node is then considered up
+	Timeout  time.Duration // for the handshake once the node is dialed
+	Failures int           // consecutive failed checks before the node is marked down
+}
+
+// Balancer spreads the upstream connections over the nodes of a cluster
+type Balancer struct {
+	mu       sync.Mutex
+	nodes    []*node
+	strategy string
+	next     int // round-robin position
+	dial     func(address string) (net.Conn, error)
+	checked  bool // the health checks run
+}
+
+type node struct {
+	address  string
+	active   int // connections open through Dial
+	failures int // consecutive failed health checks
+	down     bool
+	healthy  bool // the last health check passed
+}
+
+func New(addresses []string, strategy string, dial func(address string) (net.Conn, error)) (*Balancer, error) {
+	switch strategy {
+	case RoundRobin, LeastConnections, Priority:
+	default:
+		return nil, fmt.Errorf("unknown balancing strategy %q", strategy)
+	}
+
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no upstream node")
+	}
+
+	b := &Balancer{strategy: strategy, dial: dial}
+	for _, address := range addresses {
+		b.nodes = append(b.nodes, &node{address: address})
+	}
+
+	return b, nil
+}
+
+// Open a connection to a node picked by the strategy, the next ones are tried when it fails.
+// The nodes marked down are tried last, the health checks may not have seen them come back yet.
+func (b *Balancer) Dial() (io.ReadWriteCloser, error) {
+	var lastErr error
+
+	for _, n := range b.candidates() {
+		conn, err := b.dial(n.address)
+		if err != nil {
+			logger.Debug(fmt.Sprintf("Upstream node %s failed: %s", n.address, err.Error()))
+			lastErr = err
+			continue
+		}
+
+		b.mu.Lock()
+		n.active++
+		b.mu.Unlock()
+
+		return &trackedConn{Conn: conn, release: func() {
+			b.mu.Lock()
+			n.active--
+			b.mu.Unlock()
+		}}, nil
+	}
+
+	return nil, lastErr
+}
+
+// Nodes in the order they are tried
+func (b *Balancer) candidates() []*node {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var up, down []*node
+	for _, n := range b.nodes {
+		if n.down {
+			down = append(down, n)
+		} else {
+			up = append(up, n)
+		}
+	}
+
+	switch b.strategy {
+	case RoundRobin:
+		if len(up) > 0 {
+			start := b.next % len(up)
+			b.next++
+			up = append(append([]*node{}, up[start:]...), up[:start]...)
+		}
+
+	case LeastConnections:
+		sort.SliceStable(up, func(i, j int) bool { return up[i].active < up[j].active })
+	}
+
+	return append(up, down...)
+}
+
+// Check the nodes until stop is closed, check runs the handshake on a fresh connection and closes it
+func (b *Balancer) HealthCheck(options HealthCheck, check func(conn io.ReadWriteCloser) error, stop <-chan struct{}) {
+	if options.Interval <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	b.checked = true
+	b.mu.Unlock()
+
+	ticker := time.NewTicker(options.Interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, n := range b.nodes {
+			wg.Add(1)
+			go func(n *node) {
+				defer wg.Done()
+				b.report(n, b.checkNode(n, options.Timeout, check), options.Failures)
+			}(n)
+		}
+		wg.Wait()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *Balancer) checkNode(n *node, timeout time.Duration, check func(conn io.ReadWriteCloser) error) error {
+	conn, err := b.dial(n.address)
+	if err != nil {
+		return err
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	return check(conn)
+}
+
+// Count the failed checks, the node is down after enough of them in a row and up again after a good one
+func (b *Balancer) report(n *node, err error, failures int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n.healthy = err == nil
+
+	if err == nil {
+		if n.down {
+			logger.Info(fmt.Sprintf("Upstream node %s is up", n.address))
+		}
+		n.failures = 0
+		n.down = false
+		return
+	}
+
+	n.failures++
+	logger.Debug(fmt.Sprintf("Health check of upstream node %s failed (%d in a row): %s", n.address, n.failures, err.Error()))
+
+	if !n.down && n.failures >= failures {
+		n.down = true
+		logger.Warn(fmt.Sprintf("Upstream node %s is down after %d failed health checks: %s", n.address, n.failures, err.Error()))
+	}
+}
+
+// Whether a node passed its last health check, without the health checks every node counts as up
+func (b *Balancer) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.checked {
+		return true
+	}
+
+	for _, n := range b.nodes {
+		if n.healthy {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Connection counted in the active connections of its node until it is closed
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
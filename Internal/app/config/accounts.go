@@ -0,0 +1,103 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Account is the service account the upstream connections of the matching clients are opened with,
+// so the clients never know a broker password. The first matching account wins.
+// The patterns are the ones of the routes and match the vhost the client asked for.
+type Account struct {
+	Vhost    string
+	User     string
+	Username string // of the service account
+	Password string
+}
+
+// Read the credentials file, the password is given as is, read from an environment variable or a secret file
+//
+//	# <vhost> <user> <service user> <password|env:NAME|file:PATH>
+//	orders * orders-svc env:ORDERS_SVC_PASSWORD
+//	~^team-.+$ * teams-svc file:/run/secrets/teams-svc
+func loadAccounts(path string) ([]Account, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseAccounts(file, fmt.Sprintf(`credentials file "%s"`, path))
+}
+
+// Read the accounts in the format of the credentials file, source names them in the errors
+func parseAccounts(reader io.Reader, source string) ([]Account, error) {
+	var accounts []Account
+
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) != 4 {
+			return nil, fmt.Errorf(`%s line %d: expected "<vhost> <user> <service user> <password>"`, source, line)
+		}
+
+		password, err := secret(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf(`%s line %d: %s`, source, line, err.Error())
+		}
+
+		accounts = append(accounts, Account{
+			Vhost:    fields[0],
+			User:     fields[1],
+			Username: fields[2],
+			Password: password,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return accounts, nil
+}
+
+// Value of "env:NAME", the content of "file:PATH" without the trailing new line, or the value itself
+func secret(reference string) (string, error) {
+	switch {
+	case strings.HasPrefix(reference, "env:"):
+		name := strings.TrimPrefix(reference, "env:")
+		value, exists := os.LookupEnv(name)
+		if !exists {
+			return "", fmt.Errorf(`environment variable "%s" is not set`, name)
+		}
+		return value, nil
+
+	case strings.HasPrefix(reference, "file:"):
+		content, err := ioutil.ReadFile(strings.TrimPrefix(reference, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	return reference, nil
+}
+
+// Credentials file lines of the accounts, the passwords are masked
+func accountLines(accounts []Account) string {
+	var lines []string
+
+	for _, account := range accounts {
+		lines = append(lines, fmt.Sprintf("%s %s %s %s", account.Vhost, account.User, account.Username, mask(account.Password)))
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -1,51 +1,681 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
-	"github.com/joho/godotenv"
 	logger "github.com/sirupsen/logrus"
-	"os"
+	"net"
 	"strconv"
+	"strings"
+	"time"
 )
 
-// init is invoked before main()
-func init() {
-	// loads values from .env into the system
-	if err := godotenv.Load(); err != nil {
-		logger.Error("No .env file found")
-	}
-}
-
 type Config struct {
 	BindAddr string
 	BindPort int
+	Tune     Tune
 	LogLevel string
+	// "host:port" of the HTTP endpoints like /metrics, they are not served when empty
+	HTTPAddr string
+	Upstream Upstream
+	Pool     Pool
+	Recovery Recovery
+	Spool    Spool
+	Shutdown Shutdown
+	Auth     Auth
+	TLS      TLS
+	// overrides of the broker connection.start properties, "capabilities.name" keys change the capabilities
+	ServerProperties map[string]string
+	// upstreams next to the default one and the routes to them, read from RoutesFile or given inline
+	RoutesFile string
+	Clusters   []Cluster
+	Routes     []Route
+	// service accounts of the upstream connections, read from CredentialsFile or given inline
+	CredentialsFile string
+	Accounts        []Account
+	// header the client user is published with, none when empty
+	IdentityHeader string
+	// "host:port" of the admin API, it is not served when empty
+	AdminAddr string
+}
+
+// Connection to the RabbitMQ broker the clients are relayed to.
+// Empty User or Vhost means the client's own credentials or vhost are used.
+// User, Password and Vhost apply to the default upstream alone, a matching route picks the vhost.
+type Upstream struct {
+	Addresses   []string // "host:port" of the cluster nodes
+	Port        int      // of the nodes given without one
+	Balance     string   // "round-robin", "least-connections" or "priority"
+	HealthCheck HealthCheck
+	User        string
+	Password    string
+	Vhost       string
+	Heartbeat   uint16 // seconds, the clients negotiate their own heartbeat with the proxy
+	TLS         UpstreamTLS
+}
+
+// AMQP handshakes against every node, a node is marked down after Failures of them fail in a row
+type HealthCheck struct {
+	Interval time.Duration // zero disables the checks
+	Timeout  time.Duration
+	Failures int
+}
+
+// Limits a listener offers in connection.tune, they are lowered to the ones of the upstream.
+// Zero means no limit.
+type Tune struct {
+	ChannelMax uint16
+	FrameMax   uint32
+	Heartbeat  uint16 // seconds
+}
+
+// amqps listener, it is started when the certificate is set
+type TLS struct {
+	Port         int
+	Tune         Tune
+	CertFile     string
+	KeyFile      string
+	MinVersion   uint16
+	ClientCAFile string // CA the client certificates are verified with
+	ClientAuth   tls.ClientAuthType
+}
+
+// TLS of the connections to the broker
+type UpstreamTLS struct {
+	Enabled    bool
+	CAFile     string // the only CA the broker certificate may come from, the system roots when empty
+	ServerName string // SNI and the name verified in the certificate, the upstream host when empty
+	MinVersion uint16
+	// client certificate of the proxy. The upstream login stays PLAIN: with EXTERNAL the broker would
+	// take the identity from this certificate, every client would be the same user.
+	CertFile string
+	KeyFile  string
 }
 
-// Create new app config
-func NewConfig() (*Config, error) {
-	proxyHost, exists := os.LookupEnv("PROXY_CONNECTION_HOST")
+// Upstream connections kept open between clients
+type Pool struct {
+	Size        int
+	IdleTimeout time.Duration
+}
+
+// Reconnection to the broker when an upstream connection is lost while a client uses it
+type Recovery struct {
+	Enabled    bool
+	Attempts   int // zero retries until the client leaves
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Disk spool of the messages published while no upstream is reachable, disabled without a directory
+type Spool struct {
+	Dir         string
+	MaxBytes    int64 // of the messages waiting, zero means no limit
+	MaxMessages int   // zero means no limit
+}
+
+// Draining of the clients on SIGTERM or SIGINT
+type Shutdown struct {
+	Delay time.Duration // the readiness fails this long before the listeners close
+	Grace time.Duration // the busy clients have this long to finish, they are closed then
+}
+
+// Client authentication by the proxy.
+// Without a users file any credentials are accepted and the broker checks them.
+type Auth struct {
+	UsersFile string // "user:bcrypt-hash" lines
+	// how the verified client certificates map to user names for EXTERNAL, the common name when empty
+	CertRules string
+}
+
+// Read the config from the parameters
+func (p *parameters) config() (*Config, error) {
+	proxyHost, exists := p.lookup("PROXY_CONNECTION_HOST")
 	if !exists {
-		return nil, fmt.Errorf(`parameter "PROXY_CONNECTION_HOST" not found in .env file`)
+		return nil, fmt.Errorf(`parameter "PROXY_CONNECTION_HOST" is not set`)
 	}
-	proxyPortDraft, exists := os.LookupEnv("PROXY_CONNECTION_PORT")
+	proxyPortDraft, exists := p.lookup("PROXY_CONNECTION_PORT")
 	if !exists {
-		return nil, fmt.Errorf(`parameter "PROXY_CONNECTION_PORT" not found in .env file`)
+		return nil, fmt.Errorf(`parameter "PROXY_CONNECTION_PORT" is not set`)
 	}
 
+	// 0 leaves only the amqps listener
 	proxyPort, err := strconv.Atoi(proxyPortDraft)
 	if err != nil {
 		return nil, fmt.Errorf(`parameter "PROXY_CONNECTION_PORT" must be integer`)
 	}
 
-	logLevel, exists := os.LookupEnv("LOG_LEVEL")
+	logLevel, exists := p.lookup("LOG_LEVEL")
 	if !exists {
 		logLevel = "error"
 	}
+	if _, err := logger.ParseLevel(logLevel); err != nil {
+		return nil, fmt.Errorf(`parameter "LOG_LEVEL" must be one of "panic", "fatal", "error", "warn", "info", "debug", "trace"`)
+	}
+
+	upstream, err := p.newUpstream()
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := p.newPool()
+	if err != nil {
+		return nil, err
+	}
+
+	recovery, err := p.newRecovery()
+	if err != nil {
+		return nil, err
+	}
+
+	spool, err := p.newSpool()
+	if err != nil {
+		return nil, err
+	}
+
+	shutdown, err := p.newShutdown()
+	if err != nil {
+		return nil, err
+	}
+
+	tune, err := p.newTune("PROXY", Tune{ChannelMax: 2047, FrameMax: 131072, Heartbeat: 60})
+	if err != nil {
+		return nil, err
+	}
+
+	listenerTLS, err := p.newTLS(*tune)
+	if err != nil {
+		return nil, err
+	}
+
+	serverProperties, err := p.newServerProperties()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		clusters []Cluster
+		routes   []Route
+	)
+	routesFile, inlineRoutes := p.get("PROXY_ROUTES_FILE"), p.get("PROXY_ROUTES")
+	switch {
+	case routesFile != "" && inlineRoutes != "":
+		return nil, fmt.Errorf(`parameter "PROXY_ROUTES" cannot be set with "PROXY_ROUTES_FILE"`)
+	case routesFile != "":
+		if clusters, routes, err = loadRoutes(routesFile, upstream.Port); err != nil {
+			return nil, err
+		}
+	case inlineRoutes != "":
+		if clusters, routes, err = parseRoutes(strings.NewReader(inlineRoutes), `parameter "PROXY_ROUTES"`, upstream.Port); err != nil {
+			return nil, err
+		}
+	}
+
+	var accounts []Account
+	credentialsFile, inlineAccounts := p.get("PROXY_CREDENTIALS_FILE"), p.get("PROXY_ACCOUNTS")
+	switch {
+	case credentialsFile != "" && inlineAccounts != "":
+		return nil, fmt.Errorf(`parameter "PROXY_ACCOUNTS" cannot be set with "PROXY_CREDENTIALS_FILE"`)
+	case credentialsFile != "":
+		if accounts, err = loadAccounts(credentialsFile); err != nil {
+			return nil, err
+		}
+	case inlineAccounts != "":
+		if accounts, err = parseAccounts(strings.NewReader(inlineAccounts), `parameter "PROXY_ACCOUNTS"`); err != nil {
+			return nil, err
+		}
+	}
+
+	httpAddr := p.get("PROXY_HTTP_ADDR")
+	if httpAddr != "" {
+		if _, _, err := net.SplitHostPort(httpAddr); err != nil {
+			return nil, fmt.Errorf(`parameter "PROXY_HTTP_ADDR" must be "host:port"`)
+		}
+	}
+
+	adminAddr := p.get("PROXY_ADMIN_ADDR")
+	if adminAddr != "" {
+		if _, _, err := net.SplitHostPort(adminAddr); err != nil {
+			return nil, fmt.Errorf(`parameter "PROXY_ADMIN_ADDR" must be "host:port"`)
+		}
+	}
+
+	if proxyPort == 0 && listenerTLS.CertFile == "" {
+		return nil, fmt.Errorf(`parameter "PROXY_CONNECTION_PORT" may be 0 only with "PROXY_TLS_CERT_FILE"`)
+	}
+
+	// the clients authenticated with their certificate have no password to open the upstream connection with
+	if listenerTLS.ClientAuth != tls.NoClientCert && upstream.User == "" && len(accounts) == 0 && !clusterUsers(clusters) {
+		return nil, fmt.Errorf(`parameter "PROXY_TLS_CLIENT_AUTH" needs "RABBITMQ_CONNECTION_USER", upstream users in the routes or service accounts in "PROXY_CREDENTIALS_FILE"`)
+	}
 
 	return &Config{
 		BindAddr: proxyHost,
 		BindPort: proxyPort,
+		Tune:     *tune,
 		LogLevel: logLevel,
+		HTTPAddr: httpAddr,
+		Upstream: *upstream,
+		Pool:     *pool,
+		Recovery: *recovery,
+		Spool:    *spool,
+		Shutdown: *shutdown,
+		Auth: Auth{
+			UsersFile: p.get("PROXY_AUTH_USERS_FILE"),
+			CertRules: p.get("PROXY_AUTH_CERT_RULES"),
+		},
+		TLS:              *listenerTLS,
+		ServerProperties: serverProperties,
+		RoutesFile:       routesFile,
+		Clusters:         clusters,
+		Routes:           routes,
+		CredentialsFile:  credentialsFile,
+		Accounts:         accounts,
+		IdentityHeader:   p.get("PROXY_IDENTITY_HEADER"),
+		AdminAddr:        adminAddr,
 	}, nil
 }
+
+// Read upstream broker connection
+func (p *parameters) newUpstream() (*Upstream, error) {
+	host, exists := p.lookup("RABBITMQ_CONNECTION_HOST")
+	if !exists {
+		return nil, fmt.Errorf(`parameter "RABBITMQ_CONNECTION_HOST" is not set`)
+	}
+	portDraft, exists := p.lookup("RABBITMQ_CONNECTION_PORT")
+	if !exists {
+		return nil, fmt.Errorf(`parameter "RABBITMQ_CONNECTION_PORT" is not set`)
+	}
+
+	port, err := strconv.Atoi(portDraft)
+	if err != nil {
+		return nil, fmt.Errorf(`parameter "RABBITMQ_CONNECTION_PORT" must be integer`)
+	}
+
+	addresses, err := newAddresses(host, port)
+	if err != nil {
+		return nil, fmt.Errorf(`parameter "RABBITMQ_CONNECTION_HOST" %s`, err.Error())
+	}
+
+	balance := p.get("RABBITMQ_BALANCE")
+	if balance == "" {
+		balance = "round-robin"
+	}
+	if !balanceStrategies[balance] {
+		return nil, fmt.Errorf(`parameter "RABBITMQ_BALANCE" must be one of "round-robin", "least-connections", "priority"`)
+	}
+
+	healthCheck, err := p.newHealthCheck()
+	if err != nil {
+		return nil, err
+	}
+
+	user := p.get("RABBITMQ_CONNECTION_USER")
+	password := p.get("RABBITMQ_CONNECTION_PASSWORD")
+	vhost := p.get("RABBITMQ_CONNECTION_VHOST")
+
+	heartbeat := 60
+	if heartbeatDraft, exists := p.lookup("RABBITMQ_CONNECTION_HEARTBEAT"); exists {
+		if heartbeat, err = strconv.Atoi(heartbeatDraft); err != nil || heartbeat < 0 || heartbeat > 65535 {
+			return nil, fmt.Errorf(`parameter "RABBITMQ_CONNECTION_HEARTBEAT" must be integer between 0 and 65535 (seconds)`)
+		}
+	}
+
+	upstreamTLS, err := p.newUpstreamTLS()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Upstream{
+		Addresses:   addresses,
+		Port:        port,
+		Balance:     balance,
+		HealthCheck: *healthCheck,
+		User:        user,
+		Password:    password,
+		Vhost:       vhost,
+		Heartbeat:   uint16(heartbeat),
+		TLS:         *upstreamTLS,
+	}, nil
+}
+
+var balanceStrategies = map[string]bool{
+	"round-robin":       true,
+	"least-connections": true,
+	"priority":          true,
+}
+
+// Read the cluster nodes: "rabbit1, rabbit2:5673, [::1]", the port defaults to RABBITMQ_CONNECTION_PORT
+func newAddresses(hosts string, defaultPort int) ([]string, error) {
+	var addresses []string
+
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+
+		// without a port the host may still be an IPv6 address
+		port := strconv.Itoa(defaultPort)
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			if _, err := strconv.Atoi(p); err != nil {
+				return nil, fmt.Errorf(`has an invalid port in "%s"`, host)
+			}
+			host, port = h, p
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+
+		addresses = append(addresses, net.JoinHostPort(host, port))
+	}
+
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf(`must list at least one node`)
+	}
+
+	return addresses, nil
+}
+
+// Read upstream health check settings
+func (p *parameters) newHealthCheck() (*HealthCheck, error) {
+	healthCheck := &HealthCheck{
+		Interval: 10 * time.Second,
+		Timeout:  5 * time.Second,
+		Failures: 3,
+	}
+
+	if draft, exists := p.lookup("RABBITMQ_HEALTH_CHECK_INTERVAL"); exists {
+		value, err := strconv.Atoi(draft)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf(`parameter "RABBITMQ_HEALTH_CHECK_INTERVAL" must be integer, 0 disables the checks (seconds)`)
+		}
+		healthCheck.Interval = time.Duration(value) * time.Second
+	}
+
+	if draft, exists := p.lookup("RABBITMQ_HEALTH_CHECK_TIMEOUT"); exists {
+		value, err := strconv.Atoi(draft)
+		if err != nil || value < 1 {
+			return nil, fmt.Errorf(`parameter "RABBITMQ_HEALTH_CHECK_TIMEOUT" must be positive integer (seconds)`)
+		}
+		healthCheck.Timeout = time.Duration(value) * time.Second
+	}
+
+	if draft, exists := p.lookup("RABBITMQ_HEALTH_CHECK_FAILURES"); exists {
+		var err error
+		if healthCheck.Failures, err = strconv.Atoi(draft); err != nil || healthCheck.Failures < 1 {
+			return nil, fmt.Errorf(`parameter "RABBITMQ_HEALTH_CHECK_FAILURES" must be positive integer`)
+		}
+	}
+
+	return healthCheck, nil
+}
+
+// Read the server properties overrides: "cluster_name=edge, capabilities.direct_reply_to=false"
+func (p *parameters) newServerProperties() (map[string]string, error) {
+	properties := make(map[string]string)
+
+	for _, pair := range strings.Split(p.get("PROXY_SERVER_PROPERTIES"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf(`parameter "PROXY_SERVER_PROPERTIES" must be a list of "key=value" pairs`)
+		}
+		properties[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return properties, nil
+}
+
+// Read the limits of a listener, the ones not set are taken from defaults
+func (p *parameters) newTune(prefix string, defaults Tune) (*Tune, error) {
+	tune := defaults
+
+	if draft, exists := p.lookup(prefix + "_CHANNEL_MAX"); exists {
+		value, err := strconv.ParseUint(draft, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf(`parameter "%s_CHANNEL_MAX" must be integer between 0 and 65535`, prefix)
+		}
+		tune.ChannelMax = uint16(value)
+	}
+
+	if draft, exists := p.lookup(prefix + "_FRAME_MAX"); exists {
+		value, err := strconv.ParseUint(draft, 10, 32)
+		if err != nil || (value != 0 && value < 4096) {
+			return nil, fmt.Errorf(`parameter "%s_FRAME_MAX" must be 0 or integer not lower than 4096 (bytes)`, prefix)
+		}
+		tune.FrameMax = uint32(value)
+	}
+
+	if draft, exists := p.lookup(prefix + "_HEARTBEAT"); exists {
+		value, err := strconv.ParseUint(draft, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf(`parameter "%s_HEARTBEAT" must be integer between 0 and 65535 (seconds)`, prefix)
+		}
+		tune.Heartbeat = uint16(value)
+	}
+
+	return &tune, nil
+}
+
+// Read amqps listener settings, the limits default to the ones of the plain listener
+func (p *parameters) newTLS(defaultTune Tune) (*TLS, error) {
+	conf := &TLS{
+		Port:         5671,
+		CertFile:     p.get("PROXY_TLS_CERT_FILE"),
+		KeyFile:      p.get("PROXY_TLS_KEY_FILE"),
+		ClientCAFile: p.get("PROXY_TLS_CLIENT_CA_FILE"),
+		ClientAuth:   tls.NoClientCert,
+	}
+
+	if conf.CertFile == "" {
+		return conf, nil
+	}
+	if conf.KeyFile == "" {
+		return nil, fmt.Errorf(`parameter "PROXY_TLS_KEY_FILE" is not set`)
+	}
+
+	tune, err := p.newTune("PROXY_TLS", defaultTune)
+	if err != nil {
+		return nil, err
+	}
+	conf.Tune = *tune
+
+	if portDraft, exists := p.lookup("PROXY_TLS_PORT"); exists {
+		var err error
+		if conf.Port, err = strconv.Atoi(portDraft); err != nil {
+			return nil, fmt.Errorf(`parameter "PROXY_TLS_PORT" must be integer`)
+		}
+	}
+
+	minVersion, err := p.tlsVersion("PROXY_TLS_MIN_VERSION")
+	if err != nil {
+		return nil, err
+	}
+	conf.MinVersion = minVersion
+
+	switch p.get("PROXY_TLS_CLIENT_AUTH") {
+	case "", "none":
+	case "optional":
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf(`parameter "PROXY_TLS_CLIENT_AUTH" must be one of "none", "optional", "require"`)
+	}
+
+	if conf.ClientAuth != tls.NoClientCert && conf.ClientCAFile == "" {
+		return nil, fmt.Errorf(`parameter "PROXY_TLS_CLIENT_CA_FILE" is not set`)
+	}
+
+	return conf, nil
+}
+
+// Read upstream TLS settings
+func (p *parameters) newUpstreamTLS() (*UpstreamTLS, error) {
+	conf := &UpstreamTLS{
+		CAFile:     p.get("RABBITMQ_TLS_CA_FILE"),
+		ServerName: p.get("RABBITMQ_TLS_SERVER_NAME"),
+		CertFile:   p.get("RABBITMQ_TLS_CERT_FILE"),
+		KeyFile:    p.get("RABBITMQ_TLS_KEY_FILE"),
+	}
+
+	if conf.CertFile != "" && conf.KeyFile == "" {
+		return nil, fmt.Errorf(`parameter "RABBITMQ_TLS_KEY_FILE" is not set`)
+	}
+
+	if enabledDraft, exists := p.lookup("RABBITMQ_TLS"); exists && enabledDraft != "" {
+		var err error
+		if conf.Enabled, err = strconv.ParseBool(enabledDraft); err != nil {
+			return nil, fmt.Errorf(`parameter "RABBITMQ_TLS" must be boolean`)
+		}
+	}
+
+	minVersion, err := p.tlsVersion("RABBITMQ_TLS_MIN_VERSION")
+	if err != nil {
+		return nil, err
+	}
+	conf.MinVersion = minVersion
+
+	return conf, nil
+}
+
+// TLS version parameter like "1.2", TLS 1.2 when it is not set
+func (p *parameters) tlsVersion(name string) (uint16, error) {
+	versions := map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	draft := p.get(name)
+	if draft == "" {
+		return tls.VersionTLS12, nil
+	}
+
+	version, exists := versions[draft]
+	if !exists {
+		return 0, fmt.Errorf(`parameter "%s" must be one of "1.0", "1.1", "1.2", "1.3"`, name)
+	}
+
+	return version, nil
+}
+
+// Read upstream connection pool settings
+func (p *parameters) newPool() (*Pool, error) {
+	size := 10
+	if sizeDraft, exists := p.lookup("RABBITMQ_POOL_SIZE"); exists {
+		var err error
+		if size, err = strconv.Atoi(sizeDraft); err != nil || size < 1 {
+			return nil, fmt.Errorf(`parameter "RABBITMQ_POOL_SIZE" must be positive integer`)
+		}
+	}
+
+	idleTimeout := 60
+	if idleTimeoutDraft, exists := p.lookup("RABBITMQ_POOL_IDLE_TIMEOUT"); exists {
+		var err error
+		if idleTimeout, err = strconv.Atoi(idleTimeoutDraft); err != nil || idleTimeout < 1 {
+			return nil, fmt.Errorf(`parameter "RABBITMQ_POOL_IDLE_TIMEOUT" must be positive integer (seconds)`)
+		}
+	}
+
+	return &Pool{
+		Size:        size,
+		IdleTimeout: time.Duration(idleTimeout) * time.Second,
+	}, nil
+}
+
+// Read upstream recovery settings, the backoff doubles from the minimum to the maximum between the attempts
+func (p *parameters) newRecovery() (*Recovery, error) {
+	recovery := &Recovery{
+		Enabled:    true,
+		Attempts:   10,
+		MinBackoff: time.Second,
+		MaxBackoff: 30 * time.Second,
+	}
+
+	if enabledDraft, exists := p.lookup("RABBITMQ_RECOVERY"); exists && enabledDraft != "" {
+		var err error
+		if recovery.Enabled, err = strconv.ParseBool(enabledDraft); err != nil {
+			return nil, fmt.Errorf(`parameter "RABBITMQ_RECOVERY" must be boolean`)
+		}
+	}
+
+	if attemptsDraft, exists := p.lookup("RABBITMQ_RECOVERY_ATTEMPTS"); exists {
+		var err error
+		if recovery.Attempts, err = strconv.Atoi(attemptsDraft); err != nil || recovery.Attempts < 0 {
+			return nil, fmt.Errorf(`parameter "RABBITMQ_RECOVERY_ATTEMPTS" must be integer, 0 for no limit`)
+		}
+	}
+
+	if draft, exists := p.lookup("RABBITMQ_RECOVERY_MIN_BACKOFF"); exists {
+		value, err := strconv.ParseFloat(draft, 64)
+		if err != nil || value <= 0 {
+			return nil, fmt.Errorf(`parameter "RABBITMQ_RECOVERY_MIN_BACKOFF" must be positive number (seconds)`)
+		}
+		recovery.MinBackoff = time.Duration(value * float64(time.Second))
+	}
+
+	if draft, exists := p.lookup("RABBITMQ_RECOVERY_MAX_BACKOFF"); exists {
+		value, err := strconv.ParseFloat(draft, 64)
+		if err != nil || value <= 0 {
+			return nil, fmt.Errorf(`parameter "RABBITMQ_RECOVERY_MAX_BACKOFF" must be positive number (seconds)`)
+		}
+		recovery.MaxBackoff = time.Duration(value * float64(time.Second))
+	}
+
+	if recovery.MaxBackoff < recovery.MinBackoff {
+		return nil, fmt.Errorf(`parameter "RABBITMQ_RECOVERY_MAX_BACKOFF" must not be lower than "RABBITMQ_RECOVERY_MIN_BACKOFF"`)
+	}
+
+	return recovery, nil
+}
+
+// Read the publish spool settings, the limits apply once the directory is set
+func (p *parameters) newSpool() (*Spool, error) {
+	spool := &Spool{
+		Dir:      p.get("PROXY_SPOOL_DIR"),
+		MaxBytes: 1 << 30,
+	}
+
+	if draft, exists := p.lookup("PROXY_SPOOL_MAX_BYTES"); exists && draft != "" {
+		var err error
+		if spool.MaxBytes, err = strconv.ParseInt(draft, 10, 64); err != nil || spool.MaxBytes < 0 {
+			return nil, fmt.Errorf(`parameter "PROXY_SPOOL_MAX_BYTES" must be integer, 0 for no limit (bytes)`)
+		}
+	}
+
+	if draft, exists := p.lookup("PROXY_SPOOL_MAX_MESSAGES"); exists && draft != "" {
+		var err error
+		if spool.MaxMessages, err = strconv.Atoi(draft); err != nil || spool.MaxMessages < 0 {
+			return nil, fmt.Errorf(`parameter "PROXY_SPOOL_MAX_MESSAGES" must be integer, 0 for no limit`)
+		}
+	}
+
+	return spool, nil
+}
+
+// Read the shutdown settings
+func (p *parameters) newShutdown() (*Shutdown, error) {
+	shutdown := &Shutdown{Grace: 30 * time.Second}
+
+	if draft, exists := p.lookup("PROXY_SHUTDOWN_DELAY"); exists && draft != "" {
+		value, err := strconv.ParseFloat(draft, 64)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf(`parameter "PROXY_SHUTDOWN_DELAY" must be number, 0 closes the listeners right away (seconds)`)
+		}
+		shutdown.Delay = time.Duration(value * float64(time.Second))
+	}
+
+	if draft, exists := p.lookup("PROXY_SHUTDOWN_GRACE"); exists && draft != "" {
+		value, err := strconv.ParseFloat(draft, 64)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf(`parameter "PROXY_SHUTDOWN_GRACE" must be number, 0 closes the busy clients right away (seconds)`)
+		}
+		shutdown.Grace = time.Duration(value * float64(time.Second))
+	}
+
+	return shutdown, nil
+}
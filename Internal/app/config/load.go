@@ -0,0 +1,259 @@
+package config
+
+import (
+	"fmt"
+	"github.com/joho/godotenv"
+	logger "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Where the config comes from, the command line fills them
+type Options struct {
+	File string // YAML configuration file, only the environment and .env are read without it
+	// values of the command line flags by setting key
+	Overrides map[string]string
+}
+
+// Parameter values by name from every source, the first source that sets a parameter wins
+type parameters struct {
+	overrides map[string]string
+	file      map[string]string
+	filePath  string
+	dotenv    map[string]string
+}
+
+// Load the config: the command line flags win over the configuration file,
+// the file over the environment and the environment over .env
+func Load(options Options) (*Config, error) {
+	p := &parameters{
+		overrides: make(map[string]string),
+		file:      make(map[string]string),
+		filePath:  options.File,
+	}
+
+	// .env is read on every load, unlike the environment it may change before a reload
+	dotenv, err := godotenv.Read()
+	if err != nil && options.File == "" {
+		logger.Error("No .env file found")
+	}
+	p.dotenv = dotenv
+
+	for key, value := range options.Overrides {
+		s := settingByKey(key)
+		if s == nil {
+			return nil, fmt.Errorf(`unknown setting "%s"`, key)
+		}
+		p.overrides[s.name] = value
+	}
+
+	if options.File != "" {
+		if err := p.readFile(options.File); err != nil {
+			return nil, err
+		}
+	}
+
+	conf, err := p.config()
+	if err != nil {
+		return nil, p.explain(err)
+	}
+
+	return conf, nil
+}
+
+func (p *parameters) lookup(name string) (string, bool) {
+	if value, exists := p.overrides[name]; exists {
+		return value, true
+	}
+	if value, exists := p.file[name]; exists {
+		return value, true
+	}
+
+	return p.environment(name)
+}
+
+func (p *parameters) get(name string) string {
+	value, _ := p.lookup(name)
+	return value
+}
+
+// Variable of the environment or of .env, the configuration file refers to them
+func (p *parameters) environment(name string) (string, bool) {
+	if value, exists := os.LookupEnv(name); exists {
+		return value, true
+	}
+
+	value, exists := p.dotenv[name]
+	return value, exists
+}
+
+var parameterName = regexp.MustCompile(`parameter "([A-Z_]+)"`)
+
+// Tell the setting of the parameter an error is about when it does not come from the environment
+func (p *parameters) explain(err error) error {
+	match := parameterName.FindStringSubmatch(err.Error())
+	if match == nil {
+		return err
+	}
+
+	s := settingByName(match[1])
+	if s == nil {
+		return err
+	}
+	if _, exists := p.overrides[s.name]; exists {
+		return fmt.Errorf(`%s, given by the "-%s" flag`, err.Error(), s.key)
+	}
+	if _, exists := p.file[s.name]; exists {
+		return fmt.Errorf(`%s, given as "%s" in "%s"`, err.Error(), s.key, p.filePath)
+	}
+
+	return err
+}
+
+// Read the settings of the configuration file:
+//
+//	listeners:
+//	  amqp:
+//	    port: 5672
+//	upstream:
+//	  hosts: [rabbit1, rabbit2]
+//	  password: ${RABBITMQ_PASSWORD}
+//	routing:
+//	  server_properties:
+//	    cluster_name: edge
+//	  routes:
+//	    - upstream teams rabbit-b1,rabbit-b2
+//	    - route ~team-(.+) * teams $1
+//
+// The lists are joined with commas and the mappings of a setting are "key=value" lists.
+// The lists of routes and accounts are the lines of the routes and credentials files.
+// "${NAME}" in a value is the variable of the environment, "${NAME:-default}" falls back to default, "$$" is "$".
+func (p *parameters) readFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return fmt.Errorf(`configuration file "%s": %s`, path, err.Error())
+	}
+
+	// an empty file sets nothing
+	if len(root.Content) == 0 {
+		return nil
+	}
+	if err := p.walk(root.Content[0], ""); err != nil {
+		return fmt.Errorf(`configuration file "%s": %s`, path, err.Error())
+	}
+
+	return nil
+}
+
+func (p *parameters) walk(node *yaml.Node, path string) error {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	if s := settingByKey(path); s != nil {
+		value, err := p.value(node, s.separator())
+		if err != nil {
+			return fmt.Errorf(`line %d: "%s" %s`, node.Line, path, err.Error())
+		}
+		p.file[s.name] = value
+		return nil
+	}
+
+	if node.Kind != yaml.MappingNode {
+		if path == "" {
+			return fmt.Errorf(`line %d: must be a mapping of the settings`, node.Line)
+		}
+		return fmt.Errorf(`line %d: unknown setting "%s"`, node.Line, path)
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i].Value
+		if path != "" {
+			key = path + "." + key
+		}
+		if err := p.walk(node.Content[i+1], key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Parameter value of a setting node, the items of a list are joined with the separator
+func (p *parameters) value(node *yaml.Node, separator string) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return "", nil
+		}
+		return p.interpolate(node.Value)
+
+	case yaml.SequenceNode:
+		var items []string
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", fmt.Errorf(`must list plain values`)
+			}
+			value, err := p.interpolate(item.Value)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, value)
+		}
+		return strings.Join(items, separator), nil
+
+	case yaml.MappingNode:
+		var pairs []string
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i+1].Kind != yaml.ScalarNode {
+				return "", fmt.Errorf(`must map keys to plain values`)
+			}
+			value, err := p.interpolate(node.Content[i+1].Value)
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, node.Content[i].Value+"="+value)
+		}
+		return strings.Join(pairs, ", "), nil
+	}
+
+	return "", fmt.Errorf(`must be a value, a list or a mapping`)
+}
+
+var variable = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// Replace the variables in a value, a variable that is not set and has no default is an error
+func (p *parameters) interpolate(value string) (string, error) {
+	var err error
+
+	value = variable.ReplaceAllStringFunc(value, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+
+		groups := variable.FindStringSubmatch(match)
+		name, hasDefault, fallback := groups[1], groups[2] != "", groups[3]
+
+		// like the shell, the default replaces an empty value too
+		if value, exists := p.environment(name); exists && (value != "" || !hasDefault) {
+			return value
+		}
+		if hasDefault {
+			return fallback
+		}
+		if err == nil {
+			err = fmt.Errorf(`refers to "%s" which is not set`, name)
+		}
+		return ""
+	})
+
+	return value, err
+}
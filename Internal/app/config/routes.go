@@ -0,0 +1,179 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Upstream name of the nodes of RABBITMQ_CONNECTION_HOST, the clients no route matches go there
+const DefaultUpstream = "default"
+
+// Cluster is an upstream next to the default one, the routes send clients to it.
+// It shares the TLS and the health check settings of the default upstream, never its credentials.
+type Cluster struct {
+	Name      string
+	Addresses []string // "host:port" of the nodes
+	Balance   string
+	User      string // of the upstream connections, the client's own when empty
+	Password  string
+}
+
+// Route sends the clients of a vhost and user to an upstream, the first matching route wins.
+// The patterns are exact, glob ("team-*") or a regular expression starting with "~",
+// which matches the whole value.
+type Route struct {
+	Vhost    string
+	User     string
+	Upstream string
+	// vhost opened on the upstream, the client's one when empty. "$1" refers to a group of the vhost regular expression.
+	RewriteVhost string
+}
+
+// Cluster of the name, nil when there is none
+func (c *Config) Cluster(name string) *Cluster {
+	for i := range c.Clusters {
+		if c.Clusters[i].Name == name {
+			return &c.Clusters[i]
+		}
+	}
+
+	return nil
+}
+
+// Whether an upstream of the routes has its own user
+func (c *Config) ClusterUsers() bool {
+	return clusterUsers(c.Clusters)
+}
+
+func clusterUsers(clusters []Cluster) bool {
+	for _, cluster := range clusters {
+		if cluster.User != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Read the routes file, the upstream lines define the clusters the route lines refer to
+//
+//	# upstream <name> <host[:port],...> [round-robin|least-connections|priority] [user=<user> password=<password|env:NAME|file:PATH>]
+//	upstream teams rabbit-b1,rabbit-b2
+//	upstream billing rabbit-c1 priority user=billing-svc password=env:BILLING_SVC_PASSWORD
+//	# route <vhost> <user> <upstream> [<upstream vhost>]
+//	route orders * teams prod-orders
+//	route ~^team-(.+)$ * teams $1
+func loadRoutes(path string, defaultPort int) ([]Cluster, []Route, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	return parseRoutes(file, fmt.Sprintf(`routes file "%s"`, path), defaultPort)
+}
+
+// Read the routes in the format of the routes file, source names them in the errors
+func parseRoutes(reader io.Reader, source string, defaultPort int) ([]Cluster, []Route, error) {
+	var (
+		clusters []Cluster
+		routes   []Route
+	)
+	names := map[string]bool{DefaultUpstream: true}
+
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "upstream":
+			if len(fields) < 3 {
+				return nil, nil, fmt.Errorf(`%s line %d: expected "upstream <name> <host[:port],...> [balance] [user=<user> password=<password>]"`, source, line)
+			}
+			if names[fields[1]] {
+				return nil, nil, fmt.Errorf(`%s line %d: upstream "%s" is already defined`, source, line, fields[1])
+			}
+
+			addresses, err := newAddresses(fields[2], defaultPort)
+			if err != nil {
+				return nil, nil, fmt.Errorf(`%s line %d: nodes %s`, source, line, err.Error())
+			}
+
+			cluster := Cluster{Name: fields[1], Addresses: addresses, Balance: "round-robin"}
+			options := fields[3:]
+			if len(options) > 0 && !strings.Contains(options[0], "=") {
+				cluster.Balance, options = options[0], options[1:]
+			}
+			if !balanceStrategies[cluster.Balance] {
+				return nil, nil, fmt.Errorf(`%s line %d: balance must be one of "round-robin", "least-connections", "priority"`, source, line)
+			}
+
+			for _, option := range options {
+				parts := strings.SplitN(option, "=", 2)
+				switch {
+				case len(parts) == 2 && parts[0] == "user":
+					cluster.User = parts[1]
+				case len(parts) == 2 && parts[0] == "password":
+					if cluster.Password, err = secret(parts[1]); err != nil {
+						return nil, nil, fmt.Errorf(`%s line %d: password %s`, source, line, err.Error())
+					}
+				default:
+					return nil, nil, fmt.Errorf(`%s line %d: unknown upstream option "%s", expected "user=" or "password="`, source, line, option)
+				}
+			}
+			if cluster.User == "" && cluster.Password != "" {
+				return nil, nil, fmt.Errorf(`%s line %d: password is given without a user`, source, line)
+			}
+
+			names[fields[1]] = true
+			clusters = append(clusters, cluster)
+
+		case "route":
+			if len(fields) < 4 || len(fields) > 5 {
+				return nil, nil, fmt.Errorf(`%s line %d: expected "route <vhost> <user> <upstream> [<upstream vhost>]"`, source, line)
+			}
+			if !names[fields[3]] {
+				return nil, nil, fmt.Errorf(`%s line %d: upstream "%s" is not defined above`, source, line, fields[3])
+			}
+
+			route := Route{Vhost: fields[1], User: fields[2], Upstream: fields[3]}
+			if len(fields) == 5 {
+				route.RewriteVhost = fields[4]
+			}
+			routes = append(routes, route)
+
+		default:
+			return nil, nil, fmt.Errorf(`%s line %d: unknown directive "%s"`, source, line, fields[0])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return clusters, routes, nil
+}
+
+// Routes file lines of the clusters and the routes
+func routeLines(clusters []Cluster, routes []Route) string {
+	var lines []string
+
+	for _, cluster := range clusters {
+		line := fmt.Sprintf("upstream %s %s %s", cluster.Name, strings.Join(cluster.Addresses, ","), cluster.Balance)
+		if cluster.User != "" {
+			line += fmt.Sprintf(" user=%s password=%s", cluster.User, mask(cluster.Password))
+		}
+		lines = append(lines, line)
+	}
+	for _, route := range routes {
+		lines = append(lines, strings.TrimSpace(fmt.Sprintf("route %s %s %s %s", route.Vhost, route.User, route.Upstream, route.RewriteVhost)))
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,237 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"gopkg.in/yaml.v3"
+	"strings"
+	"time"
+)
+
+// Setting is a parameter as the configuration file and the command line name it
+type setting struct {
+	key   string // path in the configuration file, the flag has the same name
+	name  string // parameter of the environment and .env
+	usage string
+	// value in the effective configuration
+	value func(c *Config) interface{}
+}
+
+// Every setting in the order of the effective configuration
+var settings = []setting{
+	{"log_level", "LOG_LEVEL", "level of the log: error, warn, info, debug", func(c *Config) interface{} { return c.LogLevel }},
+
+	{"listeners.bind", "PROXY_CONNECTION_HOST", "host the AMQP listeners bind to", func(c *Config) interface{} { return c.BindAddr }},
+	{"listeners.amqp.port", "PROXY_CONNECTION_PORT", "port of the AMQP listener, 0 leaves only amqps", func(c *Config) interface{} { return c.BindPort }},
+	{"listeners.amqp.channel_max", "PROXY_CHANNEL_MAX", "channels offered to the clients, 0 for no limit", func(c *Config) interface{} { return c.Tune.ChannelMax }},
+	{"listeners.amqp.frame_max", "PROXY_FRAME_MAX", "frame size offered to the clients (bytes), 0 for no limit", func(c *Config) interface{} { return c.Tune.FrameMax }},
+	{"listeners.amqp.heartbeat", "PROXY_HEARTBEAT", "heartbeat offered to the clients (seconds)", func(c *Config) interface{} { return c.Tune.Heartbeat }},
+	{"listeners.amqps.port", "PROXY_TLS_PORT", "port of the AMQPS listener", func(c *Config) interface{} { return c.TLS.Port }},
+	{"listeners.amqps.cert_file", "PROXY_TLS_CERT_FILE", "certificate of the AMQPS listener, it is started when set", func(c *Config) interface{} { return c.TLS.CertFile }},
+	{"listeners.amqps.key_file", "PROXY_TLS_KEY_FILE", "key of the certificate", func(c *Config) interface{} { return c.TLS.KeyFile }},
+	{"listeners.amqps.min_version", "PROXY_TLS_MIN_VERSION", "lowest TLS version: 1.0, 1.1, 1.2, 1.3", func(c *Config) interface{} { return versionName(c.TLS.MinVersion) }},
+	{"listeners.amqps.client_auth", "PROXY_TLS_CLIENT_AUTH", "client certificates: none, optional, require. Their users need the upstream user or service accounts", func(c *Config) interface{} { return clientAuthName(c.TLS.ClientAuth) }},
+	{"listeners.amqps.client_ca_file", "PROXY_TLS_CLIENT_CA_FILE", "CA the client certificates are verified with", func(c *Config) interface{} { return c.TLS.ClientCAFile }},
+	{"listeners.amqps.channel_max", "PROXY_TLS_CHANNEL_MAX", "channels offered to the AMQPS clients", func(c *Config) interface{} { return c.TLS.Tune.ChannelMax }},
+	{"listeners.amqps.frame_max", "PROXY_TLS_FRAME_MAX", "frame size offered to the AMQPS clients (bytes)", func(c *Config) interface{} { return c.TLS.Tune.FrameMax }},
+	{"listeners.amqps.heartbeat", "PROXY_TLS_HEARTBEAT", "heartbeat offered to the AMQPS clients (seconds)", func(c *Config) interface{} { return c.TLS.Tune.Heartbeat }},
+	{"listeners.http", "PROXY_HTTP_ADDR", `"host:port" of /metrics, /healthz and /readyz`, func(c *Config) interface{} { return c.HTTPAddr }},
+	{"listeners.admin", "PROXY_ADMIN_ADDR", `"host:port" of the admin API`, func(c *Config) interface{} { return c.AdminAddr }},
+
+	{"upstream.hosts", "RABBITMQ_CONNECTION_HOST", "nodes of the broker cluster: rabbit1,rabbit2:5673", func(c *Config) interface{} { return c.Upstream.Addresses }},
+	{"upstream.port", "RABBITMQ_CONNECTION_PORT", "port of the nodes given without one", func(c *Config) interface{} { return c.Upstream.Port }},
+	{"upstream.balance", "RABBITMQ_BALANCE", "node choice: round-robin, least-connections, priority", func(c *Config) interface{} { return c.Upstream.Balance }},
+	{"upstream.user", "RABBITMQ_CONNECTION_USER", "user of the default upstream connections, the client's own when empty", func(c *Config) interface{} { return c.Upstream.User }},
+	{"upstream.password", "RABBITMQ_CONNECTION_PASSWORD", "password of the upstream user", func(c *Config) interface{} { return mask(c.Upstream.Password) }},
+	{"upstream.vhost", "RABBITMQ_CONNECTION_VHOST", "vhost of the default upstream connections when no route matches, the client's own when empty", func(c *Config) interface{} { return c.Upstream.Vhost }},
+	{"upstream.heartbeat", "RABBITMQ_CONNECTION_HEARTBEAT", "heartbeat of the upstream connections (seconds)", func(c *Config) interface{} { return c.Upstream.Heartbeat }},
+	{"upstream.health_check.interval", "RABBITMQ_HEALTH_CHECK_INTERVAL", "seconds between the node checks, 0 disables them", func(c *Config) interface{} { return seconds(c.Upstream.HealthCheck.Interval) }},
+	{"upstream.health_check.timeout", "RABBITMQ_HEALTH_CHECK_TIMEOUT", "seconds a node check may take", func(c *Config) interface{} { return seconds(c.Upstream.HealthCheck.Timeout) }},
+	{"upstream.health_check.failures", "RABBITMQ_HEALTH_CHECK_FAILURES", "failed checks in a row that mark a node down", func(c *Config) interface{} { return c.Upstream.HealthCheck.Failures }},
+	{"upstream.tls.enabled", "RABBITMQ_TLS", "connect to the broker with TLS", func(c *Config) interface{} { return c.Upstream.TLS.Enabled }},
+	{"upstream.tls.ca_file", "RABBITMQ_TLS_CA_FILE", "CA of the broker certificate, the system roots when empty", func(c *Config) interface{} { return c.Upstream.TLS.CAFile }},
+	{"upstream.tls.server_name", "RABBITMQ_TLS_SERVER_NAME", "name verified in the broker certificate", func(c *Config) interface{} { return c.Upstream.TLS.ServerName }},
+	{"upstream.tls.min_version", "RABBITMQ_TLS_MIN_VERSION", "lowest TLS version: 1.0, 1.1, 1.2, 1.3", func(c *Config) interface{} { return versionName(c.Upstream.TLS.MinVersion) }},
+	{"upstream.tls.cert_file", "RABBITMQ_TLS_CERT_FILE", "client certificate of the proxy, the upstream login stays PLAIN", func(c *Config) interface{} { return c.Upstream.TLS.CertFile }},
+	{"upstream.tls.key_file", "RABBITMQ_TLS_KEY_FILE", "key of the proxy certificate", func(c *Config) interface{} { return c.Upstream.TLS.KeyFile }},
+	{"upstream.recovery.enabled", "RABBITMQ_RECOVERY", "reconnect the clients when their upstream connection is lost", func(c *Config) interface{} { return c.Recovery.Enabled }},
+	{"upstream.recovery.attempts", "RABBITMQ_RECOVERY_ATTEMPTS", "reconnection attempts, 0 for no limit", func(c *Config) interface{} { return c.Recovery.Attempts }},
+	{"upstream.recovery.min_backoff", "RABBITMQ_RECOVERY_MIN_BACKOFF", "seconds before the first attempt", func(c *Config) interface{} { return seconds(c.Recovery.MinBackoff) }},
+	{"upstream.recovery.max_backoff", "RABBITMQ_RECOVERY_MAX_BACKOFF", "most seconds between the attempts", func(c *Config) interface{} { return seconds(c.Recovery.MaxBackoff) }},
+
+	{"auth.users_file", "PROXY_AUTH_USERS_FILE", `"user:bcrypt-hash" lines the clients are checked against`, func(c *Config) interface{} { return c.Auth.UsersFile }},
+	{"auth.cert_rules", "PROXY_AUTH_CERT_RULES", "how the client certificates map to user names", func(c *Config) interface{} { return c.Auth.CertRules }},
+	{"auth.credentials_file", "PROXY_CREDENTIALS_FILE", "service accounts of the upstream connections", func(c *Config) interface{} { return c.CredentialsFile }},
+	{"auth.accounts", "PROXY_ACCOUNTS", "lines of the credentials file given inline instead of it", func(c *Config) interface{} { return inline(c.CredentialsFile, accountLines(c.Accounts)) }},
+	{"auth.identity_header", "PROXY_IDENTITY_HEADER", "header the client user is published with", func(c *Config) interface{} { return c.IdentityHeader }},
+
+	{"routing.routes_file", "PROXY_ROUTES_FILE", "upstreams next to the default one and the routes to them", func(c *Config) interface{} { return c.RoutesFile }},
+	{"routing.routes", "PROXY_ROUTES", "lines of the routes file given inline instead of it", func(c *Config) interface{} { return inline(c.RoutesFile, routeLines(c.Clusters, c.Routes)) }},
+	{"routing.server_properties", "PROXY_SERVER_PROPERTIES", `overrides of the broker properties: "cluster_name=edge"`, func(c *Config) interface{} { return c.ServerProperties }},
+
+	{"limits.pool.size", "RABBITMQ_POOL_SIZE", "upstream connections per user and vhost", func(c *Config) interface{} { return c.Pool.Size }},
+	{"limits.pool.idle_timeout", "RABBITMQ_POOL_IDLE_TIMEOUT", "seconds an idle upstream connection is kept", func(c *Config) interface{} { return seconds(c.Pool.IdleTimeout) }},
+	{"limits.spool.max_bytes", "PROXY_SPOOL_MAX_BYTES", "bytes waiting in the spool, 0 for no limit", func(c *Config) interface{} { return c.Spool.MaxBytes }},
+	{"limits.spool.max_messages", "PROXY_SPOOL_MAX_MESSAGES", "messages waiting in the spool, 0 for no limit", func(c *Config) interface{} { return c.Spool.MaxMessages }},
+
+	{"spool.dir", "PROXY_SPOOL_DIR", "directory of the spool, the messages are not spooled when empty", func(c *Config) interface{} { return c.Spool.Dir }},
+	{"shutdown.delay", "PROXY_SHUTDOWN_DELAY", "seconds the readiness fails before the listeners close", func(c *Config) interface{} { return seconds(c.Shutdown.Delay) }},
+	{"shutdown.grace", "PROXY_SHUTDOWN_GRACE", "seconds the busy clients have to finish", func(c *Config) interface{} { return seconds(c.Shutdown.Grace) }},
+}
+
+// The inline routes and accounts list lines, the other lists are joined with commas
+func (s *setting) separator() string {
+	if s.key == "routing.routes" || s.key == "auth.accounts" {
+		return "\n"
+	}
+
+	return ", "
+}
+
+func settingByKey(key string) *setting {
+	for i := range settings {
+		if settings[i].key == key {
+			return &settings[i]
+		}
+	}
+
+	return nil
+}
+
+func settingByName(name string) *setting {
+	for i := range settings {
+		if settings[i].name == name {
+			return &settings[i]
+		}
+	}
+
+	return nil
+}
+
+// Register -config and a flag for each setting, they fill the options
+func (o *Options) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&o.File, "config", "", "YAML configuration file")
+
+	for _, s := range settings {
+		flags.Var(&override{options: o, key: s.key}, s.key, s.usage+" ("+s.name+")")
+	}
+}
+
+// Flag of a setting
+type override struct {
+	options *Options
+	key     string
+}
+
+func (o *override) String() string {
+	if o.options == nil {
+		return ""
+	}
+
+	return o.options.Overrides[o.key]
+}
+
+func (o *override) Set(value string) error {
+	if o.options.Overrides == nil {
+		o.options.Overrides = make(map[string]string)
+	}
+	o.options.Overrides[o.key] = value
+
+	return nil
+}
+
+// Effective config as a configuration file, the passwords are masked.
+// The amqps settings are left out while the listener is not started.
+func (c *Config) YAML() ([]byte, error) {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+
+	for _, s := range settings {
+		if c.TLS.CertFile == "" && strings.HasPrefix(s.key, "listeners.amqps.") && s.key != "listeners.amqps.cert_file" {
+			continue
+		}
+
+		value := &yaml.Node{}
+		if err := value.Encode(s.value(c)); err != nil {
+			return nil, err
+		}
+
+		path := strings.Split(s.key, ".")
+		parent := root
+		for _, key := range path[:len(path)-1] {
+			parent = child(parent, key)
+		}
+		parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: path[len(path)-1]}, value)
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(root); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// Mapping under the key, it is added when missing
+func child(parent *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(parent.Content); i += 2 {
+		if parent.Content[i].Value == key {
+			return parent.Content[i+1]
+		}
+	}
+
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, node)
+
+	return node
+}
+
+// Lines given inline, nothing when they come from a file
+func inline(file string, lines string) string {
+	if file != "" {
+		return ""
+	}
+
+	return lines
+}
+
+func mask(secret string) string {
+	if secret == "" {
+		return ""
+	}
+
+	return "********"
+}
+
+func seconds(d time.Duration) float64 {
+	return d.Seconds()
+}
+
+func versionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS13:
+		return "1.3"
+	}
+
+	return "1.2"
+}
+
+func clientAuthName(clientAuth tls.ClientAuthType) string {
+	switch clientAuth {
+	case tls.VerifyClientCertIfGiven:
+		return "optional"
+	case tls.RequireAndVerifyClientCert:
+		return "require"
+	}
+
+	return "none"
+}
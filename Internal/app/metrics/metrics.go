@@ -0,0 +1,269 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds the metric families and writes them in the Prometheus text format
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string // "counter", "gauge" or "histogram"
+	labels  []string
+	buckets []float64 // of the histograms
+	series  sync.Map  // by joined label values
+	// collect reports the values read on scrape, the family has no series of its own then
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.families = append(r.families, f)
+	return f
+}
+
+// Counter only goes up
+type Counter struct {
+	labelValues []string
+	value       uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Gauge goes up and down
+type Gauge struct {
+	labelValues []string
+	value       int64
+}
+
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.value, 1)
+}
+
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.value, -1)
+}
+
+func (g *Gauge) Set(value int64) {
+	atomic.StoreInt64(&g.value, value)
+}
+
+// Histogram counts the observations in cumulative buckets
+type Histogram struct {
+	labelValues []string
+	buckets     []float64
+	counts      []uint64 // by bucket, the last one is +Inf
+	count       uint64
+	sum         uint64 // float64 bits
+}
+
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + value)
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			return
+		}
+	}
+}
+
+type CounterVec struct{ f *family }
+type GaugeVec struct{ f *family }
+type HistogramVec struct{ f *family }
+
+func (r *Registry) Counter(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.add(&family{name: name, help: help, kind: "counter", labels: labels})}
+}
+
+func (r *Registry) Gauge(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.add(&family{name: name, help: help, kind: "gauge", labels: labels})}
+}
+
+// The buckets are the upper bounds in increasing order, +Inf is added
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{r.add(&family{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})}
+}
+
+// Counter read on scrape from somewhere else
+func (r *Registry) CounterFunc(name string, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	r.add(&family{name: name, help: help, kind: "counter", labels: labels, collect: collect})
+}
+
+// Gauge read on scrape from somewhere else
+func (r *Registry) GaugeFunc(name string, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	r.add(&family{name: name, help: help, kind: "gauge", labels: labels, collect: collect})
+}
+
+// Series of the label values, given in the order of the labels
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	key := v.f.key(labelValues)
+	if c, ok := v.f.series.Load(key); ok {
+		return c.(*Counter)
+	}
+	c, _ := v.f.series.LoadOrStore(key, &Counter{labelValues: labelValues})
+	return c.(*Counter)
+}
+
+func (v *GaugeVec) With(labelValues ...string) *Gauge {
+	key := v.f.key(labelValues)
+	if g, ok := v.f.series.Load(key); ok {
+		return g.(*Gauge)
+	}
+	g, _ := v.f.series.LoadOrStore(key, &Gauge{labelValues: labelValues})
+	return g.(*Gauge)
+}
+
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	key := v.f.key(labelValues)
+	if h, ok := v.f.series.Load(key); ok {
+		return h.(*Histogram)
+	}
+	h, _ := v.f.series.LoadOrStore(key, &Histogram{
+		labelValues: labelValues,
+		buckets:     v.f.buckets,
+		counts:      make([]uint64, len(v.f.buckets)+1),
+	})
+	return h.(*Histogram)
+}
+
+func (f *family) key(labelValues []string) string {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, %d values given", f.name, len(f.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// Handler serves the metrics to the Prometheus scrapes
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// Write the metrics in the text exposition format, the series sorted by their labels
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family{}, r.families...)
+	r.mu.Unlock()
+
+	out := bufio.NewWriter(w)
+
+	for _, f := range families {
+		fmt.Fprintf(out, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(out, "# TYPE %s %s\n", f.name, f.kind)
+
+		// the lines of a series, sorted by its labels
+		var groups [][]string
+
+		if f.collect != nil {
+			f.collect(func(value float64, labelValues ...string) {
+				groups = append(groups, []string{f.name + labelString(f.labels, labelValues, "", "") + " " + formatValue(value)})
+			})
+		}
+
+		f.series.Range(func(_, series interface{}) bool {
+			switch s := series.(type) {
+			case *Counter:
+				groups = append(groups, []string{f.name + labelString(f.labels, s.labelValues, "", "") + " " + strconv.FormatUint(atomic.LoadUint64(&s.value), 10)})
+			case *Gauge:
+				groups = append(groups, []string{f.name + labelString(f.labels, s.labelValues, "", "") + " " + strconv.FormatInt(atomic.LoadInt64(&s.value), 10)})
+			case *Histogram:
+				groups = append(groups, s.lines(f))
+			}
+			return true
+		})
+
+		sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+		for _, lines := range groups {
+			for _, line := range lines {
+				out.WriteString(line)
+				out.WriteByte('\n')
+			}
+		}
+	}
+
+	return out.Flush()
+}
+
+// Bucket, sum and count lines of a histogram, they sort together by their labels
+func (h *Histogram) lines(f *family) []string {
+	labels := labelString(f.labels, h.labelValues, "", "")
+
+	lines := make([]string, 0, len(h.counts)+2)
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		bound := "+Inf"
+		if i < len(h.buckets) {
+			bound = formatValue(h.buckets[i])
+		}
+		lines = append(lines, fmt.Sprintf("%s_bucket%s %d", f.name, labelString(f.labels, h.labelValues, "le", bound), cumulative))
+	}
+	lines = append(lines, fmt.Sprintf("%s_sum%s %s", f.name, labels, formatValue(math.Float64frombits(atomic.LoadUint64(&h.sum)))))
+	lines = append(lines, fmt.Sprintf("%s_count%s %d", f.name, labels, atomic.LoadUint64(&h.count)))
+
+	return lines
+}
+
+// {name="value",...} with an extra label when its name is given, empty without any label
+func labelString(names []string, values []string, extraName string, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escape(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+escape(extraValue)+`"`)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(value string) string {
+	return escaper.Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,244 @@
+package proxyserver
+
+import (
+	"encoding/json"
+	"fmt"
+	logger "github.com/sirupsen/logrus"
+	"github.com/sv-z/amqproxy/Internal/ampq"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reply text of the connections closed by the admin API without a reason
+const defaultCloseReason = "closed by the proxy admin"
+
+// Client connection as the admin API sees it
+type client struct {
+	id        string
+	listener  string
+	remote    string
+	upstream  string
+	connected time.Time
+	conn      *ampq.Connection
+	metrics   *connMetrics
+}
+
+// Live client connections by id
+type clients struct {
+	mu   sync.RWMutex
+	byId map[string]*client
+}
+
+func newClients() *clients {
+	return &clients{byId: make(map[string]*client)}
+}
+
+func (c *clients) add(cl *client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.byId[cl.id] = cl
+}
+
+func (c *clients) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.byId, id)
+}
+
+func (c *clients) get(id string) (*client, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	cl, exists := c.byId[id]
+	return cl, exists
+}
+
+// Clients of the user and vhost in the order they connected, an empty filter matches any
+func (c *clients) list(user string, vhost string) []*client {
+	c.mu.RLock()
+	var list []*client
+	for _, cl := range c.byId {
+		if (user == "" || cl.conn.User == user) && (vhost == "" || cl.conn.VirtualHost == vhost) {
+			list = append(list, cl)
+		}
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].connected.Before(list[j].connected) })
+	return list
+}
+
+type connectionInfo struct {
+	Id               string           `json:"id"`
+	Listener         string           `json:"listener"`
+	RemoteAddress    string           `json:"remote_address"`
+	User             string           `json:"user"`
+	Mechanism        string           `json:"auth_mechanism"`
+	Vhost            string           `json:"vhost"`
+	Upstream         string           `json:"upstream"`
+	ConnectedAt      time.Time        `json:"connected_at"`
+	ClientProperties clientProperties `json:"client_properties"`
+	Tune             tuneInfo         `json:"tune"`
+	Channels         []channelInfo    `json:"channels"`
+	BytesIn          uint64           `json:"bytes_in"`
+	BytesOut         uint64           `json:"bytes_out"`
+}
+
+type clientProperties struct {
+	Product        string `json:"product,omitempty"`
+	Version        string `json:"version,omitempty"`
+	ConnectionName string `json:"connection_name,omitempty"`
+}
+
+type tuneInfo struct {
+	ChannelMax uint16 `json:"channel_max"`
+	FrameMax   uint32 `json:"frame_max"`
+	Heartbeat  uint16 `json:"heartbeat"`
+}
+
+type channelInfo struct {
+	Id              uint16   `json:"id"`
+	UpstreamChannel uint16   `json:"upstream_channel"`
+	Consumers       []string `json:"consumers"`
+}
+
+func (cl *client) info() connectionInfo {
+	properties := cl.conn.ClientProperties
+	product, _ := properties["product"].(string)
+	version, _ := properties["version"].(string)
+	name, _ := properties["connection_name"].(string)
+
+	consumers := cl.conn.Consumers()
+	channels := []channelInfo{}
+	for id, upstream := range cl.conn.Channels() {
+		tags := consumers[id]
+		if tags == nil {
+			tags = []string{}
+		}
+		channels = append(channels, channelInfo{Id: id, UpstreamChannel: upstream, Consumers: tags})
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Id < channels[j].Id })
+
+	return connectionInfo{
+		Id:               cl.id,
+		Listener:         cl.listener,
+		RemoteAddress:    cl.remote,
+		User:             cl.conn.User,
+		Mechanism:        cl.conn.Mechanism,
+		Vhost:            cl.conn.VirtualHost,
+		Upstream:         cl.upstream,
+		ConnectedAt:      cl.connected,
+		ClientProperties: clientProperties{Product: product, Version: version, ConnectionName: name},
+		Tune: tuneInfo{
+			ChannelMax: cl.conn.Tune.ChannelMax,
+			FrameMax:   cl.conn.Tune.FrameMax,
+			Heartbeat:  cl.conn.Tune.Heartbeat,
+		},
+		Channels: channels,
+		BytesIn:  atomic.LoadUint64(&cl.metrics.bytesIn),
+		BytesOut: atomic.LoadUint64(&cl.metrics.bytesOut),
+	}
+}
+
+// Serve the admin API until the listener is closed:
+//
+//	GET    /connections?user=&vhost=   live connections, filtered by user and vhost
+//	GET    /connections/{id}           one connection
+//	DELETE /connections/{id}           close the connection
+//	DELETE /connections?user=&vhost=   close the connections of the user and/or vhost
+//
+// The X-Reason header of DELETE is the reply text of connection.close.
+func (s *server) serveAdmin(l net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", s.adminConnections)
+	mux.HandleFunc("/connections/", s.adminConnection)
+
+	adminServer := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if err := adminServer.Serve(l); err != nil && err != http.ErrServerClosed {
+		logger.Debug(fmt.Sprintf("Admin API stopped: %s", err.Error()))
+	}
+}
+
+func (s *server) adminConnections(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	vhost := r.URL.Query().Get("vhost")
+
+	switch r.Method {
+	case http.MethodGet:
+		list := []connectionInfo{}
+		for _, cl := range s.clients.list(user, vhost) {
+			list = append(list, cl.info())
+		}
+		writeJSON(w, http.StatusOK, list)
+
+	case http.MethodDelete:
+		// closing every client takes more than a missing filter
+		if user == "" && vhost == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": `"user" or "vhost" must be given`})
+			return
+		}
+
+		list := s.clients.list(user, vhost)
+		reason := closeReason(r)
+		for _, cl := range list {
+			cl.conn.Kill(reason)
+		}
+		logger.Info(fmt.Sprintf("Admin closed %d connections of user %q vhost %q: %s", len(list), user, vhost, reason))
+		writeJSON(w, http.StatusOK, map[string]int{"closed": len(list)})
+
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+func (s *server) adminConnection(w http.ResponseWriter, r *http.Request) {
+	cl, exists := s.clients.get(strings.TrimPrefix(r.URL.Path, "/connections/"))
+	if !exists {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "connection not found"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, cl.info())
+
+	case http.MethodDelete:
+		reason := closeReason(r)
+		cl.conn.Kill(reason)
+		logger.Info(fmt.Sprintf("Admin closed connection [%s] of user %q vhost %q: %s", cl.id, cl.conn.User, cl.conn.VirtualHost, reason))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+func closeReason(r *http.Request) string {
+	if reason := strings.TrimSpace(r.Header.Get("X-Reason")); reason != "" {
+		return reason
+	}
+
+	return defaultCloseReason
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Debug(fmt.Sprintf("Cannot write the admin response: %s", err.Error()))
+	}
+}
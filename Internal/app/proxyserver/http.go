@@ -0,0 +1,80 @@
+package proxyserver
+
+import (
+	"fmt"
+	logger "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Serve the HTTP endpoints until the listener is closed
+func (s *server) serveHTTP(l net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.registry.Handler())
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+
+	httpServer := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if err := httpServer.Serve(l); err != nil && err != http.ErrServerClosed {
+		logger.Debug(fmt.Sprintf("HTTP server stopped: %s", err.Error()))
+	}
+}
+
+// The process is alive and every listener accepts the clients
+func (s *server) healthz(w http.ResponseWriter, _ *http.Request) {
+	var problems []string
+	for _, l := range s.listeners {
+		if atomic.LoadInt32(&l.failing) != 0 {
+			problems = append(problems, fmt.Sprintf("listener %s is not accepting", l.name))
+		}
+	}
+
+	writeProbe(w, problems)
+}
+
+// The clients can be served: an upstream answered the health check, the spool has room and the proxy is not draining
+func (s *server) readyz(w http.ResponseWriter, _ *http.Request) {
+	var problems []string
+
+	if atomic.LoadInt32(&s.draining) != 0 {
+		problems = append(problems, "draining")
+	}
+
+	var down []string
+	for name, nodes := range s.upstreams {
+		if !nodes.Ready() {
+			down = append(down, name)
+		}
+	}
+	if len(down) == len(s.upstreams) {
+		sort.Strings(down)
+		problems = append(problems, fmt.Sprintf("no upstream reachable (%s)", strings.Join(down, ", ")))
+	}
+
+	if sp := s.currentSpool(); sp != nil && sp.Full() {
+		problems = append(problems, "spool full")
+	}
+
+	writeProbe(w, problems)
+}
+
+// 200 with "ok", 503 with the problems one by line
+func writeProbe(w http.ResponseWriter, problems []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,216 @@
+package proxyserver
+
+import (
+	"fmt"
+	"github.com/sv-z/amqproxy/Internal/ampq"
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+	"github.com/sv-z/amqproxy/Internal/app/metrics"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the upstream dial latency buckets (seconds)
+var dialBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Series of the proxy, labelled by the listener of the client and by the upstream
+type serverMetrics struct {
+	registry          *metrics.Registry
+	accepted          *metrics.CounterVec
+	active            *metrics.GaugeVec
+	handshakeFailures *metrics.CounterVec
+	frames            *metrics.CounterVec
+	bytes             *metrics.CounterVec
+	methods           *metrics.CounterVec
+	published         *metrics.CounterVec
+	delivered         *metrics.CounterVec
+	dialDuration      *metrics.HistogramVec
+	dialFailures      *metrics.CounterVec
+	shutdownClosed    *metrics.Counter
+	shutdownForced    *metrics.Counter
+}
+
+func newServerMetrics() *serverMetrics {
+	r := metrics.NewRegistry()
+
+	return &serverMetrics{
+		registry:          r,
+		accepted:          r.Counter("amqproxy_connections_accepted_total", "Client connections accepted.", "listener"),
+		active:            r.Gauge("amqproxy_connections_active", "Client connections open.", "listener"),
+		handshakeFailures: r.Counter("amqproxy_handshake_failures_total", "Client connections closed before connection.open-ok.", "listener", "reason"),
+		frames:            r.Counter("amqproxy_frames_total", "Frames exchanged with the clients.", "listener", "direction", "type"),
+		bytes:             r.Counter("amqproxy_bytes_total", "Frame payload bytes exchanged with the clients.", "listener", "direction", "type"),
+		methods:           r.Counter("amqproxy_methods_total", "Methods exchanged with the clients.", "listener", "direction", "method"),
+		published:         r.Counter("amqproxy_messages_published_total", "Messages the clients published.", "listener", "vhost", "upstream"),
+		delivered:         r.Counter("amqproxy_messages_delivered_total", "Messages delivered to the clients.", "listener", "vhost", "upstream"),
+		dialDuration:      r.Histogram("amqproxy_upstream_dial_duration_seconds", "Time to open the TCP (and TLS) connection to an upstream node.", dialBuckets, "upstream"),
+		dialFailures:      r.Counter("amqproxy_upstream_dial_failures_total", "Upstream node connections that could not be opened.", "upstream"),
+		shutdownClosed:    r.Counter("amqproxy_shutdown_connections_closed_total", "Client connections closed while draining.").With(),
+		shutdownForced:    r.Counter("amqproxy_shutdown_connections_forced_total", "Client connections closed when the shutdown grace period ran out.").With(),
+	}
+}
+
+// Shutdown state read on scrape
+func (m *serverMetrics) watchShutdown(s *server) {
+	m.registry.GaugeFunc("amqproxy_shutdown_draining", "1 while the proxy drains the clients before exiting.", nil, func(emit func(float64, ...string)) {
+		emit(float64(atomic.LoadInt32(&s.draining)))
+	})
+}
+
+// Pool gauges read on scrape
+func (m *serverMetrics) watchPools(pools map[string]*ampq.Pool) {
+	m.registry.GaugeFunc("amqproxy_upstream_connections", "Upstream connections by state.", []string{"upstream", "state"}, func(emit func(float64, ...string)) {
+		for name, pool := range pools {
+			open, idle := pool.Stats()
+			emit(float64(open-idle), name, "in_use")
+			emit(float64(idle), name, "idle")
+		}
+	})
+}
+
+// Spool series read on scrape
+func (m *serverMetrics) watchSpool(s *server) {
+	m.registry.GaugeFunc("amqproxy_spool_messages", "Messages waiting in the spool.", nil, func(emit func(float64, ...string)) {
+		if sp := s.currentSpool(); sp != nil {
+			emit(float64(sp.Stats().Messages))
+		}
+	})
+	m.registry.GaugeFunc("amqproxy_spool_bytes", "Bytes waiting in the spool.", nil, func(emit func(float64, ...string)) {
+		if sp := s.currentSpool(); sp != nil {
+			emit(float64(sp.Stats().Bytes))
+		}
+	})
+	m.registry.CounterFunc("amqproxy_spool_messages_total", "Messages the spool took in, forwarded and rejected.", []string{"state"}, func(emit func(float64, ...string)) {
+		sp := s.currentSpool()
+		if sp == nil {
+			return
+		}
+		stats := sp.Stats()
+		emit(float64(stats.Stored), "stored")
+		emit(float64(stats.Forwarded), "forwarded")
+		emit(float64(stats.Rejected), "rejected")
+	})
+}
+
+// Dial of the nodes of an upstream, timed
+func (m *serverMetrics) timedDial(upstream string, dial func(address string) (net.Conn, error)) func(address string) (net.Conn, error) {
+	duration := m.dialDuration.With(upstream)
+	failures := m.dialFailures.With(upstream)
+
+	return func(address string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(address)
+		if err != nil {
+			failures.Inc()
+			return nil, err
+		}
+		duration.Observe(time.Since(start).Seconds())
+
+		return conn, nil
+	}
+}
+
+var frameTypes = []string{
+	spec091.FrameMethod:    "method",
+	spec091.FrameHeader:    "header",
+	spec091.FrameBody:      "body",
+	spec091.FrameHeartbeat: "heartbeat",
+}
+
+var directions = [2]string{"in", "out"}
+
+// Counters of one client connection, resolved once so the frames only add to them
+type connMetrics struct {
+	server   *serverMetrics
+	listener string
+	frames   [2][]*metrics.Counter // by direction and frame type
+	bytes    [2][]*metrics.Counter
+	methods  sync.Map     // *metrics.Counter by direction and method ids
+	messages atomic.Value // *messageCounters once the upstream is known
+	// payload bytes of this connection by direction, updated atomically
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+type messageCounters struct {
+	published *metrics.Counter
+	delivered *metrics.Counter
+}
+
+func (m *serverMetrics) connection(listener string) *connMetrics {
+	c := &connMetrics{server: m, listener: listener}
+
+	for d, direction := range directions {
+		c.frames[d] = make([]*metrics.Counter, len(frameTypes))
+		c.bytes[d] = make([]*metrics.Counter, len(frameTypes))
+		for t, name := range frameTypes {
+			if name == "" {
+				continue
+			}
+			c.frames[d][t] = m.frames.With(listener, direction, name)
+			c.bytes[d][t] = m.bytes.With(listener, direction, name)
+		}
+	}
+
+	return c
+}
+
+// Count the messages of the client against its vhost and upstream.
+// Nothing is published or delivered before, the channels are opened through the upstream.
+func (c *connMetrics) routed(vhost string, upstream string) {
+	c.messages.Store(&messageCounters{
+		published: c.server.published.With(c.listener, vhost, upstream),
+		delivered: c.server.delivered.With(c.listener, vhost, upstream),
+	})
+}
+
+func (c *connMetrics) observe(out bool, frame *spec091.Frame) {
+	d := 0
+	if out {
+		d = 1
+	}
+
+	if out {
+		atomic.AddUint64(&c.bytesOut, uint64(len(frame.Payload)))
+	} else {
+		atomic.AddUint64(&c.bytesIn, uint64(len(frame.Payload)))
+	}
+
+	if int(frame.Type) < len(frameTypes) && c.frames[d][frame.Type] != nil {
+		c.frames[d][frame.Type].Inc()
+		c.bytes[d][frame.Type].Add(uint64(len(frame.Payload)))
+	}
+
+	classId, methodId, ok := frame.MethodId()
+	if !ok {
+		return
+	}
+	c.method(d, classId, methodId).Inc()
+
+	messages, _ := c.messages.Load().(*messageCounters)
+	if messages == nil {
+		return
+	}
+	switch {
+	case !out && classId == 60 && methodId == 40: // basic.publish
+		messages.published.Inc()
+	case out && classId == 60 && (methodId == 60 || methodId == 71): // basic.deliver, basic.get-ok
+		messages.delivered.Inc()
+	}
+}
+
+func (c *connMetrics) method(d int, classId uint16, methodId uint16) *metrics.Counter {
+	key := uint64(d)<<32 | uint64(classId)<<16 | uint64(methodId)
+	if counter, ok := c.methods.Load(key); ok {
+		return counter.(*metrics.Counter)
+	}
+
+	name := spec091.MethodName(classId, methodId)
+	if name == "" {
+		name = fmt.Sprintf("%d.%d", classId, methodId)
+	}
+
+	counter, _ := c.methods.LoadOrStore(key, c.server.methods.With(c.listener, directions[d], name))
+	return counter.(*metrics.Counter)
+}
@@ -1,40 +1,317 @@
 package proxyserver
 
 import (
+	"crypto/tls"
 	"fmt"
 	guuid "github.com/google/uuid"
 	logger "github.com/sirupsen/logrus"
 	"github.com/sv-z/amqproxy/Internal/ampq"
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+	"github.com/sv-z/amqproxy/Internal/app/auth"
+	"github.com/sv-z/amqproxy/Internal/app/balancer"
 	"github.com/sv-z/amqproxy/Internal/app/config"
+	"io"
 	"net"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-// Start server
-func Start(conf *config.Config) *error {
+// How long the broker has to accept the TCP connection
+const upstreamDialTimeout = 10 * time.Second
+
+// Start server, SIGHUP applies the reloadable sections of the config reload reads
+func Start(conf *config.Config, reload func() (*config.Config, error)) *error {
 	setLoggerLevel(conf)
 
-	address := fmt.Sprintf("%s:%d", conf.BindAddr, conf.BindPort)
-	// Listen for incoming connections.
-	listener, err := net.Listen("tcp", address)
+	// stops the certificate reloads
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// sockets of systemd or of the process this one upgraded
+	inherited, err := inheritedSockets()
+	if err != nil {
+		return &err
+	}
+
+	var (
+		listeners []*listener
+		sockets   []socket
+	)
+	// Close the listeners when the application closes.
+	defer func() {
+		for _, sock := range sockets {
+			sock.listener.Close()
+		}
+	}()
+	// the inherited sockets the configuration has no listener for anymore
+	defer func() {
+		for _, l := range inherited {
+			l.Close()
+		}
+	}()
+
+	if conf.BindPort != 0 {
+		address := fmt.Sprintf("%s:%d", conf.BindAddr, conf.BindPort)
+		// Listen for incoming connections.
+		tcpListener, err := listen(inherited, "amqp", address)
+		if err != nil {
+			return &err
+		}
+		sockets = append(sockets, socket{name: "amqp", listener: tcpListener})
+		listeners = append(listeners, &listener{Listener: tcpListener, name: "amqp"})
+		logger.Info(fmt.Sprintf(`Listening on tcp: "%s"`, address))
+	}
+
+	if conf.TLS.CertFile != "" {
+		tlsConf, err := newServerTLS(conf.TLS, stop)
+		if err != nil {
+			return &err
+		}
+
+		address := net.JoinHostPort(conf.BindAddr, strconv.Itoa(conf.TLS.Port))
+		tcpListener, err := listen(inherited, "amqps", address)
+		if err != nil {
+			return &err
+		}
+		sockets = append(sockets, socket{name: "amqps", listener: tcpListener})
+		listeners = append(listeners, &listener{Listener: tls.NewListener(tcpListener, tlsConf), name: "amqps"})
+		logger.Info(fmt.Sprintf(`Listening on tls: "%s"`, address))
+	}
+
+	current, err := newPolicy(conf)
 	if err != nil {
 		return &err
 	}
 
-	// Close the listener when the application closes.
-	defer listener.Close()
-	logger.Info(fmt.Sprintf(`Listening on tcp: "%s"`, address))
+	dial := func(address string) (net.Conn, error) {
+		return net.DialTimeout("tcp", address, upstreamDialTimeout)
+	}
+	if conf.Upstream.TLS.Enabled {
+		if dial, err = newUpstreamTLSDialer(conf.Upstream, stop); err != nil {
+			return &err
+		}
+	}
+
+	serverMetrics := newServerMetrics()
+
+	// one pool for each cluster, the default one serves the clients no route matches
+	pools := map[string]*ampq.Pool{}
+	upstreams := map[string]*balancer.Balancer{}
+	defer func() {
+		for _, pool := range pools {
+			pool.Close()
+		}
+	}()
+
+	clusters := append([]config.Cluster{{
+		Name:      config.DefaultUpstream,
+		Addresses: conf.Upstream.Addresses,
+		Balance:   conf.Upstream.Balance,
+	}}, conf.Clusters...)
+
+	for _, cluster := range clusters {
+		pool, nodes, err := newUpstreamPool(conf, cluster, serverMetrics.timedDial(cluster.Name, dial), stop)
+		if err != nil {
+			return &err
+		}
+		pools[cluster.Name] = pool
+		upstreams[cluster.Name] = nodes
+	}
+
+	srv := &server{
+		pools:     pools,
+		upstreams: upstreams,
+		listeners: listeners,
+		metrics:   serverMetrics,
+		clients:   newClients(),
+	}
+	srv.policy.Store(current)
+	serverMetrics.watchPools(pools)
+	serverMetrics.watchShutdown(srv)
+
+	if conf.Spool.Dir != "" {
+		if err := srv.openSpool(stop); err != nil {
+			return &err
+		}
+		serverMetrics.watchSpool(srv)
+	}
+
+	if conf.HTTPAddr != "" {
+		httpListener, err := listen(inherited, "http", conf.HTTPAddr)
+		if err != nil {
+			return &err
+		}
+		sockets = append(sockets, socket{name: "http", listener: httpListener})
+		logger.Info(fmt.Sprintf(`Serving HTTP on "%s"`, conf.HTTPAddr))
+		go srv.serveHTTP(httpListener)
+	}
+
+	if conf.AdminAddr != "" {
+		adminListener, err := listen(inherited, "admin", conf.AdminAddr)
+		if err != nil {
+			return &err
+		}
+		sockets = append(sockets, socket{name: "admin", listener: adminListener})
+		logger.Info(fmt.Sprintf(`Serving the admin API on "%s"`, conf.AdminAddr))
+		go srv.serveAdmin(adminListener)
+	}
+	srv.sockets = sockets
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append([]os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP}, upgradeSignals...)...)
+	defer signal.Stop(signals)
+
+	var serving sync.WaitGroup
+	for _, l := range listeners {
+		serving.Add(1)
+		go func(l *listener) {
+			defer serving.Done()
+			srv.serve(l)
+		}(l)
+	}
+
+	// the process this one upgraded drains its clients from now on
+	notifyUpgraded()
+
+	for {
+		sig := <-signals
+		if sig == syscall.SIGHUP {
+			srv.reloadOn(sig, reload)
+			continue
+		}
+
+		if !isUpgradeSignal(sig) {
+			ignoreUpgrades()
+			srv.shutdown(sig, srv.current().conf.Shutdown.Delay, signals, reload, &serving)
+			return nil
+		}
+
+		if err := srv.upgrade(); err != nil {
+			logger.Error(fmt.Sprintf("Upgrade on %s failed, this process keeps serving: %s", sig, err.Error()))
+			continue
+		}
+
+		// the new process answers the probes and the admin requests
+		for _, sock := range sockets {
+			if sock.name == "http" || sock.name == "admin" {
+				sock.listener.Close()
+			}
+		}
+		ignoreUpgrades()
+		srv.shutdown(sig, 0, signals, reload, &serving)
+		return nil
+	}
+}
+
+// Pool of the connections to the nodes of a cluster, checked on the health check interval
+func newUpstreamPool(conf *config.Config, cluster config.Cluster, dial func(address string) (net.Conn, error), stop <-chan struct{}) (*ampq.Pool, *balancer.Balancer, error) {
+	nodes, err := balancer.New(cluster.Addresses, cluster.Balance, dial)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the configured user opens a real connection, otherwise connection.start has to come.
+	// The user is the one of the default upstream, the other clusters may not know it.
+	var credentials ampq.Credentials
+	if cluster.Name == config.DefaultUpstream {
+		credentials = ampq.Credentials{
+			User:     conf.Upstream.User,
+			Password: conf.Upstream.Password,
+			Vhost:    conf.Upstream.Vhost,
+		}
+	}
+
+	go nodes.HealthCheck(
+		balancer.HealthCheck{
+			Interval: conf.Upstream.HealthCheck.Interval,
+			Timeout:  conf.Upstream.HealthCheck.Timeout,
+			Failures: conf.Upstream.HealthCheck.Failures,
+		},
+		func(conn io.ReadWriteCloser) error {
+			return ampq.Check(conn, credentials)
+		},
+		stop,
+	)
+
+	return ampq.NewPool(
+		nodes.Dial,
+		ampq.PoolOptions{
+			MaxSize:     conf.Pool.Size,
+			IdleTimeout: conf.Pool.IdleTimeout,
+		},
+	), nodes, nil
+}
+
+// Listener of the clients
+type listener struct {
+	net.Listener
+	name string // "amqp" or "amqps", the label of its metrics
+	// set while Accept fails, updated atomically
+	failing int32
+}
+
+// What the connections of all the listeners share
+type server struct {
+	pools     map[string]*ampq.Pool         // by upstream name
+	upstreams map[string]*balancer.Balancer // nodes of the pools, by upstream name
+	listeners []*listener
+	sockets   []socket     // listening, handed to the new process on an upgrade
+	policy    atomic.Value // *policy, replaced by the reload
+	spool     atomic.Value // *spool.Spool, unset when the messages are not spooled
+	metrics   *serverMetrics
+	clients   *clients
+	// set once the shutdown begins, the readiness fails from then on
+	draining int32
+	// the client connections being handled
+	handlers sync.WaitGroup
+}
 
+// Accept the clients of the listener until it is closed by the shutdown
+func (s *server) serve(l *listener) {
 	for {
-		conn, err := listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
+			if atomic.LoadInt32(&s.draining) != 0 {
+				return
+			}
+			atomic.StoreInt32(&l.failing, 1)
 			logger.Warn(fmt.Sprintf(`Error accepting: %s`, err.Error()))
 			continue
 		}
+		atomic.StoreInt32(&l.failing, 0)
 
-		go handleRequest(conn)
+		s.handlers.Add(1)
+		go s.handleRequest(conn, l)
 	}
 }
 
+// Check the clients against the users file when it is configured
+func newAuthenticator(conf *config.Config) (ampq.Authenticator, error) {
+	if conf.Auth.UsersFile == "" {
+		// the broker never sees the credentials of these clients, logged as an error so the default level shows it
+		if conf.Upstream.User != "" {
+			logger.Error(fmt.Sprintf(`No users file: any client is accepted and relayed as upstream user %q. Set "PROXY_AUTH_USERS_FILE" to authenticate the clients`, conf.Upstream.User))
+		} else if len(conf.Accounts) > 0 || conf.ClusterUsers() {
+			logger.Error(`No users file: any client matching a service account or routed to an upstream with a user is accepted and relayed with those credentials. Set "PROXY_AUTH_USERS_FILE" to authenticate the clients`)
+		}
+		return ampq.NewPasswordAuthenticator(nil), nil
+	}
+
+	users, err := auth.LoadUsers(conf.Auth.UsersFile)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info(fmt.Sprintf(`Loaded %d users from "%s"`, users.Len(), conf.Auth.UsersFile))
+
+	return ampq.NewPasswordAuthenticator(users), nil
+}
+
 // Set mail logger level
 func setLoggerLevel(conf *config.Config) {
 	level, err := logger.ParseLevel(conf.LogLevel)
@@ -47,18 +324,205 @@ func setLoggerLevel(conf *config.Config) {
 }
 
 // Handle request
-func handleRequest(conn net.Conn) {
+func (s *server) handleRequest(conn net.Conn, l *listener) {
 	requestId := guuid.New().String()
+	// the client keeps the config it connected with, a reload applies to the next ones
+	p := s.current()
+	tune := p.tune(l)
+
+	defer s.handlers.Done()
+
+	s.metrics.accepted.With(l.name).Inc()
+	active := s.metrics.active.With(l.name)
+	active.Inc()
+	defer active.Dec()
+	defer func() {
+		if atomic.LoadInt32(&s.draining) != 0 {
+			s.metrics.shutdownClosed.Inc()
+		}
+	}()
 
 	logger.Debug(fmt.Sprintf("----- ==== Start connection [%s] ==== -----", requestId))
 	defer func() {
+		conn.Close()
 		logger.Debug(fmt.Sprintf("----- ==== Stop connection [%s] ==== -----", requestId))
 	}()
 
-	ampqConn := ampq.NewConnection(conn)
+	authenticator := p.authenticator
+	certUser, verified, err := certificateUser(conn, p.certs)
+	if err != nil {
+		logger.Debug(fmt.Sprintf("TLS handshake [%s] failed: %s", requestId, err.Error()))
+		s.metrics.handshakeFailures.With(l.name, "tls").Inc()
+		return
+	}
+	if verified {
+		authenticator = ampq.NewExternalAuthenticator(authenticator, certUser)
+	}
+
+	ampqConn := ampq.NewConnection(conn, authenticator)
+	connMetrics := s.metrics.connection(l.name)
+	ampqConn.Observe(connMetrics.observe)
+
+	// the upstream is known only after connection.open, the default one speaks for all of them until then
+	defaultPool := s.pools[config.DefaultUpstream]
+	upstreamProperties, err := defaultPool.ServerProperties()
+	if err != nil {
+		logger.Warn(fmt.Sprintf("Cannot read upstream server properties: %s", err.Error()))
+	}
+	ampqConn.ServerProperties = ampq.ServerProperties(upstreamProperties, p.conf.ServerProperties)
+
+	// the client cannot be offered more than the upstream connections accept
+	offer := ampq.Tune{ChannelMax: tune.ChannelMax, FrameMax: tune.FrameMax, Heartbeat: tune.Heartbeat}
+	if upstreamTune, known := defaultPool.Tune(); known {
+		offer = offer.Clamp(upstreamTune)
+	}
+	ampqConn.Offer = offer
+
+	// the handshake closes the connection with the reply code itself
 	if err := ampqConn.Open(); err != nil {
 		logger.Error(err)
+		s.metrics.handshakeFailures.With(l.name, ampq.HandshakeFailure(err)).Inc()
 		return
 	}
+	defer ampqConn.Close()
 	logger.Debug(fmt.Sprintf("----- ==== AMPQ Connected [%s] ==== -----", requestId))
+	logger.Info(fmt.Sprintf("Client [%s] %s connected as user %q (%s) on vhost %q", requestId, conn.RemoteAddr(), ampqConn.User, ampqConn.Mechanism, ampqConn.VirtualHost))
+	defer logger.Info(fmt.Sprintf("Client [%s] %s user %q vhost %q disconnected", requestId, conn.RemoteAddr(), ampqConn.User, ampqConn.VirtualHost))
+
+	// a bug in one connection must not take the whole proxy down
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error(fmt.Sprintf("Connection [%s] panic: %v\n%s", requestId, r, debug.Stack()))
+			ampqConn.CloseWithError(spec091.NewError(spec091.InternalError, "internal proxy error"))
+		}
+	}()
+
+	// the upstream connections are opened with the listener limits, so they can serve any of its clients
+	limits := ampq.Tune{
+		ChannelMax: tune.ChannelMax,
+		FrameMax:   tune.FrameMax,
+		Heartbeat:  p.conf.Upstream.Heartbeat,
+	}
+
+	ampqConn.IdentityHeader = p.conf.IdentityHeader
+
+	upstreamName, credentials, err := p.route(ampqConn)
+	if err != nil {
+		logger.Error(err)
+		ampqConn.CloseWithError(err)
+		return
+	}
+	connMetrics.routed(ampqConn.VirtualHost, upstreamName)
+
+	s.clients.add(&client{
+		id:        requestId,
+		listener:  l.name,
+		remote:    conn.RemoteAddr().String(),
+		upstream:  upstreamName,
+		connected: time.Now(),
+		conn:      ampqConn,
+		metrics:   connMetrics,
+	})
+	defer s.clients.remove(requestId)
+
+	// the shutdown listed the clients before this one was added
+	if atomic.LoadInt32(&s.draining) != 0 {
+		ampqConn.Drain(shutdownReason)
+	}
+	pool := s.pools[upstreamName]
+	upstream, err := pool.Acquire(credentials, ampqConn.ClientProperties, limits)
+	if err != nil {
+		logger.Error(err)
+		// the broker's refusal is passed to the client as is
+		if _, ok := err.(*spec091.Error); !ok {
+			if sp := s.currentSpool(); s.spoolable(sp, credentials) {
+				if err := s.spoolClient(sp, ampqConn, upstreamName, credentials); err != nil {
+					logger.Debug(fmt.Sprintf("Spool [%s] of user %q stopped: %s", requestId, ampqConn.User, err.Error()))
+					ampqConn.CloseWithError(err)
+				}
+				return
+			}
+			err = spec091.NewError(spec091.ConnectionForced, "upstream connection failed")
+		}
+		ampqConn.CloseWithError(err)
+		return
+	}
+	// the relay may replace the upstream, the last one goes back to the pool
+	defer func() {
+		if upstream != nil {
+			pool.Release(upstream)
+		}
+	}()
+	logger.Debug(fmt.Sprintf("----- ==== Upstream Connected [%s] ==== -----", requestId))
+
+	var recovery *ampq.Recovery
+	if p.conf.Recovery.Enabled {
+		recovery = &ampq.Recovery{
+			Reconnect: func() (*ampq.Upstream, error) {
+				return pool.Acquire(credentials, ampqConn.ClientProperties, limits)
+			},
+			Discard:    pool.Release,
+			Attempts:   p.conf.Recovery.Attempts,
+			MinBackoff: p.conf.Recovery.MinBackoff,
+			MaxBackoff: p.conf.Recovery.MaxBackoff,
+		}
+	}
+
+	if upstream, err = ampq.Relay(ampqConn, upstream, recovery); err != nil {
+		logger.Debug(fmt.Sprintf("Relay [%s] of user %q stopped: %s", requestId, ampqConn.User, err.Error()))
+		ampqConn.CloseWithError(err)
+	}
+}
+
+// Name and credentials of the upstream the routes pick for the client's vhost and user.
+// A service account matching the client replaces the credentials.
+// A client authenticated with its certificate has no password to pass, it needs configured credentials.
+func (p *policy) route(conn *ampq.Connection) (string, ampq.Credentials, error) {
+	upstream, vhost, matched := p.router.Route(conn.VirtualHost, conn.User)
+	if !matched {
+		upstream = config.DefaultUpstream
+	}
+
+	credentials, configured := upstreamCredentials(p.conf, upstream, conn)
+	// the vhost of the route, the client's one unless the route rewrites it
+	if matched {
+		credentials.Vhost = vhost
+	}
+
+	if username, password, matched := p.accounts.Lookup(conn.VirtualHost, conn.User); matched {
+		credentials.User = username
+		credentials.Password = password
+	} else if conn.Mechanism == "EXTERNAL" && !configured {
+		return "", credentials, spec091.NewError(spec091.AccessRefused, "no upstream credentials for user '%s' authenticated with a certificate", conn.User)
+	}
+
+	logger.Debug(fmt.Sprintf("User %q vhost %q relayed to upstream %q vhost %q as user %q", conn.User, conn.VirtualHost, upstream, credentials.Vhost, credentials.User))
+
+	return upstream, credentials, nil
+}
+
+// Credentials configured for the upstream, the client's own ones when they are not set.
+// The settings of the default upstream apply to it alone, the clusters have their own user.
+func upstreamCredentials(conf *config.Config, upstream string, conn *ampq.Connection) (credentials ampq.Credentials, configured bool) {
+	credentials = ampq.Credentials{
+		User:     conn.User,
+		Password: conn.Password(),
+		Vhost:    conn.VirtualHost,
+	}
+
+	user, password := "", ""
+	if upstream == config.DefaultUpstream {
+		user, password = conf.Upstream.User, conf.Upstream.Password
+		if conf.Upstream.Vhost != "" {
+			credentials.Vhost = conf.Upstream.Vhost
+		}
+	} else if cluster := conf.Cluster(upstream); cluster != nil {
+		user, password = cluster.User, cluster.Password
+	}
+
+	if user != "" {
+		credentials.User, credentials.Password = user, password
+	}
+
+	return credentials, user != ""
 }
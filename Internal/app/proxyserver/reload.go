@@ -0,0 +1,159 @@
+package proxyserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	logger "github.com/sirupsen/logrus"
+	"github.com/sv-z/amqproxy/Internal/ampq"
+	"github.com/sv-z/amqproxy/Internal/app/auth"
+	"github.com/sv-z/amqproxy/Internal/app/config"
+	"github.com/sv-z/amqproxy/Internal/app/routing"
+	"os"
+	"reflect"
+)
+
+// What a client reads when it connects, the reload replaces it.
+// conf keeps the sections that are not reloadable as they were at the start.
+type policy struct {
+	conf          *config.Config
+	router        *routing.Router
+	accounts      *routing.Accounts
+	authenticator ampq.Authenticator
+	certs         *auth.CertMapper // nil when the client certificates are not verified
+}
+
+func newPolicy(conf *config.Config) (*policy, error) {
+	authenticator, err := newAuthenticator(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// EXTERNAL is offered only when the client certificates are verified
+	var certs *auth.CertMapper
+	if conf.TLS.CertFile != "" && conf.TLS.ClientAuth != tls.NoClientCert {
+		if certs, err = auth.NewCertMapper(conf.Auth.CertRules); err != nil {
+			return nil, err
+		}
+	}
+
+	var rules []routing.Rule
+	for _, route := range conf.Routes {
+		rules = append(rules, routing.Rule{
+			Vhost:        route.Vhost,
+			User:         route.User,
+			Upstream:     route.Upstream,
+			RewriteVhost: route.RewriteVhost,
+		})
+	}
+	router, err := routing.NewRouter(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	var serviceAccounts []routing.Account
+	for _, account := range conf.Accounts {
+		serviceAccounts = append(serviceAccounts, routing.Account{
+			Vhost:    account.Vhost,
+			User:     account.User,
+			Username: account.Username,
+			Password: account.Password,
+		})
+	}
+	accounts, err := routing.NewAccounts(serviceAccounts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy{
+		conf:          conf,
+		router:        router,
+		accounts:      accounts,
+		authenticator: authenticator,
+		certs:         certs,
+	}, nil
+}
+
+// Limits the listener offers to its clients
+func (p *policy) tune(l *listener) config.Tune {
+	if l.name == "amqps" {
+		return p.conf.TLS.Tune
+	}
+
+	return p.conf.Tune
+}
+
+func (s *server) current() *policy {
+	return s.policy.Load().(*policy)
+}
+
+// Read the config again and apply its reloadable sections: the routing, the users, certificate rules
+// and service accounts, and the limits. The connected clients keep what they were admitted with.
+// The other sections take a restart, their changes are only reported.
+func (s *server) reload(load func() (*config.Config, error)) error {
+	loaded, err := load()
+	if err != nil {
+		return err
+	}
+
+	previous := s.current().conf
+	conf := reloadable(previous, loaded)
+
+	// the pools of the upstreams are opened at the start
+	for _, route := range conf.Routes {
+		if _, exists := s.pools[route.Upstream]; !exists {
+			return fmt.Errorf("upstream %q of the routes is not running, new upstreams take a restart", route.Upstream)
+		}
+	}
+
+	next, err := newPolicy(conf)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(*reloadable(loaded, previous), *previous) {
+		logger.Warn("The config changed outside the routing, auth and limits, these changes take a restart")
+	}
+
+	s.policy.Store(next)
+	setLoggerLevel(conf)
+	for _, pool := range s.pools {
+		pool.SetOptions(ampq.PoolOptions{MaxSize: conf.Pool.Size, IdleTimeout: conf.Pool.IdleTimeout})
+	}
+	if sp := s.currentSpool(); sp != nil {
+		sp.SetLimits(s.spoolLimits())
+	}
+
+	logger.Info(fmt.Sprintf("Config reloaded: %d routes, %d service accounts", len(conf.Routes), len(conf.Accounts)))
+
+	return nil
+}
+
+// Reload on a signal, a failed reload keeps the config
+func (s *server) reloadOn(sig os.Signal, load func() (*config.Config, error)) {
+	if err := s.reload(load); err != nil {
+		logger.Error(fmt.Sprintf("Reload on %s failed, the config is kept: %s", sig, err.Error()))
+	}
+}
+
+// Copy of conf with the reloadable sections of loaded
+func reloadable(conf *config.Config, loaded *config.Config) *config.Config {
+	merged := *conf
+
+	merged.LogLevel = loaded.LogLevel
+	merged.Tune = loaded.Tune
+	merged.TLS.Tune = loaded.TLS.Tune
+	merged.Pool = loaded.Pool
+	merged.Recovery = loaded.Recovery
+	merged.Spool.MaxBytes = loaded.Spool.MaxBytes
+	merged.Spool.MaxMessages = loaded.Spool.MaxMessages
+	merged.Shutdown = loaded.Shutdown
+	merged.Auth = loaded.Auth
+	merged.ServerProperties = loaded.ServerProperties
+	merged.RoutesFile = loaded.RoutesFile
+	merged.Routes = loaded.Routes
+	merged.CredentialsFile = loaded.CredentialsFile
+	merged.Accounts = loaded.Accounts
+	merged.IdentityHeader = loaded.IdentityHeader
+
+	return &merged
+}
@@ -0,0 +1,119 @@
+package proxyserver
+
+import (
+	"fmt"
+	logger "github.com/sirupsen/logrus"
+	"github.com/sv-z/amqproxy/Internal/app/config"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Reply text of connection.close when the proxy shuts down
+const shutdownReason = "proxy shutting down"
+
+// How often the drain progress is logged
+const drainReportInterval = 5 * time.Second
+
+// How long the clients closed after the grace period have to answer connection.close
+const forceCloseTimeout = 5 * time.Second
+
+// Stop accepting and close the clients once they have nothing in flight, the busy ones after the grace period.
+// The readiness fails for the delay first so the load balancer stops sending clients.
+// A second SIGTERM or SIGINT skips the waits, SIGHUP still reloads the config.
+func (s *server) shutdown(sig os.Signal, delay time.Duration, signals <-chan os.Signal, load func() (*config.Config, error), serving *sync.WaitGroup) {
+	atomic.StoreInt32(&s.draining, 1)
+	logger.Info(fmt.Sprintf("Received %s, shutting down", sig))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	again := s.terminations(signals, load, stop)
+
+	if delay > 0 {
+		logger.Info(fmt.Sprintf("Readiness fails, the listeners close in %s", delay))
+		select {
+		case <-time.After(delay):
+		case sig := <-again:
+			logger.Warn(fmt.Sprintf("Received %s again, closing the listeners now", sig))
+		}
+	}
+
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	serving.Wait()
+
+	clients := s.clients.list("", "")
+	gracePeriod := s.current().conf.Shutdown.Grace
+	logger.Info(fmt.Sprintf("Listeners closed, draining %d client connections for up to %s", len(clients), gracePeriod))
+	for _, cl := range clients {
+		cl.conn.Drain(shutdownReason)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	grace := time.NewTimer(gracePeriod)
+	defer grace.Stop()
+	report := time.NewTicker(drainReportInterval)
+	defer report.Stop()
+
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			logger.Info("All client connections drained")
+			return
+		case <-report.C:
+			logger.Info(fmt.Sprintf("Draining, %d client connections left", len(s.clients.list("", ""))))
+		case <-grace.C:
+			waiting = false
+		case sig := <-again:
+			logger.Warn(fmt.Sprintf("Received %s again, closing the client connections now", sig))
+			waiting = false
+		}
+	}
+
+	busy := s.clients.list("", "")
+	for _, cl := range busy {
+		cl.conn.Kill(shutdownReason)
+	}
+	s.metrics.shutdownForced.Add(uint64(len(busy)))
+	logger.Warn(fmt.Sprintf("Closed %d busy client connections", len(busy)))
+
+	select {
+	case <-done:
+	case <-time.After(forceCloseTimeout):
+		logger.Warn(fmt.Sprintf("%d client connections did not close", len(s.clients.list("", ""))))
+	}
+}
+
+// Pass on the termination signals received until stop, the reload ones are handled meanwhile
+func (s *server) terminations(signals <-chan os.Signal, load func() (*config.Config, error), stop <-chan struct{}) <-chan os.Signal {
+	again := make(chan os.Signal, 1)
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case sig := <-signals:
+				switch sig {
+				case syscall.SIGHUP:
+					s.reloadOn(sig, load)
+				case syscall.SIGTERM, syscall.SIGINT:
+					select {
+					case again <- sig:
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	return again
+}
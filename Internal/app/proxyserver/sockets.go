@@ -0,0 +1,105 @@
+package proxyserver
+
+import (
+	"fmt"
+	logger "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment of the process started by an upgrade: the names of the passed sockets and the pipe it is ready on
+const (
+	listenFdsEnv = "AMQPROXY_LISTEN_FDS"
+	readyFdEnv   = "AMQPROXY_READY_FD"
+)
+
+// First file descriptor passed by systemd or by the upgraded process
+const listenFdsStart = 3
+
+// Names of the systemd sockets without a FileDescriptorName, in order
+var defaultSocketNames = []string{"amqp", "amqps", "http", "admin"}
+
+// Listening socket by name: "amqp", "amqps", "http" or "admin"
+type socket struct {
+	name     string
+	listener net.Listener // the TCP one, under the TLS of the amqps listener
+}
+
+// Sockets passed by systemd socket activation or by the process that upgraded to this one, by name.
+// The variables are removed so the processes started later do not take them.
+func inheritedSockets() (map[string]net.Listener, error) {
+	var names []string
+
+	if draft := os.Getenv(listenFdsEnv); draft != "" {
+		names = strings.Split(draft, ",")
+	} else if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid == os.Getpid() {
+		count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf(`parameter "LISTEN_FDS" must be positive integer`)
+		}
+
+		fdNames := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < count; i++ {
+			name := ""
+			if i < len(fdNames) && fdNames[i] != "unknown" {
+				name = fdNames[i]
+			}
+			if name == "" && i < len(defaultSocketNames) {
+				name = defaultSocketNames[i]
+			}
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range []string{listenFdsEnv, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(name)
+	}
+
+	sockets := make(map[string]net.Listener)
+	for i, name := range names {
+		file := os.NewFile(uintptr(listenFdsStart+i), name)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited socket %d %q: %s", listenFdsStart+i, name, err.Error())
+		}
+		sockets[name] = l
+	}
+
+	return sockets, nil
+}
+
+// Listen on the address unless the socket was inherited, the inherited one is taken out of the map
+func listen(inherited map[string]net.Listener, name string, address string) (net.Listener, error) {
+	if l, exists := inherited[name]; exists {
+		delete(inherited, name)
+		logger.Info(fmt.Sprintf(`Inherited %s socket on "%s"`, name, l.Addr()))
+		return l, nil
+	}
+
+	return net.Listen("tcp", address)
+}
+
+// Tell the process that upgraded to this one it can drain its clients
+func notifyUpgraded() {
+	draft := os.Getenv(readyFdEnv)
+	if draft == "" {
+		return
+	}
+	os.Unsetenv(readyFdEnv)
+
+	fd, err := strconv.Atoi(draft)
+	if err != nil {
+		logger.Error(fmt.Sprintf(`parameter "%s" must be integer`, readyFdEnv))
+		return
+	}
+
+	ready := os.NewFile(uintptr(fd), "upgrade")
+	defer ready.Close()
+
+	if _, err := ready.Write([]byte{1}); err != nil {
+		logger.Error(fmt.Sprintf("Cannot tell the previous process this one serves: %s", err.Error()))
+	}
+}
@@ -0,0 +1,214 @@
+package proxyserver
+
+import (
+	"fmt"
+	logger "github.com/sirupsen/logrus"
+	"github.com/sv-z/amqproxy/Internal/ampq"
+	transfer "github.com/sv-z/amqproxy/Internal/ampq/data-transfer"
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+	"github.com/sv-z/amqproxy/Internal/app/spool"
+	"time"
+)
+
+// How often the spool is forwarded again while the upstream is not reachable
+const spoolRetryInterval = 5 * time.Second
+
+// Most entries forwarded over one upstream connection at a time
+const spoolForwardBatch = 256
+
+// How often the spool held by another process is opened again
+const spoolLockRetryInterval = time.Second
+
+// Open the spool and forward it until stop is closed.
+// The process started by an upgrade gets the spool once the previous one let it go, nothing is spooled until then.
+func (s *server) openSpool(stop <-chan struct{}) error {
+	dir := s.current().conf.Spool.Dir
+
+	sp, err := spool.Open(dir, s.spoolLimits())
+	if err != nil && err != spool.ErrLocked {
+		return err
+	}
+
+	go func() {
+		if sp == nil {
+			logger.Warn(fmt.Sprintf(`Spool "%s" is used by another process, waiting for it`, dir))
+
+			ticker := time.NewTicker(spoolLockRetryInterval)
+			defer ticker.Stop()
+
+			for sp == nil {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+				}
+
+				if sp, err = spool.Open(dir, s.spoolLimits()); err != nil && err != spool.ErrLocked {
+					logger.Error(fmt.Sprintf("Cannot open the spool: %s", err.Error()))
+					return
+				}
+			}
+			logger.Info(fmt.Sprintf(`Spool "%s" opened`, dir))
+		}
+
+		s.spool.Store(sp)
+		s.forwardSpool(sp, stop)
+		sp.Close()
+	}()
+
+	return nil
+}
+
+// Limits of the spool in the current config
+func (s *server) spoolLimits() spool.Limits {
+	conf := s.current().conf
+	return spool.Limits{MaxBytes: conf.Spool.MaxBytes, MaxMessages: conf.Spool.MaxMessages}
+}
+
+// The open spool, nil while it is not
+func (s *server) currentSpool() *spool.Spool {
+	sp, _ := s.spool.Load().(*spool.Spool)
+	return sp
+}
+
+// Keep the messages of a client the upstream cannot take now, they are forwarded once it is back
+func (s *server) spoolClient(sp *spool.Spool, conn *ampq.Connection, upstream string, credentials ampq.Credentials) error {
+	logger.Warn(fmt.Sprintf("Upstream %q is not reachable, the messages of user %q vhost %q are spooled", upstream, conn.User, conn.VirtualHost))
+
+	return ampq.Spool(conn, func(messages []*spec091.Message) (int, error) {
+		entries := make([]spool.Entry, len(messages))
+		for i, message := range messages {
+			entries[i] = spool.Entry{
+				Upstream: upstream,
+				Vhost:    credentials.Vhost,
+				User:     credentials.User,
+				Message:  message,
+			}
+		}
+
+		return sp.Append(entries)
+	})
+}
+
+// Only the credentials from the configuration can be spooled, the client passwords are not written to the disk
+func (s *server) spoolable(sp *spool.Spool, credentials ampq.Credentials) bool {
+	if sp == nil {
+		return false
+	}
+
+	password, known := s.servicePassword(credentials.User)
+	return known && password == credentials.Password
+}
+
+// Password of a configured upstream user or of a service account
+func (s *server) servicePassword(user string) (string, bool) {
+	conf := s.current().conf
+	if user != "" && user == conf.Upstream.User {
+		return conf.Upstream.Password, true
+	}
+
+	for _, cluster := range conf.Clusters {
+		if user != "" && user == cluster.User {
+			return cluster.Password, true
+		}
+	}
+
+	for _, account := range conf.Accounts {
+		if account.Username == user {
+			return account.Password, true
+		}
+	}
+
+	return "", false
+}
+
+// Forward the spool whenever messages come in, and on an interval while the upstream is not reachable.
+// The entries left by the previous run go first.
+func (s *server) forwardSpool(sp *spool.Spool, stop <-chan struct{}) {
+	ticker := time.NewTicker(spoolRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		s.drainSpool(sp, stop)
+
+		select {
+		case <-stop:
+			return
+		case <-sp.Ready():
+		case <-ticker.C:
+		}
+	}
+}
+
+// Forward the spooled entries in order until the spool is empty or an upstream fails
+func (s *server) drainSpool(sp *spool.Spool, stop <-chan struct{}) {
+	for {
+		entries, err := sp.Peek(spoolForwardBatch)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Cannot read the spool: %s", err.Error()))
+			return
+		}
+		if len(entries) == 0 {
+			return
+		}
+
+		// the entries of the same upstream connection go together
+		first := entries[0]
+		messages := []*spec091.Message{first.Message}
+		for _, entry := range entries[1:] {
+			if entry.Upstream != first.Upstream || entry.Vhost != first.Vhost || entry.User != first.User {
+				break
+			}
+			messages = append(messages, entry.Message)
+		}
+
+		done, err := s.forwardEntries(first, messages)
+		if commitErr := sp.Commit(done); commitErr != nil {
+			logger.Error(fmt.Sprintf("Cannot move the spool cursor: %s", commitErr.Error()))
+			return
+		}
+		if err != nil {
+			stats := sp.Stats()
+			logger.Debug(fmt.Sprintf("Spool of %d entries (%d bytes) not forwarded to upstream %q: %s", stats.Messages, stats.Bytes, first.Upstream, err.Error()))
+			return
+		}
+
+		if stats := sp.Stats(); stats.Messages == 0 {
+			logger.Info(fmt.Sprintf("Spool forwarded, %d entries so far", stats.Forwarded))
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
+
+// Forward the entries of one upstream connection, the ones it cannot be opened for anymore are dropped
+func (s *server) forwardEntries(destination spool.Entry, messages []*spec091.Message) (int, error) {
+	pool, exists := s.pools[destination.Upstream]
+	if !exists {
+		logger.Error(fmt.Sprintf("Upstream %q is not configured anymore, %d spooled entries dropped", destination.Upstream, len(messages)))
+		return len(messages), nil
+	}
+
+	password, known := s.servicePassword(destination.User)
+	if !known {
+		logger.Error(fmt.Sprintf("User %q is not configured anymore, %d spooled entries dropped", destination.User, len(messages)))
+		return len(messages), nil
+	}
+
+	conf := s.current().conf
+	upstream, err := pool.Acquire(
+		ampq.Credentials{User: destination.User, Password: password, Vhost: destination.Vhost},
+		transfer.Table{"product": "amqproxy spool"},
+		ampq.Tune{ChannelMax: conf.Tune.ChannelMax, FrameMax: conf.Tune.FrameMax, Heartbeat: conf.Upstream.Heartbeat},
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer pool.Release(upstream)
+
+	return ampq.Forward(upstream, messages)
+}
@@ -0,0 +1,205 @@
+package proxyserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	logger "github.com/sirupsen/logrus"
+	"github.com/sv-z/amqproxy/Internal/app/auth"
+	"github.com/sv-z/amqproxy/Internal/app/config"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the certificate files are checked for changes
+const certReloadInterval = 10 * time.Second
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// Certificate and CA read from files, they are read again when a file changes.
+// A file that fails to load keeps the previous version in use.
+type certStore struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	caPool  *x509.CertPool
+	modTime time.Time // the newest modification time of the files
+}
+
+func newCertStore(certFile string, keyFile string, caFile string) (*certStore, error) {
+	store := &certStore{certFile: certFile, keyFile: keyFile, caFile: caFile}
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (s *certStore) load() error {
+	modTime := s.lastModified()
+
+	var cert *tls.Certificate
+	if s.certFile != "" {
+		pair, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		if err != nil {
+			return err
+		}
+		cert = &pair
+	}
+
+	var caPool *x509.CertPool
+	if s.caFile != "" {
+		pem, err := ioutil.ReadFile(s.caFile)
+		if err != nil {
+			return err
+		}
+
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf(`no certificate found in "%s"`, s.caFile)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cert, s.caPool, s.modTime = cert, caPool, modTime
+
+	return nil
+}
+
+// Reload the files when they change until stop is closed
+func (s *certStore) watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-ticker.C:
+			s.mu.RLock()
+			changed := s.lastModified().After(s.modTime)
+			s.mu.RUnlock()
+
+			if !changed {
+				continue
+			}
+
+			if err := s.load(); err != nil {
+				logger.Error(fmt.Sprintf("Certificate reload failed, the previous one is kept: %s", err.Error()))
+				continue
+			}
+			logger.Info(fmt.Sprintf(`Certificates reloaded from "%s" "%s"`, s.certFile, s.caFile))
+		}
+	}
+}
+
+func (s *certStore) lastModified() time.Time {
+	var last time.Time
+
+	for _, file := range []string{s.certFile, s.keyFile, s.caFile} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+
+	return last
+}
+
+func (s *certStore) certificate() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.cert
+}
+
+func (s *certStore) roots() *x509.CertPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.caPool
+}
+
+// Identity of the client certificate verified during the TLS handshake, false for plain connections
+func certificateUser(conn net.Conn, certs *auth.CertMapper) (string, bool, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || certs == nil {
+		return "", false, nil
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+
+	if err := tlsConn.Handshake(); err != nil {
+		return "", false, err
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return "", false, nil
+	}
+
+	user, ok := certs.User(state.PeerCertificates[0])
+	if !ok {
+		logger.Warn(fmt.Sprintf(`No user for the client certificate "%s"`, state.PeerCertificates[0].Subject))
+	}
+
+	return user, ok, nil
+}
+
+// TLS of the amqps listener, every handshake takes the current certificate and client CA
+func newServerTLS(conf config.TLS, stop <-chan struct{}) (*tls.Config, error) {
+	store, err := newCertStore(conf.CertFile, conf.KeyFile, conf.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	go store.watch(stop)
+
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				Certificates: []tls.Certificate{*store.certificate()},
+				ClientCAs:    store.roots(),
+				ClientAuth:   conf.ClientAuth,
+				MinVersion:   conf.MinVersion,
+			}, nil
+		},
+		MinVersion: conf.MinVersion,
+	}, nil
+}
+
+// Dial the broker over TLS, every connection takes the current pinned CA and proxy certificate
+func newUpstreamTLSDialer(conf config.Upstream, stop <-chan struct{}) (func(address string) (net.Conn, error), error) {
+	store, err := newCertStore(conf.TLS.CertFile, conf.TLS.KeyFile, conf.TLS.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	go store.watch(stop)
+
+	return func(address string) (net.Conn, error) {
+		// without a server name the host of the node is verified
+		return tls.DialWithDialer(&net.Dialer{Timeout: upstreamDialTimeout}, "tcp", address, &tls.Config{
+			RootCAs:    store.roots(),
+			ServerName: conf.TLS.ServerName,
+			MinVersion: conf.TLS.MinVersion,
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				if cert := store.certificate(); cert != nil {
+					return cert, nil
+				}
+				return &tls.Certificate{}, nil
+			},
+		})
+	}, nil
+}
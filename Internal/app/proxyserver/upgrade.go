@@ -0,0 +1,104 @@
+//go:build !windows
+// +build !windows
+
+package proxyserver
+
+import (
+	"fmt"
+	logger "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How long the new process has to serve before the upgrade is given up
+const upgradeTimeout = 30 * time.Second
+
+// Signals that start the binary again, the new process takes over the sockets
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+func isUpgradeSignal(sig os.Signal) bool {
+	return sig == syscall.SIGUSR2
+}
+
+// No upgrade while the process shuts down
+func ignoreUpgrades() {
+	signal.Ignore(upgradeSignals...)
+}
+
+// Start the binary again with the listening sockets and wait until it serves.
+// It reads the configuration again, with the arguments and the environment of this process.
+func (s *server) upgrade() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	var names []string
+	for _, sock := range s.sockets {
+		filer, ok := sock.listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("%s socket cannot be passed", sock.name)
+		}
+		file, err := filer.File()
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		files = append(files, file)
+		names = append(names, sock.name)
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	files = append(files, readyWriter)
+
+	var env []string
+	for _, variable := range os.Environ() {
+		name := strings.SplitN(variable, "=", 2)[0]
+		if name != listenFdsEnv && name != readyFdEnv && !strings.HasPrefix(name, "LISTEN_") {
+			env = append(env, variable)
+		}
+	}
+	env = append(env,
+		listenFdsEnv+"="+strings.Join(names, ","),
+		readyFdEnv+"="+strconv.Itoa(len(files)-1),
+	)
+
+	process, err := os.StartProcess(executable, os.Args, &os.ProcAttr{Env: env, Files: files})
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+	logger.Info(fmt.Sprintf("Started %s (pid %d), waiting for it to serve", executable, process.Pid))
+
+	// the pipe is closed without a byte when the new process exits
+	served := make(chan bool, 1)
+	go func() {
+		n, _ := ready.Read(make([]byte, 1))
+		served <- n == 1
+	}()
+
+	select {
+	case ok := <-served:
+		if !ok {
+			go process.Wait()
+			return fmt.Errorf("new process (pid %d) exited before serving", process.Pid)
+		}
+	case <-time.After(upgradeTimeout):
+		process.Kill()
+		go process.Wait()
+		return fmt.Errorf("new process (pid %d) did not serve within %s", process.Pid, upgradeTimeout)
+	}
+
+	logger.Info(fmt.Sprintf("New process (pid %d) serves, draining the clients of this one", process.Pid))
+	return process.Release()
+}
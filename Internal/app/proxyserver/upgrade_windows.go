@@ -0,0 +1,19 @@
+package proxyserver
+
+import (
+	"fmt"
+	"os"
+)
+
+// The sockets cannot be passed to a new process on Windows
+var upgradeSignals []os.Signal
+
+func isUpgradeSignal(os.Signal) bool {
+	return false
+}
+
+func ignoreUpgrades() {}
+
+func (s *server) upgrade() error {
+	return fmt.Errorf("upgrade is not supported on windows")
+}
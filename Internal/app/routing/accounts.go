@@ -0,0 +1,65 @@
+package routing
+
+import "fmt"
+
+// Account opens the upstream connections of the clients of a vhost and user as a service account.
+// The patterns are the ones of the rules.
+type Account struct {
+	Vhost    string
+	User     string
+	Username string
+	Password string
+}
+
+// Accounts picks the service account of a client with the first matching account
+type Accounts struct {
+	accounts []account
+}
+
+type account struct {
+	vhost    *matcher
+	user     *matcher
+	username string
+	password string
+}
+
+func NewAccounts(accounts []Account) (*Accounts, error) {
+	a := &Accounts{}
+
+	for i, acc := range accounts {
+		vhost, err := newMatcher(acc.Vhost)
+		if err != nil {
+			return nil, fmt.Errorf("account %d: vhost %s", i+1, err.Error())
+		}
+
+		user, err := newMatcher(acc.User)
+		if err != nil {
+			return nil, fmt.Errorf("account %d: user %s", i+1, err.Error())
+		}
+
+		a.accounts = append(a.accounts, account{
+			vhost:    vhost,
+			user:     user,
+			username: acc.Username,
+			password: acc.Password,
+		})
+	}
+
+	return a, nil
+}
+
+// Service account of a client, matched is false when no account applies
+func (a *Accounts) Lookup(vhost string, user string) (username string, password string, matched bool) {
+	for _, acc := range a.accounts {
+		if _, ok := acc.vhost.match(vhost); !ok {
+			continue
+		}
+		if _, ok := acc.user.match(user); !ok {
+			continue
+		}
+
+		return acc.username, acc.password, true
+	}
+
+	return "", "", false
+}
@@ -0,0 +1,158 @@
+package routing
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Rule sends the clients of a vhost and user to an upstream.
+// The patterns are exact, glob ("team-*") or a regular expression starting with "~".
+// Like the globs the regular expressions match the whole value, "~team-.+" is "~^team-.+$".
+type Rule struct {
+	Vhost    string
+	User     string
+	Upstream string
+	// vhost opened on the upstream, the client's one when empty. "$1" refers to a group of the vhost regular expression.
+	RewriteVhost string
+}
+
+// Router picks the upstream of a client with the first matching rule
+type Router struct {
+	rules []rule
+}
+
+type rule struct {
+	vhost        *matcher
+	user         *matcher
+	upstream     string
+	rewriteVhost string
+}
+
+func NewRouter(rules []Rule) (*Router, error) {
+	router := &Router{}
+
+	for i, r := range rules {
+		vhost, err := newMatcher(r.Vhost)
+		if err != nil {
+			return nil, fmt.Errorf("route %d: vhost %s", i+1, err.Error())
+		}
+
+		user, err := newMatcher(r.User)
+		if err != nil {
+			return nil, fmt.Errorf("route %d: user %s", i+1, err.Error())
+		}
+
+		router.rules = append(router.rules, rule{
+			vhost:        vhost,
+			user:         user,
+			upstream:     r.Upstream,
+			rewriteVhost: r.RewriteVhost,
+		})
+	}
+
+	return router, nil
+}
+
+// Upstream and upstream vhost of a client, matched is false when no rule applies.
+// The vhost is the client's one unless the rule rewrites it.
+func (r *Router) Route(vhost string, user string) (upstream string, upstreamVhost string, matched bool) {
+	for _, rule := range r.rules {
+		groups, ok := rule.vhost.match(vhost)
+		if !ok {
+			continue
+		}
+		if _, ok := rule.user.match(user); !ok {
+			continue
+		}
+
+		upstreamVhost = vhost
+		if rule.rewriteVhost != "" {
+			upstreamVhost = rule.vhost.expand(rule.rewriteVhost, vhost, groups)
+		}
+
+		return rule.upstream, upstreamVhost, true
+	}
+
+	return "", vhost, false
+}
+
+type matcher struct {
+	exact string
+	regex *regexp.Regexp // of the regular expressions and the globs
+	glob  bool           // the groups of a glob are not for the rewrite
+}
+
+func newMatcher(pattern string) (*matcher, error) {
+	switch {
+	case strings.HasPrefix(pattern, "~"):
+		// anchored, the group keeps the alternatives inside them
+		regex, err := regexp.Compile("^(?:" + pattern[1:] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %s", pattern, err.Error())
+		}
+		return &matcher{regex: regex}, nil
+
+	case strings.ContainsAny(pattern, "*?["):
+		regex, err := regexp.Compile(globExpression(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %s", pattern, err.Error())
+		}
+		return &matcher{regex: regex, glob: true}, nil
+	}
+
+	return &matcher{exact: pattern}, nil
+}
+
+// Regular expression of a glob: "*" is any text, "/" included, "?" any character and "[...]" a class
+func globExpression(glob string) string {
+	var expression strings.Builder
+	expression.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			expression.WriteString(".*")
+		case '?':
+			expression.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				// left unbalanced, the compilation reports it
+				expression.WriteString("[")
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expression.WriteString("[" + class + "]")
+			i += end
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	expression.WriteString("$")
+
+	return expression.String()
+}
+
+// Whether the value matches, with the positions of the groups of a regular expression
+func (m *matcher) match(value string) ([]int, bool) {
+	if m.regex == nil {
+		return nil, value == m.exact
+	}
+
+	groups := m.regex.FindStringSubmatchIndex(value)
+	return groups, groups != nil
+}
+
+// Template with the groups of the matched value, only regular expressions have groups
+func (m *matcher) expand(template string, value string, groups []int) string {
+	if m.regex == nil || m.glob {
+		return template
+	}
+
+	return string(m.regex.ExpandString(nil, template, value, groups))
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package spool
+
+import (
+	"os"
+	"syscall"
+)
+
+// Lock file held while the spool is open, the lock goes with the process
+func lockDir(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+
+	return file, nil
+}
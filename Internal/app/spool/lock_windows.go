@@ -0,0 +1,8 @@
+package spool
+
+import "os"
+
+// The lock file is only created, the spool must not be shared on Windows
+func lockDir(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+}
@@ -0,0 +1,651 @@
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	logger "github.com/sirupsen/logrus"
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A new segment file is started once the last one reaches that size
+var segmentSize int64 = 64 << 20
+
+const (
+	segmentSuffix = ".spool"
+	cursorName    = "cursor"
+	lockName      = "lock"
+)
+
+// ErrLocked is returned by Open when another process holds the spool
+var ErrLocked = errors.New("spool is used by another process")
+
+// Length and checksum of the record data
+const recordHeaderSize = 8
+
+// Entry is a spooled message or declaration with the upstream connection it goes to
+type Entry struct {
+	Upstream string // name of the upstream
+	Vhost    string
+	User     string
+	Message  *spec091.Message // the channel is not kept
+}
+
+// Limits of the entries waiting in the spool, zero means no limit
+type Limits struct {
+	MaxBytes    int64
+	MaxMessages int
+}
+
+// Stats tell how deep the spool is and what went through it since the start
+type Stats struct {
+	Messages  int   // waiting to be forwarded
+	Bytes     int64 // of the waiting entries
+	Stored    uint64
+	Forwarded uint64
+	Rejected  uint64 // the spool had no room left
+}
+
+// Spool is an append-only log of the entries accepted while no upstream is reachable.
+// The log is split into segment files, a segment is removed once all its entries are forwarded.
+// The cursor file keeps the position of the oldest entry not forwarded yet.
+// Peek and Commit are meant for a single goroutine forwarding the entries.
+type Spool struct {
+	mu       sync.Mutex
+	dir      string
+	limits   Limits
+	segments []uint64 // oldest first, the entries are appended to the last one
+	file     *os.File // of the last segment
+	size     int64    // of the last segment
+	cursor   position
+	peeked   []record // of the last Peek
+	stats    Stats
+	ready    chan struct{}
+	full     bool // an entry did not fit the limits, until entries are forwarded
+	lock     *os.File
+}
+
+type position struct {
+	segment uint64
+	offset  int64
+}
+
+// Where a record read by Peek ends and how big it is
+type record struct {
+	end  position
+	size int64
+}
+
+// Open the spool in dir, the entries left by a previous run are forwarded first.
+// A record cut short by a crash ends its segment, it was never confirmed.
+// Only one process opens the spool at a time, ErrLocked tells another one holds it.
+func Open(dir string, limits Limits) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockDir(filepath.Join(dir, lockName))
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := open(dir, limits)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	s.lock = lock
+
+	return s, nil
+}
+
+func open(dir string, limits Limits) (*Spool, error) {
+	s := &Spool{dir: dir, limits: limits, ready: make(chan struct{}, 1)}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		segment, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, segment)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	if err := s.readCursor(); err != nil {
+		return nil, err
+	}
+
+	// the segments before the cursor were forwarded already
+	for len(s.segments) > 0 && s.segments[0] < s.cursor.segment {
+		os.Remove(s.segmentPath(s.segments[0]))
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) > 0 && s.segments[0] != s.cursor.segment {
+		s.cursor = position{segment: s.segments[0]}
+	}
+
+	for _, segment := range s.segments {
+		offset := int64(0)
+		if segment == s.cursor.segment {
+			offset = s.cursor.offset
+		}
+		if err := s.scan(segment, offset); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.segments) == 0 {
+		if err := s.startSegment(1); err != nil {
+			return nil, err
+		}
+		s.cursor = position{segment: 1}
+		return s, s.writeCursor()
+	}
+
+	last := s.segments[len(s.segments)-1]
+	if s.file, err = os.OpenFile(s.segmentPath(last), os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return nil, err
+	}
+	info, err := s.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	s.size = info.Size()
+
+	if s.stats.Messages > 0 {
+		logger.Info(fmt.Sprintf(`Spool "%s" holds %d entries (%d bytes) to forward`, dir, s.stats.Messages, s.stats.Bytes))
+	}
+
+	// the cursor may have moved to the first segment left
+	return s, s.writeCursor()
+}
+
+// Count the entries of a segment from offset, the segment is cut at the first broken record
+func (s *Spool) scan(segment uint64, offset int64) error {
+	file, err := os.OpenFile(s.segmentPath(segment), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+
+	for {
+		size, _, err := readRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			logger.Warn(fmt.Sprintf(`Spool segment "%s" is cut at offset %d: %s`, s.segmentPath(segment), offset, err.Error()))
+			return file.Truncate(offset)
+		}
+
+		offset += size
+		s.stats.Messages++
+		s.stats.Bytes += size
+	}
+}
+
+// Append the entries and sync them to the disk, the first ones that fit the limits are stored.
+// It returns how many, the others are rejected.
+func (s *Spool) Append(entries []Entry) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// records not written yet, they are counted once they are
+	var (
+		buf      bytes.Buffer
+		messages int
+		stored   int
+		written  int // counted already, returned when a later write fails
+	)
+	write := func() error {
+		if err := s.write(buf.Bytes()); err != nil {
+			return err
+		}
+		written += messages
+		s.stats.Messages += messages
+		s.stats.Bytes += int64(buf.Len())
+		s.stats.Stored += uint64(messages)
+		buf.Reset()
+		messages = 0
+		return nil
+	}
+
+	// the entries written are forwarded even when the others fail
+	defer func() {
+		if written > 0 {
+			select {
+			case s.ready <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	for _, entry := range entries {
+		data, err := encode(entry)
+		if err != nil {
+			return written, err
+		}
+		size := int64(recordHeaderSize + len(data))
+
+		if s.limits.MaxBytes > 0 && s.stats.Bytes+int64(buf.Len())+size > s.limits.MaxBytes {
+			break
+		}
+		if s.limits.MaxMessages > 0 && s.stats.Messages+messages+1 > s.limits.MaxMessages {
+			break
+		}
+
+		if s.size+int64(buf.Len()) >= segmentSize {
+			if err := write(); err != nil {
+				return written, err
+			}
+			if err := s.startSegment(s.segments[len(s.segments)-1] + 1); err != nil {
+				return written, err
+			}
+		}
+
+		var header [recordHeaderSize]byte
+		binary.BigEndian.PutUint32(header[0:], uint32(len(data)))
+		binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(data))
+		buf.Write(header[:])
+		buf.Write(data)
+
+		messages++
+		stored++
+	}
+
+	// the entries are confirmed once they are on the disk
+	if err := write(); err != nil {
+		return written, err
+	}
+	if err := s.file.Sync(); err != nil {
+		return written, err
+	}
+
+	s.stats.Rejected += uint64(len(entries) - stored)
+	if stored < len(entries) {
+		s.full = true
+	}
+
+	return stored, nil
+}
+
+// Write to the last segment, a failed write is undone so the next records are not read as broken
+func (s *Spool) write(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	if _, err := s.file.Write(data); err != nil {
+		s.file.Truncate(s.size)
+		return err
+	}
+	s.size += int64(len(data))
+
+	return nil
+}
+
+// Close the last segment and start a new one
+func (s *Spool) startSegment(segment uint64) error {
+	if s.file != nil {
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+		s.file.Close()
+	}
+
+	file, err := os.OpenFile(s.segmentPath(segment), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	s.file, s.size = file, 0
+	s.segments = append(s.segments, segment)
+
+	return syncDir(s.dir)
+}
+
+// Oldest entries not forwarded yet, up to max of them
+func (s *Spool) Peek(max int) ([]Entry, error) {
+	s.mu.Lock()
+	cursor := s.cursor
+	segments := append([]uint64{}, s.segments...)
+	end := position{segment: segments[len(segments)-1], offset: s.size}
+	s.mu.Unlock()
+
+	var entries []Entry
+	s.peeked = nil
+
+	for _, segment := range segments {
+		if segment < cursor.segment {
+			continue
+		}
+
+		offset := int64(0)
+		if segment == cursor.segment {
+			offset = cursor.offset
+		}
+
+		limit := int64(-1)
+		if segment == end.segment {
+			limit = end.offset
+		}
+
+		more, err := s.read(segment, offset, limit, max-len(entries), &entries)
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			break
+		}
+	}
+
+	return entries, nil
+}
+
+// Read the records of a segment from offset up to limit, -1 is the end of the file.
+// more is false once max entries are read.
+func (s *Spool) read(segment uint64, offset int64, limit int64, max int, entries *[]Entry) (bool, error) {
+	file, err := os.Open(s.segmentPath(segment))
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return false, err
+	}
+	reader := bufio.NewReader(file)
+
+	for n := 0; n < max; n++ {
+		if limit >= 0 && offset >= limit {
+			return true, nil
+		}
+
+		size, data, err := readRecord(reader)
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf(`spool segment "%s" offset %d: %s`, s.segmentPath(segment), offset, err.Error())
+		}
+
+		entry, err := decode(data)
+		if err != nil {
+			return false, fmt.Errorf(`spool segment "%s" offset %d: %s`, s.segmentPath(segment), offset, err.Error())
+		}
+
+		offset += size
+		*entries = append(*entries, entry)
+		s.peeked = append(s.peeked, record{end: position{segment: segment, offset: offset}, size: size})
+	}
+
+	return false, nil
+}
+
+// The first n entries of the last Peek were forwarded, the cursor moves past them
+func (s *Spool) Commit(n int) error {
+	if n == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.peeked[:n] {
+		s.stats.Bytes -= r.size
+	}
+	s.stats.Messages -= n
+	s.stats.Forwarded += uint64(n)
+	s.full = false
+	s.cursor = s.peeked[n-1].end
+	s.peeked = nil
+
+	last := s.segments[len(s.segments)-1]
+
+	// an empty spool starts over with a new segment, the old ones are removed below
+	if s.stats.Messages == 0 && s.size > 0 {
+		if err := s.startSegment(last + 1); err != nil {
+			return err
+		}
+		s.cursor = position{segment: last + 1}
+	}
+
+	if err := s.writeCursor(); err != nil {
+		return err
+	}
+
+	for len(s.segments) > 1 && s.segments[0] < s.cursor.segment {
+		if err := os.Remove(s.segmentPath(s.segments[0])); err != nil {
+			return err
+		}
+		s.segments = s.segments[1:]
+	}
+
+	return nil
+}
+
+// Ready is signaled when entries are appended
+func (s *Spool) Ready() <-chan struct{} {
+	return s.ready
+}
+
+func (s *Spool) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats
+}
+
+// Change the limits of the entries appended from now on
+func (s *Spool) SetLimits(limits Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.limits = limits
+}
+
+// Whether the last entries were rejected for the limits, until some are forwarded
+func (s *Spool) Full() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.full
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.file.Close()
+	s.lock.Close()
+
+	return err
+}
+
+func (s *Spool) segmentPath(segment uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", segment, segmentSuffix))
+}
+
+// The cursor file holds "<segment> <offset>", the first segment is read from the start without it
+func (s *Spool) readCursor() error {
+	content, err := ioutil.ReadFile(filepath.Join(s.dir, cursorName))
+	if os.IsNotExist(err) {
+		if len(s.segments) > 0 {
+			s.cursor = position{segment: s.segments[0]}
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Sscanf(string(content), "%d %d", &s.cursor.segment, &s.cursor.offset); err != nil {
+		return fmt.Errorf(`spool cursor "%s" is broken: %s`, filepath.Join(s.dir, cursorName), err.Error())
+	}
+
+	return nil
+}
+
+// Replace the cursor file in one step, a crash leaves the old or the new one
+func (s *Spool) writeCursor() error {
+	path := filepath.Join(s.dir, cursorName)
+
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(file, "%d %d\n", s.cursor.segment, s.cursor.offset); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	return syncDir(s.dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// Read a record: its size on the disk and its data, io.EOF at the end of the segment
+func readRecord(reader *bufio.Reader) (int64, []byte, error) {
+	var header [recordHeaderSize]byte
+	if n, err := io.ReadFull(reader, header[:]); err != nil {
+		if n == 0 && err == io.EOF {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, fmt.Errorf("record header is cut short")
+	}
+
+	length := binary.BigEndian.Uint32(header[0:])
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return 0, nil, fmt.Errorf("record of %d bytes is cut short", length)
+	}
+
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return 0, nil, fmt.Errorf("record checksum does not match")
+	}
+
+	return int64(recordHeaderSize) + int64(length), data, nil
+}
+
+// Record data: the upstream, vhost and user, then the method, the content header and the body payloads.
+// The header is empty for a declaration.
+func encode(entry Entry) ([]byte, error) {
+	var buf bytes.Buffer
+
+	for _, field := range []string{entry.Upstream, entry.Vhost, entry.User} {
+		if len(field) > 0xFFFF {
+			return nil, fmt.Errorf("spool entry field of %d bytes is too long", len(field))
+		}
+		binary.Write(&buf, binary.BigEndian, uint16(len(field)))
+		buf.WriteString(field)
+	}
+
+	method, err := spec091.NewMethodFrame(0, entry.Message.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	var header []byte
+	if entry.Message.Header != nil {
+		h := *entry.Message.Header
+		h.BodySize = uint64(len(entry.Message.Body))
+		frame, err := spec091.NewHeaderFrame(0, &h)
+		if err != nil {
+			return nil, err
+		}
+		header = frame.Payload
+	}
+
+	for _, payload := range [][]byte{method.Payload, header, entry.Message.Body} {
+		binary.Write(&buf, binary.BigEndian, uint32(len(payload)))
+		buf.Write(payload)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decode(data []byte) (Entry, error) {
+	reader := bytes.NewReader(data)
+	malformed := fmt.Errorf("record data is malformed")
+
+	var fields [3]string
+	for i := range fields {
+		var length uint16
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return Entry{}, malformed
+		}
+		field := make([]byte, length)
+		if _, err := io.ReadFull(reader, field); err != nil {
+			return Entry{}, malformed
+		}
+		fields[i] = string(field)
+	}
+
+	var payloads [3][]byte
+	for i := range payloads {
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return Entry{}, malformed
+		}
+		if int64(length) > int64(reader.Len()) {
+			return Entry{}, malformed
+		}
+		payloads[i] = make([]byte, length)
+		io.ReadFull(reader, payloads[i])
+	}
+
+	message := &spec091.Message{}
+
+	var err error
+	if message.Method, err = (&spec091.Frame{Type: spec091.FrameMethod, Payload: payloads[0]}).Method(); err != nil {
+		return Entry{}, err
+	}
+
+	if len(payloads[1]) > 0 {
+		if message.Header, err = (&spec091.Frame{Type: spec091.FrameHeader, Payload: payloads[1]}).Header(); err != nil {
+			return Entry{}, err
+		}
+		message.Body = payloads[2]
+	}
+
+	return Entry{Upstream: fields[0], Vhost: fields[1], User: fields[2], Message: message}, nil
+}
@@ -0,0 +1,429 @@
+package spool
+
+import (
+	"bytes"
+	"github.com/sv-z/amqproxy/Internal/ampq/spec091"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+func openSpool(t *testing.T, dir string, limits Limits) *Spool {
+	s, err := Open(dir, limits)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	return s
+}
+
+func publish(key string, size int) Entry {
+	return Entry{
+		Upstream: "default",
+		Vhost:    "/",
+		User:     "guest",
+		Message: &spec091.Message{
+			Method: &spec091.BasicPublish{Exchange: "events", RoutingKey: key},
+			Header: &spec091.ContentHeader{ClassId: 60, Properties: spec091.BasicProperties{ContentType: "text/plain", DeliveryMode: 2}},
+			Body:   bytes.Repeat([]byte{'x'}, size),
+		},
+	}
+}
+
+// Size of the entry in the segment file
+func recordSize(t *testing.T, entry Entry) int64 {
+	data, err := encode(entry)
+	if err != nil {
+		t.Fatalf("encode: %s", err)
+	}
+
+	return int64(recordHeaderSize + len(data))
+}
+
+func routingKeys(entries []Entry) []string {
+	var keys []string
+	for _, entry := range entries {
+		keys = append(keys, entry.Message.Method.(*spec091.BasicPublish).RoutingKey)
+	}
+
+	return keys
+}
+
+func segmentFiles(t *testing.T, dir string) int {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(names)
+}
+
+func TestEncodeDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry Entry
+	}{
+		{"publish", publish("orders.created", 100)},
+		{"empty body", publish("orders.created", 0)},
+		{"properties", Entry{
+			Upstream: "teams",
+			Vhost:    "blue",
+			User:     "svc",
+			Message: &spec091.Message{
+				Method: &spec091.BasicPublish{Exchange: "events", RoutingKey: "key", Mandatory: true},
+				Header: &spec091.ContentHeader{ClassId: 60, Properties: spec091.BasicProperties{
+					ContentType:   "application/json",
+					DeliveryMode:  2,
+					Priority:      5,
+					CorrelationId: "42",
+					MessageId:     "m-1",
+					Timestamp:     time.Unix(1700000000, 0),
+				}},
+				Body: []byte(`{"id":1}`),
+			},
+		}},
+		{"declaration", Entry{
+			Upstream: "default",
+			Vhost:    "/",
+			User:     "guest",
+			Message:  &spec091.Message{Method: &spec091.QueueDeclare{Queue: "orders", Durable: true}},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := encode(test.entry)
+			if err != nil {
+				t.Fatalf("encode: %s", err)
+			}
+			entry, err := decode(data)
+			if err != nil {
+				t.Fatalf("decode: %s", err)
+			}
+
+			if entry.Upstream != test.entry.Upstream || entry.Vhost != test.entry.Vhost || entry.User != test.entry.User {
+				t.Errorf("got %s %s %s, want %s %s %s", entry.Upstream, entry.Vhost, entry.User, test.entry.Upstream, test.entry.Vhost, test.entry.User)
+			}
+
+			methodFrame, _ := spec091.NewMethodFrame(0, test.entry.Message.Method)
+			decodedFrame, _ := spec091.NewMethodFrame(0, entry.Message.Method)
+			if !bytes.Equal(methodFrame.Payload, decodedFrame.Payload) {
+				t.Errorf("got method %+v, want %+v", entry.Message.Method, test.entry.Message.Method)
+			}
+
+			if test.entry.Message.Header == nil {
+				if entry.Message.Header != nil || entry.Message.Body != nil {
+					t.Errorf("got content for a declaration")
+				}
+				return
+			}
+
+			if entry.Message.Header == nil {
+				t.Fatalf("content header is lost")
+			}
+			want, got := test.entry.Message.Header.Properties, entry.Message.Header.Properties
+			if got.ContentType != want.ContentType || got.DeliveryMode != want.DeliveryMode || got.Priority != want.Priority ||
+				got.CorrelationId != want.CorrelationId || got.MessageId != want.MessageId || !got.Timestamp.Equal(want.Timestamp) {
+				t.Errorf("got properties %+v, want %+v", got, want)
+			}
+			if entry.Message.Header.BodySize != uint64(len(test.entry.Message.Body)) {
+				t.Errorf("got body size %d, want %d", entry.Message.Header.BodySize, len(test.entry.Message.Body))
+			}
+			if !bytes.Equal(entry.Message.Body, test.entry.Message.Body) {
+				t.Errorf("the body differs")
+			}
+		})
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	data, err := encode(publish("key", 10))
+	if err != nil {
+		t.Fatalf("encode: %s", err)
+	}
+
+	for _, size := range []int{0, 1, 5, len(data) - 1} {
+		if _, err := decode(data[:size]); err == nil {
+			t.Errorf("decoded %d bytes of %d", size, len(data))
+		}
+	}
+}
+
+func TestAppendPeekCommit(t *testing.T) {
+	dir := tempDir(t)
+	s := openSpool(t, dir, Limits{})
+	defer s.Close()
+
+	stored, err := s.Append([]Entry{publish("a", 10), publish("b", 10), publish("c", 10)})
+	if err != nil || stored != 3 {
+		t.Fatalf("append: stored %d, %v", stored, err)
+	}
+	select {
+	case <-s.Ready():
+	default:
+		t.Errorf("ready is not signaled")
+	}
+
+	entries, err := s.Peek(2)
+	if err != nil {
+		t.Fatalf("peek: %s", err)
+	}
+	if keys := routingKeys(entries); len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Fatalf("peeked %v, want [a b]", keys)
+	}
+	if err := s.Commit(2); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+
+	entries, err = s.Peek(10)
+	if err != nil {
+		t.Fatalf("peek: %s", err)
+	}
+	if keys := routingKeys(entries); len(keys) != 1 || keys[0] != "c" {
+		t.Fatalf("peeked %v, want [c]", keys)
+	}
+	if err := s.Commit(1); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+
+	stats := s.Stats()
+	if stats.Messages != 0 || stats.Bytes != 0 || stats.Stored != 3 || stats.Forwarded != 3 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	size := recordSize(t, publish("a", 100))
+
+	tests := []struct {
+		name   string
+		limits Limits
+		stored int
+	}{
+		{"no limit", Limits{}, 4},
+		{"messages", Limits{MaxMessages: 3}, 3},
+		{"bytes", Limits{MaxBytes: 2 * size}, 2},
+		{"bytes short of a record", Limits{MaxBytes: 2*size - 1}, 1},
+		{"both", Limits{MaxMessages: 3, MaxBytes: 2 * size}, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := openSpool(t, tempDir(t), test.limits)
+			defer s.Close()
+
+			stored, err := s.Append([]Entry{publish("a", 100), publish("b", 100), publish("c", 100), publish("d", 100)})
+			if err != nil {
+				t.Fatalf("append: %s", err)
+			}
+			if stored != test.stored {
+				t.Fatalf("stored %d, want %d", stored, test.stored)
+			}
+
+			stats := s.Stats()
+			if stats.Messages != test.stored || stats.Bytes != int64(test.stored)*size || stats.Rejected != uint64(4-test.stored) {
+				t.Errorf("got stats %+v", stats)
+			}
+			if s.Full() != (test.stored < 4) {
+				t.Errorf("full is %v with %d entries of 4 stored", s.Full(), test.stored)
+			}
+		})
+	}
+}
+
+// A full spool takes entries again once some are forwarded
+func TestLimitsForwarded(t *testing.T) {
+	s := openSpool(t, tempDir(t), Limits{MaxMessages: 2})
+	defer s.Close()
+
+	if stored, err := s.Append([]Entry{publish("a", 10), publish("b", 10), publish("c", 10)}); err != nil || stored != 2 {
+		t.Fatalf("append: stored %d, %v", stored, err)
+	}
+	if stored, err := s.Append([]Entry{publish("c", 10)}); err != nil || stored != 0 {
+		t.Fatalf("append to a full spool: stored %d, %v", stored, err)
+	}
+	if !s.Full() {
+		t.Fatalf("the spool is not full")
+	}
+
+	if _, err := s.Peek(1); err != nil {
+		t.Fatalf("peek: %s", err)
+	}
+	if err := s.Commit(1); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	if s.Full() {
+		t.Errorf("the spool is full after an entry is forwarded")
+	}
+
+	if stored, err := s.Append([]Entry{publish("c", 10)}); err != nil || stored != 1 {
+		t.Fatalf("append: stored %d, %v", stored, err)
+	}
+	if stats := s.Stats(); stats.Rejected != 2 || stats.Stored != 3 {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	s.SetLimits(Limits{MaxMessages: 3})
+	if stored, err := s.Append([]Entry{publish("d", 10), publish("e", 10)}); err != nil || stored != 1 {
+		t.Errorf("append with the new limits: stored %d, %v", stored, err)
+	}
+}
+
+func TestSegmentRotation(t *testing.T) {
+	defer func(size int64) { segmentSize = size }(segmentSize)
+
+	entry := publish("a", 100)
+	// two records fill a segment
+	segmentSize = 2 * recordSize(t, entry)
+
+	dir := tempDir(t)
+	s := openSpool(t, dir, Limits{})
+	defer s.Close()
+
+	var entries []Entry
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		entries = append(entries, publish(key, 100))
+	}
+	if stored, err := s.Append(entries[:3]); err != nil || stored != 3 {
+		t.Fatalf("append: stored %d, %v", stored, err)
+	}
+	if stored, err := s.Append(entries[3:]); err != nil || stored != 2 {
+		t.Fatalf("append: stored %d, %v", stored, err)
+	}
+	if n := segmentFiles(t, dir); n != 3 {
+		t.Fatalf("got %d segments, want 3", n)
+	}
+
+	// the entries are read across the segments in order
+	peeked, err := s.Peek(3)
+	if err != nil {
+		t.Fatalf("peek: %s", err)
+	}
+	if keys := routingKeys(peeked); len(keys) != 3 || keys[0] != "a" || keys[2] != "c" {
+		t.Fatalf("peeked %v, want [a b c]", keys)
+	}
+	if err := s.Commit(3); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	if n := segmentFiles(t, dir); n != 2 {
+		t.Errorf("got %d segments after the first one is forwarded, want 2", n)
+	}
+
+	peeked, err = s.Peek(10)
+	if err != nil {
+		t.Fatalf("peek: %s", err)
+	}
+	if keys := routingKeys(peeked); len(keys) != 2 || keys[0] != "d" || keys[1] != "e" {
+		t.Fatalf("peeked %v, want [d e]", keys)
+	}
+	if err := s.Commit(2); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+
+	// an empty spool starts over with one new segment
+	if n := segmentFiles(t, dir); n != 1 {
+		t.Errorf("got %d segments once all is forwarded, want 1", n)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	defer func(size int64) { segmentSize = size }(segmentSize)
+	segmentSize = 2 * recordSize(t, publish("a", 100))
+
+	dir := tempDir(t)
+	s := openSpool(t, dir, Limits{})
+
+	var entries []Entry
+	for _, key := range []string{"a", "b", "c", "d"} {
+		entries = append(entries, publish(key, 100))
+	}
+	if stored, err := s.Append(entries); err != nil || stored != 4 {
+		t.Fatalf("append: stored %d, %v", stored, err)
+	}
+	if _, err := s.Peek(1); err != nil {
+		t.Fatalf("peek: %s", err)
+	}
+	if err := s.Commit(1); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	s.Close()
+
+	// the cursor is kept, the forwarded entry is not read again
+	s = openSpool(t, dir, Limits{})
+	defer s.Close()
+
+	if stats := s.Stats(); stats.Messages != 3 {
+		t.Errorf("got %d entries after the reopening, want 3", stats.Messages)
+	}
+	peeked, err := s.Peek(10)
+	if err != nil {
+		t.Fatalf("peek: %s", err)
+	}
+	if keys := routingKeys(peeked); len(keys) != 3 || keys[0] != "b" || keys[2] != "d" {
+		t.Errorf("peeked %v, want [b c d]", keys)
+	}
+}
+
+// A record cut short by a crash is dropped, the records appended next are read
+func TestReopenTruncated(t *testing.T) {
+	dir := tempDir(t)
+	s := openSpool(t, dir, Limits{})
+
+	if stored, err := s.Append([]Entry{publish("a", 100), publish("b", 100), publish("c", 100)}); err != nil || stored != 3 {
+		t.Fatalf("append: stored %d, %v", stored, err)
+	}
+	path := s.segmentPath(s.segments[len(s.segments)-1])
+	s.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openSpool(t, dir, Limits{})
+	defer s.Close()
+
+	size := recordSize(t, publish("a", 100))
+	if stats := s.Stats(); stats.Messages != 2 || stats.Bytes != 2*size {
+		t.Errorf("got stats %+v after the reopening, want 2 entries", stats)
+	}
+
+	if stored, err := s.Append([]Entry{publish("d", 100)}); err != nil || stored != 1 {
+		t.Fatalf("append: stored %d, %v", stored, err)
+	}
+	peeked, err := s.Peek(10)
+	if err != nil {
+		t.Fatalf("peek: %s", err)
+	}
+	if keys := routingKeys(peeked); len(keys) != 3 || keys[0] != "a" || keys[1] != "b" || keys[2] != "d" {
+		t.Errorf("peeked %v, want [a b d]", keys)
+	}
+}
+
+func TestLocked(t *testing.T) {
+	dir := tempDir(t)
+	s := openSpool(t, dir, Limits{})
+
+	if _, err := Open(dir, Limits{}); err != ErrLocked {
+		t.Errorf("second open: got %v, want ErrLocked", err)
+	}
+
+	s.Close()
+	s = openSpool(t, dir, Limits{})
+	s.Close()
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	logger "github.com/sirupsen/logrus"
 	"github.com/sv-z/amqproxy/Internal/app/config"
 	"github.com/sv-z/amqproxy/Internal/app/proxyserver"
@@ -8,14 +10,47 @@ import (
 )
 
 func main() {
-	conf, err := config.NewConfig()
+	var options config.Options
+	options.RegisterFlags(flag.CommandLine)
+	checkConfig := flag.Bool("check-config", false, "validate the config, print the effective one and exit")
+
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [-config file] [-check-config] [-setting value ...]\n\n", os.Args[0])
+		fmt.Fprintln(out, "The flags win over the config file, the file over the environment and the environment over .env.")
+		fmt.Fprintln(out, "SIGHUP reloads the routing, auth and limits settings.")
+		fmt.Fprintln(out)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	conf, err := config.Load(options)
 
 	if err != nil {
 		logger.Error(err)
 		os.Exit(1)
 	}
 
-	if err := proxyserver.Start(conf); err != nil {
+	if *checkConfig {
+		effective, err := conf.YAML()
+		if err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(effective)
+		return
+	}
+
+	reload := func() (*config.Config, error) {
+		return config.Load(options)
+	}
+
+	if err := proxyserver.Start(conf, reload); err != nil {
 		logger.Error(err)
 		os.Exit(1)
 	}